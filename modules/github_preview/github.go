@@ -197,7 +197,8 @@ func (c *GithubClient) resolveArtifact(ctx context.Context, branch string) (*ghW
 // an afero.Fs backed by the on-disk zip (random access, no full extraction into memory).
 // the cleanup function removes the temp file and must be called when the filesystem
 // is no longer needed. if expectedDigest is non-empty, the downloaded content is
-// verified against it (format: "sha256:<hex>").
+// verified against it (format: "sha256:<hex>"). when the artifact type is a
+// tarball, the tarball inside the zip is spooled and served instead.
 func (c *GithubClient) DownloadArtifact(ctx context.Context, artifactID int64, maxSize int64, expectedDigest string) (afero.Fs, int64, func(), error) {
 	if err := c.limiter.wait(ctx); err != nil {
 		return nil, 0, nil, fmt.Errorf("rate limited: %w", err)
@@ -251,6 +252,16 @@ func (c *GithubClient) DownloadArtifact(ctx context.Context, artifactID int64, m
 		return nil, 0, nil, fmt.Errorf("artifact %d digest mismatch: expected %s, got %s", artifactID, expectedDigest, digest)
 	}
 
+	if c.artifactType != "" && c.artifactType != ".zip" {
+		inner, innerSize, innerCleanup, err := c.openInnerArchive(fs, filepath.Dir(zipPath))
+		// the outer zip is no longer needed once the tarball is spooled
+		cleanup()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("extract artifact %d: %w", artifactID, err)
+		}
+		fs, size, cleanup = inner, innerSize, innerCleanup
+	}
+
 	c.log.Debug("downloaded artifact",
 		zap.Int64("artifact_id", artifactID),
 		zap.Int64("size_bytes", size),
@@ -260,6 +271,36 @@ func (c *GithubClient) DownloadArtifact(ctx context.Context, artifactID int64, m
 	return fs, size, cleanup, nil
 }
 
+// openInnerArchive opens the tarball wrapped inside an artifact zip. github
+// always serves artifacts as zips, so an uploaded .tar.zst arrives as a zip
+// holding a single .tar.zst file. the tarball is spooled into dir.
+func (c *GithubClient) openInnerArchive(zipFs afero.Fs, dir string) (afero.Fs, int64, func(), error) {
+	entries, err := afero.ReadDir(zipFs, "/")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var name string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if name != "" {
+			return nil, 0, nil, fmt.Errorf("artifact contains more than one file, expected a single %s", c.artifactType)
+		}
+		name = e.Name()
+	}
+	if name == "" {
+		return nil, 0, nil, fmt.Errorf("artifact contains no %s file", c.artifactType)
+	}
+
+	f, err := zipFs.Open("/" + name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+	return archive.SpoolFs(c.artifactType, f, dir)
+}
+
 // GetPRState fetches the state of a PR ("open", "closed").
 func (c *GithubClient) GetPRState(ctx context.Context, pr int) (string, error) {
 	prInfo, err := c.getPR(ctx, pr)
@@ -1,6 +1,7 @@
 package github_preview
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"context"
@@ -12,6 +13,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -242,3 +245,43 @@ func TestDownloadArtifact(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "<html>test</html>", string(content))
 }
+
+func TestDownloadArtifactInnerTarball(t *testing.T) {
+	// a .tar.zst artifact arrives from github wrapped in a zip
+	var tarBuf bytes.Buffer
+	zst, err := zstd.NewWriter(&tarBuf)
+	require.NoError(t, err)
+	tw := tar.NewWriter(zst)
+	body := []byte("<html>zstd</html>")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "index.html", Mode: 0o644, Size: int64(len(body))}))
+	_, err = tw.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, zst.Close())
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	fw, err := zw.Create("site.tar.zst")
+	require.NoError(t, err)
+	_, err = fw.Write(tarBuf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	zipBytes := zipBuf.Bytes()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(zipBytes)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(srv.URL, func(c *githubClientConfig) {
+		c.artifactType = ".tar.zst"
+	})
+	fs, _, cleanup, err := client.DownloadArtifact(context.Background(), 9002, 10*1024*1024, "")
+	require.NoError(t, err)
+	defer cleanup()
+
+	content, err := afero.ReadFile(fs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "<html>zstd</html>", string(content))
+}
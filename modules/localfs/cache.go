@@ -0,0 +1,159 @@
+package localfs
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readCache keeps the contents of recently read files in memory, evicting
+// the least recently used ones once their total size passes maxBytes.
+// entries are dropped by the watcher as soon as their file changes on disk.
+type readCache struct {
+	maxBytes int64
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // of *cacheEntry, by name
+	lru      *list.List               // most recently used first
+	curBytes int64
+	// bumped on every invalidation, so a read that raced with a change is
+	// not cached
+	gen uint64
+}
+
+type cacheEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func newReadCache(maxBytes int64) *readCache {
+	return &readCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// open returns the cached file for name, if there is one
+func (c *readCache) open(name string) (fs.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return newCachedFile(el.Value.(*cacheEntry)), true
+}
+
+// generation returns the current generation. take it before reading a file
+// from disk, and pass it to add along with what was read.
+func (c *readCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches e, unless something was invalidated since gen
+func (c *readCache) add(e *cacheEntry, gen uint64) {
+	size := int64(len(e.data))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[e.name]; ok {
+		c.removeLocked(el)
+	}
+	for c.curBytes+size > c.maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+	c.entries[e.name] = c.lru.PushFront(e)
+	c.curBytes += size
+}
+
+func (c *readCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.name)
+	c.curBytes -= int64(len(e.data))
+}
+
+// invalidate drops name and everything below it
+func (c *readCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[name]; ok {
+		c.removeLocked(el)
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	for k, el := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			c.removeLocked(el)
+		}
+	}
+}
+
+// clear drops every entry
+func (c *readCache) clear() {
+	c.invalidate(".")
+}
+
+// fill reads f into the cache if it is a regular file that fits, and
+// returns a file to serve in its place. gen is the generation taken before
+// f was opened.
+func (c *readCache) fill(name string, f fs.File, gen uint64) (fs.File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > c.maxBytes {
+		return f, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{name: name, data: data, modTime: info.ModTime(), mode: info.Mode()}
+	c.add(e, gen)
+	return newCachedFile(e), nil
+}
+
+// cachedFile is an open file served from a cache entry
+type cachedFile struct {
+	*bytes.Reader
+	entry *cacheEntry
+}
+
+func newCachedFile(e *cacheEntry) *cachedFile {
+	return &cachedFile{Reader: bytes.NewReader(e.data), entry: e}
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return cachedFileInfo{f.entry}, nil }
+func (f *cachedFile) Close() error               { return nil }
+
+type cachedFileInfo struct {
+	entry *cacheEntry
+}
+
+func (fi cachedFileInfo) Name() string       { return path.Base(fi.entry.name) }
+func (fi cachedFileInfo) Size() int64        { return int64(len(fi.entry.data)) }
+func (fi cachedFileInfo) Mode() fs.FileMode  { return fi.entry.mode }
+func (fi cachedFileInfo) ModTime() time.Time { return fi.entry.modTime }
+func (fi cachedFileInfo) IsDir() bool        { return false }
+func (fi cachedFileInfo) Sys() any           { return nil }
@@ -0,0 +1,87 @@
+package localfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func read(t *testing.T, fsys fs.FS, name string) string {
+	t.Helper()
+	data, err := fs.ReadFile(fsys, name)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func cached(c *readCache, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[name]
+	return ok
+}
+
+func TestReadCache(t *testing.T) {
+	root := t.TempDir()
+	for name, body := range map[string]string{
+		"a.txt":     "aaaa",
+		"b.txt":     "bbbb",
+		"c.txt":     "cccc",
+		"large.txt": "larger than the whole cache",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(body), 0o644))
+	}
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Join(root, "outside")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "outside", "x.txt"), []byte("x"), 0o644))
+	require.NoError(t, os.Symlink("b.txt", filepath.Join(root, "link.txt")))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s := &Localfs{Root: root, CacheSize: 10}
+	require.NoError(t, s.Provision(ctx))
+	defer s.Cleanup()
+
+	require.Equal(t, "aaaa", read(t, s, "a.txt"))
+	require.Equal(t, "bbbb", read(t, s, "b.txt"))
+	require.True(t, cached(s.current.Load().cache, "a.txt"))
+	require.True(t, cached(s.current.Load().cache, "b.txt"))
+
+	// a was used last, so b is evicted to make room for c
+	require.Equal(t, "aaaa", read(t, s, "a.txt"))
+	require.Equal(t, "cccc", read(t, s, "c.txt"))
+	require.True(t, cached(s.current.Load().cache, "a.txt"))
+	require.False(t, cached(s.current.Load().cache, "b.txt"))
+	require.EqualValues(t, 8, s.current.Load().cache.curBytes)
+
+	require.Equal(t, "larger than the whole cache", read(t, s, "large.txt"))
+	require.False(t, cached(s.current.Load().cache, "large.txt"))
+	require.Equal(t, "x", read(t, s, "outside/x.txt"))
+	require.False(t, cached(s.current.Load().cache, "outside/x.txt"), "files outside of the watched tree are not cached")
+	require.Equal(t, "bbbb", read(t, s, "link.txt"))
+	require.False(t, cached(s.current.Load().cache, "link.txt"), "changes would be reported under b.txt")
+
+	// served files can be seeked, like the ones on disk
+	f, err := s.Open("a.txt")
+	require.NoError(t, err)
+	_, err = f.(io.Seeker).Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "aa", string(rest))
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("AAAA"), 0o644))
+	require.Eventually(t, func() bool { return !cached(s.current.Load().cache, "a.txt") }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "AAAA", read(t, s, "a.txt"))
+
+	// a stale read is not cached once something changed
+	gen := s.current.Load().cache.generation()
+	s.current.Load().cache.invalidate("c.txt")
+	s.current.Load().cache.add(&cacheEntry{name: "b.txt", data: []byte("old")}, gen)
+	require.False(t, cached(s.current.Load().cache, "b.txt"))
+}
@@ -1,12 +1,18 @@
 package localfs
 
 import (
+	"fmt"
 	"io/fs"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/spf13/afero"
+	"github.com/dustin/go-humanize"
+	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 )
 
@@ -15,9 +21,36 @@ var _ fs.FS = (*Localfs)(nil)
 type Localfs struct {
 	Root string `json:"root"`
 
-	a   afero.Fs
-	log *zap.Logger
-	fs.FS
+	// how symlinks under the root are served: follow (the default) serves
+	// them wherever they point, deny never serves them, and within_root only
+	// serves the ones that resolve to somewhere under the root
+	Symlinks string `json:"symlinks,omitempty"`
+
+	// globs of files that are never served or listed, e.g. .git or .env*. a
+	// glob without a slash matches any path element, one with a slash is
+	// matched against the path from the root, along with everything below.
+	Hide []string `json:"hide,omitempty"`
+
+	// keep up to this many bytes of recently read files in memory. the tree
+	// under the root is watched, and cached files are dropped as soon as
+	// they change on disk. zero disables the cache.
+	CacheSize int64 `json:"cache_size,omitempty"`
+
+	// treat the root as a pointer, usually a symlink, to the current
+	// release directory. it is watched, and when it moves new requests are
+	// served from the new release, while the previous one stays readable
+	// until the requests and files still using it are done.
+	Releases bool `json:"releases,omitempty"`
+
+	log         *zap.Logger
+	fileSystems caddy.FileSystems
+
+	id       uint64        // tells apart the releases of several localfs
+	seq      atomic.Uint64 // numbers the releases of this one
+	current  atomic.Pointer[release]
+	switchMu sync.Mutex
+	closed   bool // no more switches once cleaned up
+	pointer  *fsnotify.Watcher
 
 	closers []func()
 }
@@ -38,6 +71,31 @@ func (co *Localfs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				// not enough args
 				return d.ArgErr()
 			}
+		case "symlinks":
+			if !d.Args(&co.Symlinks) {
+				// not enough args
+				return d.ArgErr()
+			}
+		case "hide":
+			globs := d.RemainingArgs()
+			if len(globs) == 0 {
+				return d.ArgErr()
+			}
+			co.Hide = append(co.Hide, globs...)
+		case "releases":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			co.Releases = true
+		case "cache_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid cache_size: %s", d.Val())
+			}
+			co.CacheSize = int64(size)
 		default:
 			return d.SyntaxErr("invalid localfs option: " + vKey)
 		}
@@ -46,8 +104,16 @@ func (co *Localfs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 }
 
 func (s *Localfs) Open(name string) (fs.File, error) {
-	name = strings.Trim(name, "/")
-	return s.FS.Open(name)
+	if !s.Releases {
+		return s.current.Load().open(name)
+	}
+	// the file holds on to its release until it is closed, so a switch
+	// does not pull the release out from under a read
+	rel := s.acquire()
+	if rel == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrClosed}
+	}
+	return rel.openPinned(name)
 }
 
 func (s *Localfs) CaddyModule() caddy.ModuleInfo {
@@ -63,16 +129,57 @@ func (s *Localfs) Provision(ctx caddy.Context) error {
 	rp := caddy.NewReplacer()
 	s.Root = rp.ReplaceAll(s.Root, "")
 	s.log = ctx.Logger()
-	s.a = afero.NewBasePathFs(afero.NewOsFs(), s.Root)
-	s.FS = afero.NewIOFS(s.a)
+	for _, glob := range s.Hide {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("localfs: invalid hide glob %q: %w", glob, err)
+		}
+	}
+	switch s.Symlinks {
+	case "", symlinksFollow, symlinksDeny, symlinksWithinRoot:
+	default:
+		return fmt.Errorf("localfs: invalid symlinks policy %q, expected follow, deny or within_root", s.Symlinks)
+	}
+	s.fileSystems = ctx.FileSystems()
+	s.id = instances.Add(1)
+
+	dir := s.Root
+	if s.Releases {
+		var err error
+		if dir, err = filepath.EvalSymlinks(s.Root); err != nil {
+			return fmt.Errorf("localfs: resolving release: %w", err)
+		}
+	}
+	rel, err := s.openRelease(dir)
+	if err != nil {
+		return fmt.Errorf("localfs: %w", err)
+	}
+	s.current.Store(rel)
+	if s.Releases {
+		if err := s.watchPointer(); err != nil {
+			rel.release()
+			return fmt.Errorf("localfs: %w", err)
+		}
+		// catch a switch that happened before the watch was in place
+		s.switchRelease()
+	}
 
-	s.log.Debug("provisioned localfs", zap.Any("root", s.Root))
+	s.log.Debug("provisioned localfs", zap.Any("root", s.Root), zap.String("symlinks", s.Symlinks), zap.Strings("hide", s.Hide), zap.Int64("cache_size", s.CacheSize), zap.Bool("releases", s.Releases))
 	return nil
 }
 
 func (s *Localfs) Cleanup() error {
+	if s.pointer != nil {
+		s.pointer.Close()
+	}
 	for _, closer := range s.closers {
 		closer()
 	}
+	// files still open keep their release until they are closed
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+	s.closed = true
+	if rel := s.current.Load(); rel != nil {
+		rel.release()
+	}
 	return nil
 }
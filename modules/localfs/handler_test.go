@@ -0,0 +1,206 @@
+package localfs_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/localfs"
+	"github.com/stretchr/testify/require"
+)
+
+// newDeployDir lays out a deploy dir with a dotfile, a .git dir and
+// symlinks that stay inside of it and ones that lead out
+func newDeployDir(t *testing.T) string {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0o644))
+
+	root := t.TempDir()
+	for name, body := range map[string]string{
+		"index.html":      "home",
+		".env":            "TOKEN=1",
+		".git/config":     "[core]",
+		"assets/app.js":   "app",
+		"private/key.pem": "key",
+	} {
+		p := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(body), 0o644))
+	}
+	require.NoError(t, os.Symlink("index.html", filepath.Join(root, "home.html")))
+	require.NoError(t, os.Symlink("assets", filepath.Join(root, "static")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "passwd")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	return root
+}
+
+func provision(t *testing.T, l *localfs.Localfs) *localfs.Localfs {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	require.NoError(t, l.Provision(ctx))
+	t.Cleanup(func() { l.Cleanup() })
+	return l
+}
+
+func listing(t *testing.T, fsys fs.FS, dir string) []string {
+	t.Helper()
+	f, err := fsys.Open(dir)
+	require.NoError(t, err)
+	defer f.Close()
+	entries, err := f.(fs.ReadDirFile).ReadDir(-1)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestLocalfsSymlinks(t *testing.T) {
+	root := newDeployDir(t)
+
+	for _, tc := range []struct {
+		policy  string
+		served  []string
+		refused []string
+		listed  []string
+	}{
+		{
+			policy: "follow",
+			served: []string{"index.html", "home.html", "static/app.js", "passwd", "escape/passwd"},
+			listed: []string{".env", ".git", "assets", "escape", "home.html", "index.html", "passwd", "private", "static"},
+		},
+		{
+			policy:  "deny",
+			served:  []string{"index.html", "assets/app.js"},
+			refused: []string{"home.html", "static/app.js", "passwd", "escape/passwd"},
+			listed:  []string{".env", ".git", "assets", "index.html", "private"},
+		},
+		{
+			policy:  "within_root",
+			served:  []string{"index.html", "home.html", "static/app.js"},
+			refused: []string{"passwd", "escape/passwd"},
+			listed:  []string{".env", ".git", "assets", "home.html", "index.html", "private", "static"},
+		},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			l := provision(t, &localfs.Localfs{Root: root, Symlinks: tc.policy})
+			for _, name := range tc.served {
+				_, err := fs.ReadFile(l, "/"+name)
+				require.NoError(t, err, name)
+			}
+			for _, name := range tc.refused {
+				_, err := fs.ReadFile(l, "/"+name)
+				require.Error(t, err, name)
+			}
+			require.Equal(t, tc.listed, listing(t, l, "/"))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		l := &localfs.Localfs{Root: root, Symlinks: "sometimes"}
+		require.ErrorContains(t, l.Provision(ctx), "invalid symlinks policy")
+	})
+}
+
+func TestLocalfsHide(t *testing.T) {
+	root := newDeployDir(t)
+	for _, policy := range []string{"follow", "within_root"} {
+		t.Run(policy, func(t *testing.T) {
+			l := provision(t, &localfs.Localfs{Root: root, Symlinks: policy, Hide: []string{".*", "/private/*.pem"}})
+			for _, name := range []string{".env", ".git/config", "private/key.pem"} {
+				_, err := fs.ReadFile(l, name)
+				require.ErrorIs(t, err, fs.ErrNotExist, name)
+			}
+			body, err := fs.ReadFile(l, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "home", string(body))
+
+			require.NotContains(t, listing(t, l, "/"), ".env")
+			require.NotContains(t, listing(t, l, "/"), ".git")
+			require.Empty(t, listing(t, l, "private"))
+
+			// partial reads skip hidden entries without ending early
+			f, err := l.Open(".")
+			require.NoError(t, err)
+			defer f.Close()
+			var names []string
+			for {
+				entries, err := f.(fs.ReadDirFile).ReadDir(1)
+				if err != nil {
+					break
+				}
+				require.Len(t, entries, 1)
+				names = append(names, entries[0].Name())
+			}
+			slices.Sort(names)
+			require.Equal(t, listing(t, l, "/"), names)
+		})
+	}
+}
+
+func TestLocalfsCacheSeesEdits(t *testing.T) {
+	root := newDeployDir(t)
+	l := provision(t, &localfs.Localfs{Root: root, CacheSize: 1 << 20, Hide: []string{".git"}})
+
+	read := func(name string) string {
+		data, err := fs.ReadFile(l, name)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+	require.Equal(t, "home", read("index.html"))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "index.html"), []byte("edited"), 0o644))
+	require.Eventually(t, func() bool { return read("index.html") == "edited" }, 5*time.Second, 10*time.Millisecond)
+
+	// directories created after startup are watched too
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "blog", "2024"), 0o755))
+	post := filepath.Join(root, "blog", "2024", "post.html")
+	require.NoError(t, os.WriteFile(post, []byte("draft"), 0o644))
+	require.Eventually(t, func() bool { return read("blog/2024/post.html") == "draft" }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, os.WriteFile(post, []byte("published"), 0o644))
+	require.Eventually(t, func() bool { return read("blog/2024/post.html") == "published" }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.Remove(post))
+	require.Eventually(t, func() bool {
+		_, err := fs.ReadFile(l, "blog/2024/post.html")
+		return errors.Is(err, fs.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the cache does not get around hide
+	_, err := fs.ReadFile(l, ".git/config")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLocalfsCacheFollowsRootSymlink(t *testing.T) {
+	dir := t.TempDir()
+	for _, release := range []string{"v1", "v2"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, release), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, release, "index.html"), []byte(release), 0o644))
+	}
+	current := filepath.Join(dir, "current")
+	require.NoError(t, os.Symlink("v1", current))
+	l := provision(t, &localfs.Localfs{Root: current, CacheSize: 1 << 20})
+
+	body, err := fs.ReadFile(l, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(body))
+
+	// switch releases the way deploy tools do, with a rename over the link
+	require.NoError(t, os.Symlink("v2", filepath.Join(dir, "current.tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "current.tmp"), current))
+	require.Eventually(t, func() bool {
+		body, err := fs.ReadFile(l, "index.html")
+		return err == nil && string(body) == "v2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,82 @@
+package localfs
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gfx-labs/swim/pkg/fsmap"
+	"go.uber.org/zap"
+)
+
+// PinRelease is an http handler that pins every request to the release of a
+// localfs in releases mode that is current when the request starts, so all
+// the files of one request come from the same release, even if the release
+// is switched halfway through. the release stays open until the request is
+// done. it swaps the "fs" variable for the pinned release, so file_server
+// and try_files read from it.
+type PinRelease struct {
+	// the filesystem to pin. defaults to the one named by the "fs" variable,
+	// as set by the fs directive.
+	FileSystem string `json:"filesystem,omitempty"`
+
+	log         *zap.Logger
+	fileSystems caddy.FileSystems
+}
+
+func (p *PinRelease) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.localfs_release",
+		New: func() caddy.Module {
+			return new(PinRelease)
+		},
+	}
+}
+
+func (p *PinRelease) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			// optional arg
+			p.FileSystem = d.Val()
+		}
+		if d.NextArg() {
+			// too many args
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+func (p *PinRelease) Provision(ctx caddy.Context) error {
+	p.log = ctx.Logger()
+	p.fileSystems = ctx.FileSystems()
+	return nil
+}
+
+func (p *PinRelease) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	name := p.FileSystem
+	if name == "" {
+		name, _ = caddyhttp.GetVar(r.Context(), "fs").(string)
+	}
+	fsys, ok := p.fileSystems.Get(name)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	l, ok := fsmap.Unwrap(fsys).(*Localfs)
+	if !ok || !l.Releases {
+		p.log.Debug("filesystem is not a localfs in releases mode, not pinning", zap.String("fs", name))
+		return next.ServeHTTP(w, r)
+	}
+	rel := l.acquire()
+	if rel == nil {
+		return next.ServeHTTP(w, r)
+	}
+	defer rel.release()
+
+	// set the filesystem variable for downstream handlers (file_server, try_files, etc.)
+	caddyhttp.SetVar(r.Context(), "fs", rel.name)
+	return next.ServeHTTP(w, r)
+}
+
+var _ caddyhttp.MiddlewareHandler = (*PinRelease)(nil)
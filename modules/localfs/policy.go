@@ -0,0 +1,127 @@
+package localfs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	symlinksFollow     = "follow"
+	symlinksDeny       = "deny"
+	symlinksWithinRoot = "within_root"
+)
+
+// hidden reports whether name, or a directory it is in, matches a hide glob
+func (s *Localfs) hidden(name string) bool {
+	if name == "." {
+		return false
+	}
+	elems := strings.Split(name, "/")
+	for _, glob := range s.Hide {
+		if strings.Contains(glob, "/") {
+			glob = strings.Trim(glob, "/")
+			for i := range elems {
+				if ok, _ := path.Match(glob, strings.Join(elems[:i+1], "/")); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for _, elem := range elems {
+			if ok, _ := path.Match(glob, elem); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkNoSymlinks fails if name or any directory on the way to it is a
+// symlink. the root itself may be one.
+func (r *release) checkNoSymlinks(name string) error {
+	if name == "." {
+		return nil
+	}
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		p := strings.Join(elems[:i+1], "/")
+		info, err := r.root.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			r.s.log.Debug("refusing to follow symlink", zap.String("path", p))
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return nil
+}
+
+// filtersListings reports whether directory listings need to be filtered
+func (r *release) filtersListings() bool {
+	return len(r.s.Hide) > 0 || r.root != nil
+}
+
+// filterDir wraps f so that its listing leaves out what Open would refuse.
+// anything that is not a directory is returned as is.
+func (r *release) filterDir(name string, f fs.File) (fs.File, error) {
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		return f, nil
+	}
+	return &filteredDir{ReadDirFile: dir, rel: r, name: name}, nil
+}
+
+// filteredDir is a directory whose listing hides the entries that are not
+// served
+type filteredDir struct {
+	fs.ReadDirFile
+	rel  *release
+	name string
+}
+
+func (d *filteredDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		kept := entries[:0]
+		for _, e := range entries {
+			if d.rel.serves(path.Join(d.name, e.Name()), e) {
+				kept = append(kept, e)
+			}
+		}
+		// a partial listing may only be empty at the end of the directory
+		if len(kept) > 0 || n <= 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// serves reports whether a directory entry can be opened
+func (r *release) serves(name string, e fs.DirEntry) bool {
+	if r.s.hidden(name) {
+		return false
+	}
+	if e.Type()&fs.ModeSymlink == 0 {
+		return true
+	}
+	switch r.s.Symlinks {
+	case symlinksDeny:
+		return false
+	case symlinksWithinRoot:
+		// fails for links that lead out of the root, or nowhere
+		_, err := r.root.Stat(name)
+		return err == nil
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package localfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// releaseFsPrefix namespaces our entries in the global FileSystems map
+const releaseFsPrefix = "localfs_release:"
+
+// instances numbers every provisioned localfs
+var instances atomic.Uint64
+
+// release is the tree under one resolved root directory. without releases
+// mode there is only ever one. in releases mode it is reference counted, so
+// a release that has been switched away from stays open until the last
+// request and file using it let go.
+type release struct {
+	s       *Localfs
+	dir     string
+	fs      fs.FS
+	root    *os.Root // for the deny and within_root policies
+	cache   *readCache
+	watcher *treeWatcher
+	name    string // key in the FileSystems map, releases mode only
+
+	// open files and pinned requests, plus one for as long as the release
+	// is current
+	refs atomic.Int64
+}
+
+// openRelease opens dir with the symlink policy, hide globs and cache of s
+func (s *Localfs) openRelease(dir string) (*release, error) {
+	r := &release{s: s, dir: dir}
+	r.refs.Store(1)
+	switch s.Symlinks {
+	case symlinksDeny, symlinksWithinRoot:
+		// os.Root refuses to resolve anything outside of the root
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return nil, err
+		}
+		r.root = root
+		r.fs = root.FS()
+	default:
+		r.fs = afero.NewIOFS(afero.NewBasePathFs(afero.NewOsFs(), dir))
+	}
+	if s.CacheSize > 0 {
+		r.cache = newReadCache(s.CacheSize)
+		watcher, err := watchTree(dir, r.cache, s.log)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("watching %s for the read cache: %w", dir, err)
+		}
+		r.watcher = watcher
+	}
+	if s.Releases {
+		r.name = fmt.Sprintf("%s%d-%d", releaseFsPrefix, s.id, s.seq.Add(1))
+		if s.fileSystems != nil {
+			s.fileSystems.Register(r.name, &releaseFs{r})
+		}
+	}
+	return r, nil
+}
+
+// open opens name in the release, applying the policies of the localfs
+func (r *release) open(name string) (fs.File, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if r.s.hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if r.s.Symlinks == symlinksDeny {
+		if err := r.checkNoSymlinks(name); err != nil {
+			return nil, err
+		}
+	}
+	var gen uint64
+	if r.cache != nil {
+		if f, ok := r.cache.open(name); ok {
+			return f, nil
+		}
+		gen = r.cache.generation()
+	}
+	f, err := r.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil && r.watcher.covers(name) {
+		if f, err = r.cache.fill(name, f, gen); err != nil {
+			return nil, err
+		}
+	}
+	if r.filtersListings() {
+		return r.filterDir(name, f)
+	}
+	return f, nil
+}
+
+// openPinned opens name with a reference that the caller already took, and
+// hands it to the file
+func (r *release) openPinned(name string) (fs.File, error) {
+	f, err := r.open(name)
+	if err != nil {
+		r.release()
+		return nil, err
+	}
+	return &releaseFile{File: f, rel: r}, nil
+}
+
+// acquire takes a reference, failing if the release has already drained
+func (r *release) acquire() bool {
+	for {
+		n := r.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (r *release) release() {
+	if r.refs.Add(-1) == 0 {
+		r.close()
+		r.s.log.Debug("release drained", zap.String("dir", r.dir))
+	}
+}
+
+func (r *release) close() {
+	if r.name != "" && r.s.fileSystems != nil {
+		r.s.fileSystems.Unregister(r.name)
+	}
+	if r.watcher != nil {
+		r.watcher.Close()
+	}
+	if r.root != nil {
+		r.root.Close()
+	}
+}
+
+// acquire returns the current release with a reference taken on it, or nil
+// once the localfs has been cleaned up
+func (s *Localfs) acquire() *release {
+	for {
+		rel := s.current.Load()
+		if rel.acquire() {
+			return rel
+		}
+		if s.current.Load() == rel {
+			// drained while still current, so it was cleaned up
+			return nil
+		}
+		// switched away from and drained just now, try the new one
+	}
+}
+
+// watchPointer watches the directory the root is in, and switches to a new
+// release whenever the root changes
+func (s *Localfs) watchPointer() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(filepath.Clean(s.Root))); err != nil {
+		w.Close()
+		return err
+	}
+	s.pointer = w
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == filepath.Clean(s.Root) {
+					s.switchRelease()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// events may have been lost, look for ourselves
+				s.log.Warn("release pointer watcher error", zap.Error(err))
+				s.switchRelease()
+			}
+		}
+	}()
+	return nil
+}
+
+// switchRelease makes the release that the root points at current, if it
+// is not already. the previous release is released, and closes once the
+// requests and files still using it are done.
+func (s *Localfs) switchRelease() {
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+	if s.closed {
+		return
+	}
+	dir, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		// e.g. in between the rm and ln of a non-atomic switch. the next
+		// event brings it back.
+		s.log.Debug("unable to resolve release, keeping the current one", zap.String("root", s.Root), zap.Error(err))
+		return
+	}
+	cur := s.current.Load()
+	if cur == nil || dir == cur.dir {
+		return
+	}
+	next, err := s.openRelease(dir)
+	if err != nil {
+		s.log.Warn("unable to open release, keeping the current one", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	s.current.Store(next)
+	cur.release()
+	s.log.Info("switched release", zap.String("from", cur.dir), zap.String("to", dir))
+}
+
+// releaseFs serves a single release. it is what requests pinned by the
+// localfs_release handler read from.
+type releaseFs struct {
+	rel *release
+}
+
+func (f *releaseFs) Open(name string) (fs.File, error) {
+	if !f.rel.acquire() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.rel.openPinned(name)
+}
+
+// releaseFile holds a reference on its release until it is closed
+type releaseFile struct {
+	fs.File
+	rel  *release
+	once sync.Once
+}
+
+func (f *releaseFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.rel.release)
+	return err
+}
+
+func (f *releaseFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *releaseFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *releaseFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, &fs.PathError{Op: "readdir", Err: errors.ErrUnsupported}
+}
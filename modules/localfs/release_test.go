@@ -0,0 +1,138 @@
+package localfs
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+// newReleases lays out releases v1 and v2 under dir, and points current at v1
+func newReleases(t *testing.T) (dir, current string) {
+	dir = t.TempDir()
+	for _, release := range []string{"v1", "v2"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "releases", release), 0o755))
+		for name, body := range map[string]string{"index.html": release, "app.js": "app " + release} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "releases", release, name), []byte(body), 0o644))
+		}
+	}
+	current = filepath.Join(dir, "current")
+	require.NoError(t, os.Symlink("releases/v1", current))
+	return dir, current
+}
+
+// flip points current at release the way deploy tools do, with a rename
+// over the link
+func flip(t *testing.T, dir, release string) {
+	tmp := filepath.Join(dir, "current.tmp")
+	require.NoError(t, os.Symlink("releases/"+release, tmp))
+	require.NoError(t, os.Rename(tmp, filepath.Join(dir, "current")))
+}
+
+func readString(fsys fs.FS, name string) string {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func provisionReleases(t *testing.T, l *Localfs) *Localfs {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	require.NoError(t, l.Provision(ctx))
+	t.Cleanup(func() { l.Cleanup() })
+	return l
+}
+
+func TestReleases(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		l    *Localfs
+	}{
+		{"follow", &Localfs{}},
+		{"within_root with cache", &Localfs{Symlinks: symlinksWithinRoot, CacheSize: 1 << 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, current := newReleases(t)
+			tc.l.Root = current
+			tc.l.Releases = true
+			l := provisionReleases(t, tc.l)
+			v1 := l.current.Load().name
+			require.Equal(t, "v1", readString(l, "index.html"))
+
+			// a file opened before the switch keeps reading the old release
+			f, err := l.Open("app.js")
+			require.NoError(t, err)
+
+			flip(t, dir, "v2")
+			require.Eventually(t, func() bool { return readString(l, "index.html") == "v2" }, 5*time.Second, 10*time.Millisecond)
+
+			_, ok := l.fileSystems.Get(v1)
+			require.True(t, ok, "the old release stays open while it is in use")
+			data := make([]byte, 6)
+			_, err = f.Read(data)
+			require.NoError(t, err)
+			require.Equal(t, "app v1", string(data))
+			require.NoError(t, f.Close())
+			_, ok = l.fileSystems.Get(v1)
+			require.False(t, ok, "the old release is closed once drained")
+		})
+	}
+}
+
+func TestReleasesRequiresPointer(t *testing.T) {
+	_, current := newReleases(t)
+	os.Remove(current)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	l := &Localfs{Root: current, Releases: true}
+	require.ErrorContains(t, l.Provision(ctx), "resolving release")
+}
+
+func TestPinRelease(t *testing.T) {
+	dir, current := newReleases(t)
+	l := provisionReleases(t, &Localfs{Root: current, Releases: true})
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	p := &PinRelease{}
+	require.NoError(t, p.Provision(ctx))
+	// outside of a caddy config every context has its own map
+	p.fileSystems = l.fileSystems
+	l.fileSystems.Register("site", l)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+	caddyhttp.SetVar(r.Context(), "fs", "site")
+
+	var pinned string
+	err := p.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		pinned, _ = caddyhttp.GetVar(r.Context(), "fs").(string)
+		fsys, ok := l.fileSystems.Get(pinned)
+		require.True(t, ok)
+		require.Equal(t, "v1", readString(fsys, "index.html"))
+
+		// the release switches in the middle of the request
+		flip(t, dir, "v2")
+		require.Eventually(t, func() bool { return readString(l, "index.html") == "v2" }, 5*time.Second, 10*time.Millisecond)
+
+		require.Equal(t, "app v1", readString(fsys, "app.js"), "the rest of the request is served from the same release")
+		return nil
+	}))
+	require.NoError(t, err)
+	require.Contains(t, pinned, releaseFsPrefix)
+	_, ok := l.fileSystems.Get(pinned)
+	require.False(t, ok, "the old release is closed once the request is done")
+
+	require.NoError(t, l.Cleanup())
+	_, err = l.Open("index.html")
+	require.ErrorIs(t, err, fs.ErrClosed)
+}
@@ -0,0 +1,149 @@
+package localfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// treeWatcher watches every directory under a root and invalidates the
+// cache entries of whatever changes. inotify watches are not recursive, so
+// directories created later are added as they show up. if the root is a
+// symlink, its parent is watched too, and the whole tree is watched afresh
+// when it is pointed somewhere else.
+type treeWatcher struct {
+	root  string // as configured
+	cache *readCache
+	log   *zap.Logger
+	w     *fsnotify.Watcher
+
+	mu       sync.Mutex
+	realRoot string // root with symlinks resolved
+}
+
+func watchTree(root string, cache *readCache, log *zap.Logger) (*treeWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	tw := &treeWatcher{root: filepath.Clean(root), cache: cache, log: log, w: w}
+	if err := tw.watchRoot(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go tw.run()
+	return tw, nil
+}
+
+// watchRoot resolves the root and watches the tree under it
+func (tw *treeWatcher) watchRoot() error {
+	realRoot, err := filepath.EvalSymlinks(tw.root)
+	if err != nil {
+		return err
+	}
+	tw.mu.Lock()
+	old := tw.realRoot
+	tw.realRoot = realRoot
+	tw.mu.Unlock()
+	for _, p := range tw.w.WatchList() {
+		tw.w.Remove(p)
+	}
+	if old != "" {
+		tw.log.Debug("root moved, watching it afresh", zap.String("from", old), zap.String("to", realRoot))
+	}
+	if realRoot != tw.root {
+		if err := tw.w.Add(filepath.Dir(tw.root)); err != nil {
+			return err
+		}
+	}
+	return tw.addTree(realRoot)
+}
+
+// addTree watches dir and every directory below it
+func (tw *treeWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed while we were walking
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return tw.w.Add(p)
+	})
+}
+
+// covers reports whether name resolves to itself in the watched tree, so
+// that a change to it is reported under name. files reached through symlinks
+// would be invalidated under the path they resolve to, or never if that is
+// out of the tree.
+func (tw *treeWatcher) covers(name string) bool {
+	tw.mu.Lock()
+	realRoot := tw.realRoot
+	tw.mu.Unlock()
+	p, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, p)
+	return err == nil && filepath.ToSlash(rel) == name
+}
+
+func (tw *treeWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-tw.w.Events:
+			if !ok {
+				return
+			}
+			tw.handle(ev)
+		case err, ok := <-tw.w.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, so nothing cached can be trusted
+			tw.log.Warn("file watcher error, dropping the read cache", zap.Error(err))
+			tw.cache.clear()
+		}
+	}
+}
+
+func (tw *treeWatcher) handle(ev fsnotify.Event) {
+	if filepath.Clean(ev.Name) == tw.root {
+		tw.cache.clear()
+		if err := tw.watchRoot(); err != nil {
+			tw.log.Warn("unable to watch root", zap.String("root", tw.root), zap.Error(err))
+		}
+		return
+	}
+	tw.mu.Lock()
+	realRoot := tw.realRoot
+	tw.mu.Unlock()
+	rel, err := filepath.Rel(realRoot, ev.Name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// something else in the parent of a symlinked root
+		return
+	}
+	tw.cache.invalidate(filepath.ToSlash(rel))
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			if err := tw.addTree(ev.Name); err != nil {
+				tw.log.Warn("unable to watch new directory, dropping the read cache", zap.String("dir", ev.Name), zap.Error(err))
+				tw.cache.clear()
+			}
+		}
+	}
+}
+
+func (tw *treeWatcher) Close() error {
+	return tw.w.Close()
+}
@@ -1,14 +1,16 @@
 package mergefs
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/fs"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
-	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 )
@@ -17,13 +19,30 @@ var _ fs.FS = (*Mergefs)(nil)
 
 type Mergefs struct {
 	// ordered list of filesystem layers, first entry has highest priority
-	LayersRaw []json.RawMessage `json:"layers,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+	Layers []*Layer `json:"layers,omitempty"`
+
+	// index the merged tree at provision, so lookups and listings go
+	// straight to the layer that has the path instead of asking every
+	// layer. files added to a layer afterwards are only seen once the
+	// index is rebuilt, every IndexRefresh if set.
+	Index        bool           `json:"index,omitempty"`
+	IndexRefresh caddy.Duration `json:"index_refresh,omitempty"`
 
 	layers []fs.FS
-	a      afero.Fs
-	log    *zap.Logger
+	// by layer, nil for the layers that are always there
+	matchers []caddyhttp.MatcherSet
+	log      *zap.Logger
+	indexed  atomic.Bool
+	indexMu  sync.Mutex
+
+	// the layers that are always there
+	base *view
+	// views with conditional layers, by which of them are there
+	viewsMu     sync.Mutex
+	views       map[uint64]*view
+	fileSystems caddy.FileSystems
+	id          uint64 // tells apart the views of several mergefs
 
-	fs.FS
 	closers []func()
 }
 
@@ -39,37 +58,150 @@ func (s *Mergefs) CaddyModule() caddy.ModuleInfo {
 func (s *Mergefs) Provision(ctx caddy.Context) error {
 	s.log = ctx.Logger()
 	s.log.Debug("initializing mergefs")
+	s.fileSystems = ctx.FileSystems()
+	s.id = instances.Add(1)
 
-	if len(s.LayersRaw) == 0 {
+	if len(s.Layers) == 0 {
 		return fmt.Errorf("mergefs: at least one layer is required")
 	}
 
-	mods, err := ctx.LoadModule(s, "LayersRaw")
-	if err != nil {
-		return fmt.Errorf("loading mergefs layers: %w", err)
+	for i, l := range s.Layers {
+		log := s.log.With(zap.Int("layer", i), zap.String("backend", l.backend()))
+		switch l.OnError {
+		case "", onErrorFail, onErrorSkip:
+		default:
+			return fmt.Errorf("mergefs: layer %d: invalid on_error %q, expected fail or skip", i, l.OnError)
+		}
+		fsys, matchers, err := s.loadLayer(ctx, l)
+		if err != nil {
+			if !l.Optional {
+				return fmt.Errorf("mergefs: layer %d: %w", i, err)
+			}
+			log.Warn("optional layer failed to load, serving without it", zap.Error(err))
+			continue
+		}
+		s.layers = append(s.layers, &healthFs{FS: fsys, log: log, skip: l.OnError == onErrorSkip, recovered: s.layerRecovered})
+		s.matchers = append(s.matchers, matchers)
 	}
-	for _, mod := range mods.([]any) {
-		fsys, ok := mod.(fs.FS)
-		if !ok {
-			return fmt.Errorf("mergefs: layer module is not fs.FS")
+	if len(s.layers) == 0 {
+		return fmt.Errorf("mergefs: no layer loaded")
+	}
+	conditional := 0
+	for _, m := range s.matchers {
+		if m != nil {
+			conditional++
 		}
-		s.layers = append(s.layers, fsys)
+	}
+	if conditional > maxConditionalLayers {
+		return fmt.Errorf("mergefs: at most %d layers can have a match", maxConditionalLayers)
 	}
 
-	s.BuildLayers(s.layers)
-	s.log.Debug("initialized mergefs", zap.Int("layers", len(s.layers)))
+	s.build()
+	if s.Index {
+		if err := s.BuildIndex(); err != nil {
+			return fmt.Errorf("mergefs: building index: %w", err)
+		}
+		if s.IndexRefresh > 0 {
+			s.refreshIndex(time.Duration(s.IndexRefresh))
+		}
+	}
+	s.log.Debug("initialized mergefs", zap.Int("layers", len(s.layers)), zap.Int("conditional", conditional), zap.Bool("index", s.Index))
 	return nil
 }
 
+// BuildIndex indexes the merged tree as it is now, and serves from the
+// index from then on. it is safe to call while serving, to pick up changes
+// to the layers.
+func (s *Mergefs) BuildIndex() error {
+	if s.base == nil {
+		return fmt.Errorf("mergefs: no layers to index")
+	}
+	// one build at a time, so an older snapshot never replaces a newer one
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.indexed.Store(true)
+	start := time.Now()
+	if err := s.base.buildIndex(); err != nil {
+		return err
+	}
+	s.viewsMu.Lock()
+	views := make([]*view, 0, len(s.views))
+	for _, v := range s.views {
+		views = append(views, v)
+	}
+	s.viewsMu.Unlock()
+	for _, v := range views {
+		if err := v.buildIndex(); err != nil {
+			return err
+		}
+	}
+	if s.log != nil {
+		s.log.Debug("built merged path index", zap.Int("paths", len(s.base.index.Load().entries)), zap.Int("views", len(views)), zap.Duration("took", time.Since(start)))
+	}
+	return nil
+}
+
+// layerRecovered rebuilds the index once a failing layer works again, as it
+// may have been left out of the index while it was skipped
+func (s *Mergefs) layerRecovered() {
+	if !s.indexed.Load() {
+		return
+	}
+	go func() {
+		if err := s.BuildIndex(); err != nil {
+			s.log.Warn("unable to rebuild merged path index after a layer recovered", zap.Error(err))
+		}
+	}()
+}
+
+func (s *Mergefs) refreshIndex(interval time.Duration) {
+	done := make(chan struct{})
+	s.closers = append(s.closers, func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.BuildIndex(); err != nil {
+					s.log.Warn("unable to rebuild merged path index, keeping the previous one", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+func (s *Mergefs) loadLayer(ctx caddy.Context, l *Layer) (fs.FS, caddyhttp.MatcherSet, error) {
+	mod, err := ctx.LoadModule(l, "FileSystemRaw")
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading: %w", err)
+	}
+	fsys, ok := mod.(fs.FS)
+	if !ok {
+		return nil, nil, fmt.Errorf("layer module is not fs.FS")
+	}
+	var matchers caddyhttp.MatcherSet
+	if l.MatchRaw != nil {
+		mods, err := ctx.LoadModule(l, "MatchRaw")
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading matchers: %w", err)
+		}
+		for _, m := range mods.(map[string]any) {
+			matchers = append(matchers, m)
+		}
+	}
+	fsys, err = l.place(fsys)
+	return fsys, matchers, err
+}
+
 // BuildLayers constructs the merged union filesystem from the given fs.FS layers.
 // layers[0] has highest priority; layers[len-1] is the base.
 func (s *Mergefs) BuildLayers(layers []fs.FS) {
 	s.layers = layers
-	aferoLayers := make([]afero.Fs, len(layers))
-	for i, l := range layers {
-		aferoLayers[i] = afero.FromIOFS{FS: l}
-	}
-	s.buildAfero(aferoLayers)
+	s.matchers = nil
+	s.build()
 }
 
 // BuildAferoLayers constructs the merged union filesystem from the given afero layers.
@@ -79,25 +211,11 @@ func (s *Mergefs) BuildAferoLayers(layers []afero.Fs) {
 	for i, l := range layers {
 		fsLayers[i] = afero.NewIOFS(l)
 	}
-	s.layers = fsLayers
-	s.buildAfero(layers)
-}
-
-func (s *Mergefs) buildAfero(layers []afero.Fs) {
-	// build the union: last layer is the base, each earlier layer overlays it
-	// CopyOnWriteFs gives us merged directory listings via UnionFile
-	merged := layers[len(layers)-1]
-	for i := len(layers) - 2; i >= 0; i-- {
-		merged = afero.NewCopyOnWriteFs(merged, layers[i])
-	}
-	merged = afero.NewReadOnlyFs(merged)
-	s.a = merged
-	s.FS = afero.NewIOFS(s.a)
+	s.BuildLayers(fsLayers)
 }
 
 func (s *Mergefs) Open(name string) (fs.File, error) {
-	name = strings.Trim(name, "/")
-	return s.FS.Open(name)
+	return s.base.Open(name)
 }
 
 func (s *Mergefs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -105,23 +223,30 @@ func (s *Mergefs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			key := d.Val()
 			switch strings.ToLower(key) {
+			case "index":
+				s.Index = true
+				if d.NextArg() {
+					// optional refresh interval
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid index refresh interval: %v", err)
+					}
+					s.IndexRefresh = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 			case "layer":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				name := d.Val()
-				modID := "caddy.fs." + name
-				unm, err := caddyfile.UnmarshalModule(d, modID)
+				l, err := unmarshalLayer(d)
 				if err != nil {
 					return err
 				}
-				fsys, ok := unm.(fs.FS)
-				if !ok {
-					return d.Errf("module %s (%T) is not a supported file system implementation", modID, unm)
-				}
-				s.LayersRaw = append(s.LayersRaw, caddyconfig.JSONModuleObject(fsys, "backend", name, nil))
+				s.Layers = append(s.Layers, l)
 			default:
-				return d.SyntaxErr("expected 'layer', got '" + key + "'")
+				return d.SyntaxErr("expected 'layer' or 'index', got '" + key + "'")
 			}
 		}
 	}
@@ -132,5 +257,6 @@ func (s *Mergefs) Cleanup() error {
 	for _, closer := range s.closers {
 		closer()
 	}
+	s.dropViews()
 	return nil
 }
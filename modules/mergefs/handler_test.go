@@ -1,10 +1,25 @@
 package mergefs_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/gfx-labs/swim/modules/mergefs"
+	_ "github.com/gfx-labs/swim/plugin/localfs"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
@@ -130,3 +145,571 @@ func TestMergeOpenStripsSlashes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "hello", string(data))
 }
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(body), 0o644))
+	}
+}
+
+// provision round trips m through json, the way caddy loads it
+func provision(t *testing.T, m *mergefs.Mergefs) *mergefs.Mergefs {
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	m = new(mergefs.Mergefs)
+	require.NoError(t, json.Unmarshal(data, m))
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	require.NoError(t, m.Provision(ctx))
+	return m
+}
+
+func listing(t *testing.T, fsys fs.FS, dir string) []string {
+	entries, err := fs.ReadDir(fsys, dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMergeMountAndStrip(t *testing.T) {
+	site, docs, overrides := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFiles(t, site, map[string]string{"index.html": "site", "static/app.js": "app"})
+	writeFiles(t, docs, map[string]string{"build/index.html": "docs", "build/api/v1.html": "v1", "src/index.md": "source"})
+	writeFiles(t, overrides, map[string]string{"app.js": "patched"})
+
+	m := new(mergefs.Mergefs)
+	d := caddyfile.NewTestDispenser(`merge {
+		layer localfs ` + overrides + ` {
+			mount /static/overrides
+		}
+		layer localfs {
+			root ` + docs + `
+			mount /docs
+			strip /build
+		}
+		layer localfs ` + site + `
+	}`)
+	require.NoError(t, m.UnmarshalCaddyfile(d))
+	require.Len(t, m.Layers, 3)
+	require.Equal(t, "/static/overrides", m.Layers[0].Mount)
+	require.Equal(t, "/docs", m.Layers[1].Mount)
+	require.Equal(t, "/build", m.Layers[1].Strip)
+	m = provision(t, m)
+
+	for name, expected := range map[string]string{
+		"index.html":              "site",
+		"static/app.js":           "app",
+		"docs/index.html":         "docs",
+		"/docs/api/v1.html":       "v1",
+		"static/overrides/app.js": "patched",
+	} {
+		data, err := fs.ReadFile(m, name)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, string(data), name)
+	}
+	for _, name := range []string{"build/index.html", "docs/build/index.html", "docs/src/index.md", "app.js"} {
+		_, err := fs.ReadFile(m, name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+
+	require.Equal(t, []string{"docs", "index.html", "static"}, listing(t, m, "."))
+	require.Equal(t, []string{"app.js", "overrides"}, listing(t, m, "static"))
+	require.Equal(t, []string{"api", "index.html"}, listing(t, m, "docs"))
+	info, err := fs.Stat(m, "static/overrides")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+}
+
+func TestMergeBareLayerJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"index.html": "hello"})
+
+	m := new(mergefs.Mergefs)
+	require.NoError(t, json.Unmarshal([]byte(`{"layers":[{"backend":"localfs","root":`+strconv.Quote(dir)+`}]}`), m))
+	m = provision(t, m)
+	data, err := fs.ReadFile(m, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+}
+
+func TestMergeWhiteouts(t *testing.T) {
+	override := afero.NewMemMapFs()
+	afero.WriteFile(override, ".wh.old.html", nil, 0o644)
+	afero.WriteFile(override, "blog/.wh.drafts", nil, 0o644)
+	afero.WriteFile(override, "assets/.wh..wh..opq", nil, 0o644)
+	afero.WriteFile(override, "assets/app.js", []byte("new app"), 0o644)
+	// a whiteout does not hide the file next to it in its own layer
+	afero.WriteFile(override, ".wh.about.html", nil, 0o644)
+	afero.WriteFile(override, "about.html", []byte("new about"), 0o644)
+
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "index.html", []byte("index"), 0o644)
+	afero.WriteFile(base, "old.html", []byte("stale"), 0o644)
+	afero.WriteFile(base, "about.html", []byte("old about"), 0o644)
+	afero.WriteFile(base, "blog/post.html", []byte("post"), 0o644)
+	afero.WriteFile(base, "blog/drafts/wip.html", []byte("wip"), 0o644)
+	afero.WriteFile(base, "assets/app.js", []byte("old app"), 0o644)
+	afero.WriteFile(base, "assets/old.js", []byte("old"), 0o644)
+
+	m := new(mergefs.Mergefs)
+	m.BuildAferoLayers([]afero.Fs{override, base})
+
+	for name, expected := range map[string]string{
+		"index.html":     "index",
+		"about.html":     "new about",
+		"blog/post.html": "post",
+		"assets/app.js":  "new app",
+	} {
+		data, err := fs.ReadFile(m, name)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, string(data), name)
+	}
+	for _, name := range []string{"old.html", "blog/drafts", "blog/drafts/wip.html", "assets/old.js", ".wh.old.html", "assets/.wh..wh..opq"} {
+		_, err := m.Open(name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+
+	require.Equal(t, []string{"about.html", "assets", "blog", "index.html"}, listing(t, m, "."))
+	require.Equal(t, []string{"post.html"}, listing(t, m, "blog"))
+	require.Equal(t, []string{"app.js"}, listing(t, m, "assets"))
+}
+
+func TestMergeWhiteoutsAcrossLayers(t *testing.T) {
+	// a whiteout hides every layer below it, but not the ones above
+	top := afero.NewMemMapFs()
+	afero.WriteFile(top, "docs/v1.html", []byte("v1 again"), 0o644)
+	mid := afero.NewMemMapFs()
+	afero.WriteFile(mid, ".wh.docs", nil, 0o644)
+	afero.WriteFile(mid, "news.html", []byte("news"), 0o644)
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "docs/v1.html", []byte("v1"), 0o644)
+	afero.WriteFile(base, "docs/v2.html", []byte("v2"), 0o644)
+
+	m := new(mergefs.Mergefs)
+	m.BuildAferoLayers([]afero.Fs{top, mid, base})
+
+	data, err := fs.ReadFile(m, "docs/v1.html")
+	require.NoError(t, err)
+	require.Equal(t, "v1 again", string(data))
+	_, err = m.Open("docs/v2.html")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, []string{"v1.html"}, listing(t, m, "docs"))
+	require.Equal(t, []string{"docs", "news.html"}, listing(t, m, "."))
+}
+
+func TestMergeFileHidesDirectory(t *testing.T) {
+	// a file in place of a directory hides the directory of the layers below
+	top := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(top, "docs"), []byte("a file now"), 0o644))
+	base := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "docs", "deep"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "docs", "secret.html"), []byte("secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "docs", "deep", "er.html"), []byte("deeper"), 0o644))
+
+	mem := afero.NewMemMapFs()
+	afero.WriteFile(mem, "docs", []byte("a file now"), 0o644)
+
+	for name, upper := range map[string]fs.FS{"dir": os.DirFS(top), "memory": afero.NewIOFS(mem)} {
+		t.Run(name, func(t *testing.T) {
+			plain := new(mergefs.Mergefs)
+			plain.BuildLayers([]fs.FS{upper, os.DirFS(base)})
+			indexed := new(mergefs.Mergefs)
+			indexed.BuildLayers([]fs.FS{upper, os.DirFS(base)})
+			require.NoError(t, indexed.BuildIndex())
+
+			for _, m := range []*mergefs.Mergefs{plain, indexed} {
+				data, err := fs.ReadFile(m, "docs")
+				require.NoError(t, err)
+				require.Equal(t, "a file now", string(data))
+				for _, name := range []string{"docs/secret.html", "docs/deep", "docs/deep/er.html"} {
+					_, err := m.Open(name)
+					require.ErrorIs(t, err, fs.ErrNotExist, name)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeSquash(t *testing.T) {
+	// two layers squashed into one look the same over the layers below
+	top := afero.NewMemMapFs()
+	afero.WriteFile(top, "index.html", []byte("top"), 0o644)
+	afero.WriteFile(top, ".wh.old.html", nil, 0o644)
+	afero.WriteFile(top, "docs/new.html", []byte("new"), 0o644)
+	afero.WriteFile(top, "blog/post.html", []byte("post"), 0o644)
+	afero.WriteFile(top, "assets/.wh..wh..opq", nil, 0o644)
+	afero.WriteFile(top, "assets/app.js", []byte("app"), 0o644)
+	mid := afero.NewMemMapFs()
+	afero.WriteFile(mid, "index.html", []byte("mid"), 0o644)
+	afero.WriteFile(mid, "old.html", []byte("old"), 0o644)
+	afero.WriteFile(mid, ".wh.gone.html", nil, 0o644)
+	afero.WriteFile(mid, "docs/mid.html", []byte("mid"), 0o644)
+	afero.WriteFile(mid, "blog", []byte("a file"), 0o644)
+	afero.WriteFile(mid, "assets/mid.js", []byte("mid"), 0o644)
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "gone.html", []byte("gone"), 0o644)
+	afero.WriteFile(base, "old.html", []byte("older"), 0o644)
+	afero.WriteFile(base, "docs/base.html", []byte("base"), 0o644)
+	afero.WriteFile(base, "blog/hidden.html", []byte("hidden"), 0o644)
+	afero.WriteFile(base, "assets/base.js", []byte("base"), 0o644)
+
+	layered := new(mergefs.Mergefs)
+	layered.BuildAferoLayers([]afero.Fs{top, mid, base})
+	squashed := new(mergefs.Mergefs)
+	squashed.BuildLayers([]fs.FS{mergefs.Squash(afero.NewIOFS(top), afero.NewIOFS(mid)), afero.NewIOFS(base)})
+	require.Equal(t, tree(t, layered), tree(t, squashed))
+	require.Equal(t, map[string]string{
+		"./":             "assets,blog,docs,index.html",
+		"index.html":     "top",
+		"docs/":          "base.html,mid.html,new.html",
+		"docs/base.html": "base",
+		"docs/mid.html":  "mid",
+		"docs/new.html":  "new",
+		"blog/":          "post.html",
+		"blog/post.html": "post",
+		"assets/":        "app.js",
+		"assets/app.js":  "app",
+	}, tree(t, squashed))
+
+	// the whiteouts are kept for the layers below, and the directory that
+	// replaced a file gets an opaque marker of its own
+	require.Equal(t, map[string]string{
+		"./":                  ".wh.gone.html,.wh.old.html,assets,blog,docs,index.html",
+		".wh.gone.html":       "",
+		".wh.old.html":        "",
+		"index.html":          "top",
+		"docs/":               "mid.html,new.html",
+		"docs/mid.html":       "mid",
+		"docs/new.html":       "new",
+		"blog/":               ".wh..wh..opq,post.html",
+		"blog/.wh..wh..opq":   "",
+		"blog/post.html":      "post",
+		"assets/":             ".wh..wh..opq,app.js",
+		"assets/.wh..wh..opq": "",
+		"assets/app.js":       "app",
+	}, tree(t, mergefs.Squash(afero.NewIOFS(top), afero.NewIOFS(mid))))
+}
+
+func TestMergeReadDirInBatches(t *testing.T) {
+	top := afero.NewMemMapFs()
+	afero.WriteFile(top, "a", nil, 0o644)
+	afero.WriteFile(top, "c", nil, 0o644)
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "b", nil, 0o644)
+
+	m := new(mergefs.Mergefs)
+	m.BuildAferoLayers([]afero.Fs{top, base})
+
+	f, err := m.Open(".")
+	require.NoError(t, err)
+	defer f.Close()
+	dir := f.(fs.ReadDirFile)
+	var names []string
+	for {
+		entries, err := dir.ReadDir(2)
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+// flakyFs is a layer that can be made to fail, to fail to provision or, once
+// provisioned, to return errors for everything while broken is set
+type flakyFs struct {
+	Dir           string `json:"dir,omitempty"`
+	FailProvision bool   `json:"fail_provision,omitempty"`
+
+	fs.FS
+}
+
+var broken atomic.Bool
+
+func (f *flakyFs) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.fs.flaky",
+		New: func() caddy.Module { return new(flakyFs) },
+	}
+}
+
+func (f *flakyFs) Provision(ctx caddy.Context) error {
+	if f.FailProvision {
+		return errors.New("remote unavailable")
+	}
+	f.FS = os.DirFS(f.Dir)
+	return nil
+}
+
+func (f *flakyFs) Open(name string) (fs.File, error) {
+	if broken.Load() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("connection reset")}
+	}
+	return f.FS.Open(name)
+}
+
+func init() {
+	caddy.RegisterModule(new(flakyFs))
+}
+
+func flakyLayer(t *testing.T, l mergefs.Layer, f flakyFs) *mergefs.Layer {
+	raw, err := json.Marshal(f)
+	require.NoError(t, err)
+	var backend map[string]any
+	require.NoError(t, json.Unmarshal(raw, &backend))
+	backend["backend"] = "flaky"
+	l.FileSystemRaw, err = json.Marshal(backend)
+	require.NoError(t, err)
+	return &l
+}
+
+func localfsLayer(root string) json.RawMessage {
+	return json.RawMessage(`{"backend":"localfs","root":` + strconv.Quote(root) + `}`)
+}
+
+func TestMergeOnError(t *testing.T) {
+	remote, fallback := t.TempDir(), t.TempDir()
+	writeFiles(t, remote, map[string]string{"index.html": "remote", "new.html": "new"})
+	writeFiles(t, fallback, map[string]string{"index.html": "fallback", "old.html": "old"})
+
+	for _, tc := range []struct {
+		onError string
+		skips   bool
+	}{
+		{"", false},
+		{"fail", false},
+		{"skip", true},
+	} {
+		t.Run("on_error "+tc.onError, func(t *testing.T) {
+			t.Cleanup(func() { broken.Store(false) })
+			m := provision(t, &mergefs.Mergefs{Layers: []*mergefs.Layer{
+				flakyLayer(t, mergefs.Layer{OnError: tc.onError}, flakyFs{Dir: remote}),
+				{FileSystemRaw: localfsLayer(fallback)},
+			}})
+
+			data, err := fs.ReadFile(m, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "remote", string(data))
+
+			broken.Store(true)
+			data, err = fs.ReadFile(m, "index.html")
+			if !tc.skips {
+				require.ErrorContains(t, err, "connection reset")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "fallback", string(data))
+			require.Equal(t, []string{"index.html", "old.html"}, listing(t, m, "."))
+
+			// and back once it recovers
+			broken.Store(false)
+			data, err = fs.ReadFile(m, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "remote", string(data))
+			require.Equal(t, []string{"index.html", "new.html", "old.html"}, listing(t, m, "."))
+		})
+	}
+}
+
+func TestMergeOptionalLayers(t *testing.T) {
+	fallback := t.TempDir()
+	writeFiles(t, fallback, map[string]string{"index.html": "fallback"})
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := provision(t, &mergefs.Mergefs{Layers: []*mergefs.Layer{
+		flakyLayer(t, mergefs.Layer{Optional: true}, flakyFs{FailProvision: true}),
+		{FileSystemRaw: localfsLayer(fallback)},
+	}})
+	data, err := fs.ReadFile(m, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "fallback", string(data))
+
+	m = &mergefs.Mergefs{Layers: []*mergefs.Layer{
+		flakyLayer(t, mergefs.Layer{}, flakyFs{FailProvision: true}),
+		{FileSystemRaw: localfsLayer(fallback)},
+	}}
+	require.ErrorContains(t, m.Provision(ctx), "remote unavailable")
+
+	m = &mergefs.Mergefs{Layers: []*mergefs.Layer{
+		flakyLayer(t, mergefs.Layer{Optional: true}, flakyFs{FailProvision: true}),
+	}}
+	require.ErrorContains(t, m.Provision(ctx), "no layer loaded")
+
+	m = &mergefs.Mergefs{Layers: []*mergefs.Layer{
+		{FileSystemRaw: localfsLayer(fallback), OnError: "retry"},
+	}}
+	require.ErrorContains(t, m.Provision(ctx), "invalid on_error")
+}
+
+func TestMergeLayerOptionsCaddyfile(t *testing.T) {
+	m := new(mergefs.Mergefs)
+	d := caddyfile.NewTestDispenser(`merge {
+		layer localfs {
+			root /mnt/nfs/site
+			optional
+			on_error skip
+		}
+		layer localfs /srv/site
+	}`)
+	require.NoError(t, m.UnmarshalCaddyfile(d))
+	require.Len(t, m.Layers, 2)
+	require.True(t, m.Layers[0].Optional)
+	require.Equal(t, "skip", m.Layers[0].OnError)
+	require.JSONEq(t, `{"backend":"localfs","root":"/mnt/nfs/site"}`, string(m.Layers[0].FileSystemRaw))
+	require.False(t, m.Layers[1].Optional)
+
+	d = caddyfile.NewTestDispenser(`merge {
+		layer localfs /srv/site {
+			optional now
+		}
+	}`)
+	require.Error(t, new(mergefs.Mergefs).UnmarshalCaddyfile(d))
+}
+
+// tree reads every file and directory listing of fsys
+func tree(t testing.TB, fsys fs.FS) map[string]string {
+	out := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			entries, err := fs.ReadDir(fsys, p)
+			if err != nil {
+				return err
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			out[p+"/"] = strings.Join(names, ",")
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, p)
+		out[p] = string(data)
+		return err
+	})
+	require.NoError(t, err)
+	return out
+}
+
+func TestMergeIndex(t *testing.T) {
+	top := afero.NewMemMapFs()
+	afero.WriteFile(top, "index.html", []byte("top"), 0o644)
+	afero.WriteFile(top, ".wh.old.html", nil, 0o644)
+	afero.WriteFile(top, "assets/.wh..wh..opq", nil, 0o644)
+	afero.WriteFile(top, "assets/app.js", []byte("app"), 0o644)
+	mid := afero.NewMemMapFs()
+	afero.WriteFile(mid, "docs/a.html", []byte("a"), 0o644)
+	afero.WriteFile(mid, "docs/deep/er/b.html", []byte("b"), 0o644)
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "index.html", []byte("base"), 0o644)
+	afero.WriteFile(base, "old.html", []byte("old"), 0o644)
+	afero.WriteFile(base, "assets/old.js", []byte("old"), 0o644)
+	afero.WriteFile(base, "docs/c.html", []byte("c"), 0o644)
+
+	plain := new(mergefs.Mergefs)
+	plain.BuildAferoLayers([]afero.Fs{top, mid, base})
+	indexed := new(mergefs.Mergefs)
+	indexed.BuildAferoLayers([]afero.Fs{top, mid, base})
+	require.NoError(t, indexed.BuildIndex())
+
+	expected := tree(t, plain)
+	require.Equal(t, "assets,docs,index.html", expected["./"])
+	require.Equal(t, expected, tree(t, indexed))
+	for _, name := range []string{"old.html", "assets/old.js", "docs/nope.html", "nope/deeper", ".wh.old.html"} {
+		_, err := indexed.Open(name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+
+	// the index is a snapshot: removals fall through to the layers, while
+	// additions wait for the next build
+	require.NoError(t, top.Remove("index.html"))
+	afero.WriteFile(mid, "docs/new.html", []byte("new"), 0o644)
+	data, err := fs.ReadFile(indexed, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "base", string(data))
+	_, err = indexed.Open("docs/new.html")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, indexed.BuildIndex())
+	require.Equal(t, tree(t, plain), tree(t, indexed))
+	data, err = fs.ReadFile(indexed, "docs/new.html")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestMergeIndexRefresh(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"index.html": "hello"})
+	m := provision(t, &mergefs.Mergefs{
+		Index:        true,
+		IndexRefresh: caddy.Duration(20 * time.Millisecond),
+		Layers:       []*mergefs.Layer{{FileSystemRaw: localfsLayer(dir)}},
+	})
+	t.Cleanup(func() { m.Cleanup() })
+
+	writeFiles(t, dir, map[string]string{"new.html": "new"})
+	require.Eventually(t, func() bool {
+		_, err := fs.Stat(m, "new.html")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// newBenchLayers makes five layers sharing a directory of files entries
+// each, with the files spread over the layers
+func newBenchLayers(files int) []afero.Fs {
+	layers := make([]afero.Fs, 5)
+	for i := range layers {
+		layers[i] = afero.NewMemMapFs()
+		layers[i].MkdirAll("static", 0o755)
+	}
+	for i := range files {
+		afero.WriteFile(layers[i%len(layers)], fmt.Sprintf("static/file-%05d.js", i), []byte("x"), 0o644)
+	}
+	return layers
+}
+
+func BenchmarkMerge(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		m := new(mergefs.Mergefs)
+		m.BuildAferoLayers(newBenchLayers(5000))
+		if indexed {
+			require.NoError(b, m.BuildIndex())
+		}
+		name := "union"
+		if indexed {
+			name = "index"
+		}
+		b.Run(name+"/ReadDir", func(b *testing.B) {
+			for b.Loop() {
+				entries, err := fs.ReadDir(m, "static")
+				require.NoError(b, err)
+				require.Len(b, entries, 5000)
+			}
+		})
+		b.Run(name+"/Stat", func(b *testing.B) {
+			for b.Loop() {
+				// owned by the base layer, the worst case for the union
+				_, err := fs.Stat(m, "static/file-04999.js")
+				require.NoError(b, err)
+			}
+		})
+		b.Run(name+"/Open missing", func(b *testing.B) {
+			for b.Loop() {
+				_, err := m.Open("static/nope.js")
+				require.ErrorIs(b, err, fs.ErrNotExist)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package mergefs
+
+import (
+	"errors"
+	"io/fs"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const (
+	onErrorFail = "fail"
+	onErrorSkip = "skip"
+)
+
+// healthFs tracks whether a layer is working, logging when it starts
+// failing and when it recovers. with skip, a failing layer is treated as if
+// it did not have the file, so the layers below it serve instead.
+type healthFs struct {
+	fs.FS
+	log  *zap.Logger
+	skip bool
+	// called once the layer works again after failing
+	recovered func()
+
+	failing atomic.Bool
+	// errors passed over as missing files with skip
+	skipped atomic.Uint64
+}
+
+func (h *healthFs) Open(name string) (fs.File, error) {
+	f, err := h.FS.Open(name)
+	return f, h.check(name, err)
+}
+
+func (h *healthFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(h.FS, name)
+	return entries, h.check(name, err)
+}
+
+// check records the outcome of an operation on name, and returns the error
+// to pass on
+func (h *healthFs) check(name string, err error) error {
+	if err == nil || missing(err) || errors.Is(err, fs.ErrInvalid) {
+		if h.failing.CompareAndSwap(true, false) {
+			h.log.Info("layer recovered")
+			if h.recovered != nil {
+				h.recovered()
+			}
+		}
+		return err
+	}
+	if !h.failing.Swap(true) {
+		h.log.Warn("layer failing", zap.String("path", name), zap.Bool("skipping", h.skip), zap.Error(err))
+	} else {
+		h.log.Debug("layer still failing", zap.String("path", name), zap.Error(err))
+	}
+	if h.skip {
+		h.skipped.Add(1)
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// skipped counts the errors that the layers of u passed over with skip
+func (u *unionFs) skipped() uint64 {
+	var n uint64
+	for _, l := range u.layers {
+		if h, ok := l.(*healthFs); ok {
+			n += h.skipped.Load()
+		}
+	}
+	return n
+}
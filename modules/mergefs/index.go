@@ -0,0 +1,142 @@
+package mergefs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"syscall"
+)
+
+// pathIndex is an immutable snapshot of the merged tree, mapping every path
+// to the layer that serves it, and every directory to its merged listing.
+// it is rebuilt, not updated, when the layers change.
+type pathIndex struct {
+	union   *unionFs
+	entries map[string]*indexEntry
+	// a layer was skipped for failing while the index was built, so what it
+	// has may be missing. directories and paths not in the index are then
+	// left to the layers, until the index is rebuilt.
+	partial bool
+}
+
+type indexEntry struct {
+	layer int // serving layer, for files
+
+	dir      bool
+	info     fs.FileInfo // of the directory, from the topmost layer
+	children []fs.DirEntry
+}
+
+// buildIndex walks the union and indexes everything in it
+func buildIndex(u *unionFs) (*pathIndex, error) {
+	idx := &pathIndex{union: u, entries: make(map[string]*indexEntry)}
+	skipped := u.skipped()
+	if err := idx.addDir("."); err != nil {
+		return nil, err
+	}
+	idx.partial = u.skipped() != skipped
+	return idx, nil
+}
+
+func (idx *pathIndex) addDir(name string) error {
+	f, err := idx.union.Open(name)
+	if err != nil {
+		return err
+	}
+	d, ok := f.(*unionDir)
+	if !ok {
+		// replaced by a file while we were walking
+		f.Close()
+		return nil
+	}
+	merged, err := d.list()
+	if err != nil {
+		return err
+	}
+	e := &indexEntry{dir: true, info: d.info}
+	idx.entries[name] = e
+	for _, m := range merged {
+		e.children = append(e.children, m.DirEntry)
+		child := path.Join(name, m.Name())
+		if !m.IsDir() {
+			idx.entries[child] = &indexEntry{layer: m.layer}
+			continue
+		}
+		if err := idx.addDir(child); err != nil && !missing(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *pathIndex) Open(name string) (fs.File, error) {
+	e, ok := idx.entries[name]
+	if !ok {
+		return idx.openMissing(name)
+	}
+	if e.dir && idx.partial {
+		return idx.union.Open(name)
+	}
+	if e.dir {
+		return &indexDir{name: name, entry: e}, nil
+	}
+	f, err := idx.union.layers[e.layer].Open(name)
+	if err != nil {
+		// gone since the index was built, or the layer is failing and
+		// skipped, so let the layers below have a go
+		return idx.union.Open(name)
+	}
+	return f, nil
+}
+
+// openMissing opens a path that is not in the index. below an indexed
+// directory there is nothing, but below a file, which can be a symlink to a
+// directory, it is up to the layers.
+func (idx *pathIndex) openMissing(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if idx.partial {
+		return idx.union.Open(name)
+	}
+	for p := path.Dir(name); ; p = path.Dir(p) {
+		if e, ok := idx.entries[p]; ok {
+			if e.dir {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			return idx.union.Open(name)
+		}
+		if p == "." {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+}
+
+// indexDir is an indexed directory. the entries are shared between opens, so
+// callers get copies.
+type indexDir struct {
+	name   string
+	entry  *indexEntry
+	offset int
+}
+
+func (d *indexDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *indexDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+func (d *indexDir) Close() error { return nil }
+
+func (d *indexDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.offset:]
+	if n <= 0 {
+		d.offset += len(rest)
+		return slices.Clone(rest), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return slices.Clone(rest[:n]), nil
+}
@@ -0,0 +1,71 @@
+package mergefs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// downFs fails everything while down is set
+type downFs struct {
+	fs.FS
+	down atomic.Bool
+}
+
+func (d *downFs) Open(name string) (fs.File, error) {
+	if d.down.Load() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("connection reset")}
+	}
+	return d.FS.Open(name)
+}
+
+func names(t *testing.T, fsys fs.FS, dir string) []string {
+	entries, err := fs.ReadDir(fsys, dir)
+	require.NoError(t, err)
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+func TestIndexSkippedLayer(t *testing.T) {
+	remote := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(remote, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(remote, "docs", "new.html"), []byte("new"), 0o644))
+	fallback := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(fallback, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(fallback, "docs", "old.html"), []byte("old"), 0o644))
+
+	// the remote is down while the index is built
+	down := &downFs{FS: os.DirFS(remote)}
+	down.down.Store(true)
+	m := &Mergefs{log: zap.NewNop()}
+	m.BuildLayers([]fs.FS{
+		&healthFs{FS: down, log: zap.NewNop(), skip: true, recovered: m.layerRecovered},
+		os.DirFS(fallback),
+	})
+	require.NoError(t, m.BuildIndex())
+	require.True(t, m.base.index.Load().partial)
+	require.Equal(t, []string{"old.html"}, names(t, m, "docs"))
+
+	// what it has shows up as soon as it is back, without an index_refresh
+	down.down.Store(false)
+	data, err := fs.ReadFile(m, "docs/new.html")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+	require.Equal(t, []string{"new.html", "old.html"}, names(t, m, "docs"))
+
+	// and its recovery rebuilds the index
+	require.Eventually(t, func() bool { return !m.base.index.Load().partial }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"new.html", "old.html"}, names(t, m, "docs"))
+	_, err = m.Open("docs/nope.html")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,183 @@
+package mergefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Layer is one filesystem in the union, along with where it goes in it
+type Layer struct {
+	FileSystemRaw json.RawMessage `json:"filesystem,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// serve the layer under this path instead of at the root, e.g. /docs
+	Mount string `json:"mount,omitempty"`
+
+	// serve only this sub-tree of the layer, e.g. /build
+	Strip string `json:"strip,omitempty"`
+
+	// leave the layer out, instead of failing, when it does not load
+	Optional bool `json:"optional,omitempty"`
+
+	// what to do when the layer returns an error: fail (the default) fails
+	// the request, skip serves from the layers below as if the layer did
+	// not have the file
+	OnError string `json:"on_error,omitempty"`
+
+	// only overlay the layer for requests that match. the filesystem
+	// itself leaves the layer out, requests get it through the
+	// merge_layers handler.
+	MatchRaw caddy.ModuleMap `json:"match,omitempty" caddy:"namespace=http.matchers"`
+}
+
+// UnmarshalJSON also accepts a bare filesystem module, which is how layers
+// were configured before they had options
+func (l *Layer) UnmarshalJSON(data []byte) error {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if _, ok := probe["backend"]; ok {
+		*l = Layer{FileSystemRaw: data}
+		return nil
+	}
+	type layer Layer
+	return json.Unmarshal(data, (*layer)(l))
+}
+
+// layerOptions are the subdirectives of a layer block that belong to the
+// layer rather than to its filesystem module
+var layerOptions = map[string]bool{
+	"mount":    true,
+	"strip":    true,
+	"optional": true,
+	"on_error": true,
+	"match":    true,
+}
+
+// unmarshalLayer parses a layer directive, with the dispenser on the
+// backend name. the layer options are picked out of the block, and the rest
+// is handed to the filesystem module.
+func unmarshalLayer(d *caddyfile.Dispenser) (*Layer, error) {
+	name := d.Val()
+	module, options := splitLayerOptions(d.NextSegment())
+	md := caddyfile.NewDispenser(module)
+	md.Next()
+	modID := "caddy.fs." + name
+	unm, err := caddyfile.UnmarshalModule(md, modID)
+	if err != nil {
+		return nil, err
+	}
+	fsys, ok := unm.(fs.FS)
+	if !ok {
+		return nil, d.Errf("module %s (%T) is not a supported file system implementation", modID, unm)
+	}
+	l := &Layer{FileSystemRaw: caddyconfig.JSONModuleObject(fsys, "backend", name, nil)}
+	od := caddyfile.NewDispenser(options)
+	for od.Next() {
+		key := od.Val()
+		switch strings.ToLower(key) {
+		case "mount":
+			if !od.Args(&l.Mount) {
+				return nil, od.ArgErr()
+			}
+		case "strip":
+			if !od.Args(&l.Strip) {
+				return nil, od.ArgErr()
+			}
+		case "optional":
+			l.Optional = true
+		case "on_error":
+			if !od.Args(&l.OnError) {
+				return nil, od.ArgErr()
+			}
+		case "match":
+			matchers, err := caddyhttp.ParseCaddyfileNestedMatcherSet(od)
+			if err != nil {
+				return nil, err
+			}
+			l.MatchRaw = matchers
+		}
+		if od.NextArg() {
+			return nil, od.ArgErr()
+		}
+	}
+	return l, nil
+}
+
+// splitLayerOptions takes the lines of the layer options out of the top
+// level of the block in seg
+func splitLayerOptions(seg caddyfile.Segment) (module, options caddyfile.Segment) {
+	depth := 0
+	option := false
+	for i, tkn := range seg {
+		newLine := i == 0 || tkn.File != seg[i-1].File || tkn.Line > seg[i-1].Line+seg[i-1].NumLineBreaks()
+		if newLine && depth == 1 {
+			// lines further in belong to the block of the line they are in
+			option = !tkn.Quoted() && layerOptions[strings.ToLower(tkn.Text)]
+		}
+		if option {
+			options = append(options, tkn)
+		} else {
+			module = append(module, tkn)
+		}
+		if !tkn.Quoted() {
+			switch tkn.Text {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+		}
+	}
+	return module, options
+}
+
+// cleanLayerPath turns a mount or strip path into an fs.FS path
+func cleanLayerPath(p string) (string, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		p = "."
+	}
+	if !fs.ValidPath(p) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return p, nil
+}
+
+// backend returns the name of the filesystem module of the layer
+func (l *Layer) backend() string {
+	var probe struct {
+		Backend string `json:"backend"`
+	}
+	json.Unmarshal(l.FileSystemRaw, &probe)
+	return probe.Backend
+}
+
+// place serves the strip sub-tree of fsys at the mount point
+func (l *Layer) place(fsys fs.FS) (fs.FS, error) {
+	strip, err := cleanLayerPath(l.Strip)
+	if err != nil {
+		return nil, fmt.Errorf("strip: %w", err)
+	}
+	mount, err := cleanLayerPath(l.Mount)
+	if err != nil {
+		return nil, fmt.Errorf("mount: %w", err)
+	}
+	if strip != "." {
+		if fsys, err = fs.Sub(fsys, strip); err != nil {
+			return nil, fmt.Errorf("strip: %w", err)
+		}
+	}
+	if mount != "." {
+		fsys = &mountFs{fsys: fsys, mount: mount}
+	}
+	return fsys, nil
+}
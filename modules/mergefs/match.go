@@ -0,0 +1,95 @@
+package mergefs
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gfx-labs/swim/pkg/fsmap"
+	"go.uber.org/zap"
+)
+
+// MergeLayers is an http handler that adds the conditional layers of a
+// merge filesystem, the ones with a match, to the requests they match. the
+// filesystem by itself has no request to match against, so it leaves them
+// out. the handler swaps the "fs" variable for a view of the filesystem
+// with the matching layers in it, so file_server and try_files read from
+// it.
+type MergeLayers struct {
+	// the merge filesystem. defaults to the one named by the "fs" variable,
+	// as set by the fs directive.
+	FileSystem string `json:"filesystem,omitempty"`
+
+	log         *zap.Logger
+	fileSystems caddy.FileSystems
+}
+
+func (m *MergeLayers) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.merge_layers",
+		New: func() caddy.Module {
+			return new(MergeLayers)
+		},
+	}
+}
+
+func (m *MergeLayers) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			// optional arg
+			m.FileSystem = d.Val()
+		}
+		if d.NextArg() {
+			// too many args
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+func (m *MergeLayers) Provision(ctx caddy.Context) error {
+	m.log = ctx.Logger()
+	m.fileSystems = ctx.FileSystems()
+	return nil
+}
+
+func (m *MergeLayers) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	name := m.FileSystem
+	if name == "" {
+		name, _ = caddyhttp.GetVar(r.Context(), "fs").(string)
+	}
+	fsys, ok := m.fileSystems.Get(name)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	s, ok := fsmap.Unwrap(fsys).(*Mergefs)
+	if !ok {
+		m.log.Debug("filesystem is not a merge filesystem, leaving it", zap.String("fs", name))
+		return next.ServeHTTP(w, r)
+	}
+	var mask uint64
+	bit := 0
+	for _, matchers := range s.matchers {
+		if matchers == nil {
+			continue
+		}
+		match, err := matchers.MatchWithError(r)
+		if err != nil {
+			return err
+		}
+		if match {
+			mask |= 1 << bit
+		}
+		bit++
+	}
+	if mask == 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	// set the filesystem variable for downstream handlers (file_server, try_files, etc.)
+	caddyhttp.SetVar(r.Context(), "fs", s.view(mask).name)
+	return next.ServeHTTP(w, r)
+}
+
+var _ caddyhttp.MiddlewareHandler = (*MergeLayers)(nil)
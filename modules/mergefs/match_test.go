@@ -0,0 +1,162 @@
+package mergefs
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/gfx-labs/swim/plugin/localfs"
+	"github.com/stretchr/testify/require"
+)
+
+func layerDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, body := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644))
+	}
+	return dir
+}
+
+func TestMergeLayers(t *testing.T) {
+	drafts := layerDir(t, map[string]string{"index.html": "draft", "draft.html": "draft only"})
+	canary := layerDir(t, map[string]string{"index.html": "canary", "app.js": "canary app"})
+	site := layerDir(t, map[string]string{"index.html": "live", "app.js": "live app"})
+
+	var s Mergefs
+	require.NoError(t, json.Unmarshal([]byte(`{"layers":[
+		{"filesystem":{"backend":"localfs","root":`+strconv.Quote(drafts)+`},"match":{"header":{"Cookie":["*preview=1*"]}}},
+		{"filesystem":{"backend":"localfs","root":`+strconv.Quote(canary)+`},"match":{"remote_ip":{"ranges":["10.0.0.0/8"]}}},
+		{"backend":"localfs","root":`+strconv.Quote(site)+`}
+	]}`), &s))
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	require.NoError(t, s.Provision(ctx))
+	defer s.Cleanup()
+	s.fileSystems.Register("site", &s)
+
+	// without a request there is nothing to match, so only the live layer
+	data, err := fs.ReadFile(&s, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "live", string(data))
+
+	h := &MergeLayers{}
+	require.NoError(t, h.Provision(ctx))
+	// outside of a caddy config every context has its own map
+	h.fileSystems = s.fileSystems
+
+	serve := func(r *http.Request) fs.FS {
+		rctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{})
+		r = r.WithContext(context.WithValue(rctx, caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		caddyhttp.SetVar(r.Context(), "fs", "site")
+		var fsys fs.FS
+		err := h.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			name, _ := caddyhttp.GetVar(r.Context(), "fs").(string)
+			var ok bool
+			fsys, ok = s.fileSystems.Get(name)
+			require.True(t, ok, name)
+			return nil
+		}))
+		require.NoError(t, err)
+		return fsys
+	}
+	read := func(fsys fs.FS, name string) string {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+
+	public := httptest.NewRequest(http.MethodGet, "/", nil)
+	public.RemoteAddr = "203.0.113.7:1234"
+	fsys := serve(public)
+	require.Equal(t, "live", read(fsys, "index.html"))
+	require.Contains(t, read(fsys, "draft.html"), "not exist")
+
+	preview := httptest.NewRequest(http.MethodGet, "/", nil)
+	preview.RemoteAddr = "203.0.113.7:1234"
+	preview.Header.Set("Cookie", "session=x; preview=1")
+	fsys = serve(preview)
+	require.Equal(t, "draft", read(fsys, "index.html"))
+	require.Equal(t, "draft only", read(fsys, "draft.html"))
+	require.Equal(t, "live app", read(fsys, "app.js"))
+
+	internal := httptest.NewRequest(http.MethodGet, "/", nil)
+	internal.RemoteAddr = "10.1.2.3:1234"
+	fsys = serve(internal)
+	require.Equal(t, "canary", read(fsys, "index.html"))
+	require.Equal(t, "canary app", read(fsys, "app.js"))
+
+	internal.Header.Set("Cookie", "preview=1")
+	fsys = serve(internal)
+	require.Equal(t, "draft", read(fsys, "index.html"))
+	require.Equal(t, "canary app", read(fsys, "app.js"))
+
+	// views are made once and shared
+	require.Len(t, s.views, 3)
+	require.Same(t, s.view(1), s.view(1))
+
+	// and go away with the filesystem
+	name := s.view(1).name
+	require.NoError(t, s.Cleanup())
+	_, ok := s.fileSystems.Get(name)
+	require.False(t, ok)
+}
+
+func TestMergeLayersIndexed(t *testing.T) {
+	drafts := layerDir(t, map[string]string{"draft.html": "draft only"})
+	site := layerDir(t, map[string]string{"index.html": "live"})
+
+	var s Mergefs
+	require.NoError(t, json.Unmarshal([]byte(`{"index":true,"layers":[
+		{"filesystem":{"backend":"localfs","root":`+strconv.Quote(drafts)+`},"match":{"header":{"X-Preview":["1"]}}},
+		{"backend":"localfs","root":`+strconv.Quote(site)+`}
+	]}`), &s))
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	require.NoError(t, s.Provision(ctx))
+	defer s.Cleanup()
+
+	v := s.view(1)
+	// served from the layers until it is indexed
+	entries, err := fs.ReadDir(v, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Eventually(t, func() bool { return v.index.Load() != nil }, 5*time.Second, 10*time.Millisecond, "views of an indexed filesystem are indexed too")
+	entries, err = fs.ReadDir(v, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	_, err = fs.Stat(&s, "draft.html")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMergeLayerMatchCaddyfile(t *testing.T) {
+	var s Mergefs
+	d := caddyfile.NewTestDispenser(`merge {
+		layer localfs /srv/drafts {
+			match {
+				header Cookie *preview=1*
+				remote_ip 10.0.0.0/8
+			}
+			optional
+		}
+		layer localfs /srv/site
+	}`)
+	require.NoError(t, s.UnmarshalCaddyfile(d))
+	require.Len(t, s.Layers, 2)
+	require.True(t, s.Layers[0].Optional)
+	require.JSONEq(t, `{"Cookie":["*preview=1*"]}`, string(s.Layers[0].MatchRaw["header"]))
+	require.JSONEq(t, `{"ranges":["10.0.0.0/8"]}`, string(s.Layers[0].MatchRaw["remote_ip"]))
+	require.JSONEq(t, `{"backend":"localfs","root":"/srv/drafts"}`, string(s.Layers[0].FileSystemRaw))
+	require.Nil(t, s.Layers[1].MatchRaw)
+}
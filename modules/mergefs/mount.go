@@ -0,0 +1,77 @@
+package mergefs
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// mountFs serves fsys under the path mount. the directories leading down to
+// the mount point exist, with nothing but the next one in them, so the
+// union lists the mount point alongside the other layers.
+type mountFs struct {
+	fsys  fs.FS
+	mount string
+}
+
+func (m *mountFs) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == m.mount {
+		return m.fsys.Open(".")
+	}
+	if rest, ok := strings.CutPrefix(name, m.mount+"/"); ok {
+		return m.fsys.Open(rest)
+	}
+	// one of the directories on the way down to the mount point
+	var next string
+	switch {
+	case name == ".":
+		next, _, _ = strings.Cut(m.mount, "/")
+	case strings.HasPrefix(m.mount, name+"/"):
+		next, _, _ = strings.Cut(strings.TrimPrefix(m.mount, name+"/"), "/")
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &mountDir{name: name, next: next}, nil
+}
+
+// mountDir is a directory on the way down to a mount point
+type mountDir struct {
+	name string
+	next string
+	read bool
+}
+
+func (d *mountDir) Stat() (fs.FileInfo, error) { return dirInfo(d.name), nil }
+func (d *mountDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+func (d *mountDir) Close() error { return nil }
+
+func (d *mountDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	return []fs.DirEntry{fs.FileInfoToDirEntry(dirInfo(d.next))}, nil
+}
+
+type dirInfo string
+
+func (fi dirInfo) Name() string {
+	if i := strings.LastIndexByte(string(fi), '/'); i >= 0 {
+		return string(fi)[i+1:]
+	}
+	return string(fi)
+}
+func (fi dirInfo) Size() int64        { return 0 }
+func (fi dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (fi dirInfo) ModTime() time.Time { return time.Time{} }
+func (fi dirInfo) IsDir() bool        { return true }
+func (fi dirInfo) Sys() any           { return nil }
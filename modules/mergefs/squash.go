@@ -0,0 +1,187 @@
+package mergefs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Squash returns upper over lower as a single layer, which has the same
+// effect on the layers below it as the two of them. what upper hides of lower
+// is left out, and the whiteouts and opaque markers of both are kept, so the
+// result can stand in for the pair over any other layers.
+func Squash(upper, lower fs.FS) fs.FS {
+	return &squashFs{upper: upper, lower: lower}
+}
+
+type squashFs struct {
+	upper, lower fs.FS
+}
+
+func (s *squashFs) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := s.upper.Open(name)
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !info.IsDir() {
+			return f, nil
+		}
+		f.Close()
+		return &squashDir{s: s, name: name, info: info}, nil
+	}
+	if !missing(err) {
+		return nil, err
+	}
+	hidden, err := hides(s.upper, name)
+	if err != nil {
+		return nil, err
+	}
+	if hidden {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if path.Base(name) == OpaqueMarker {
+		opaque, err := s.replacesFile(path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		if opaque {
+			return &markerFile{info: markerInfo{}}, nil
+		}
+	}
+	return s.lower.Open(name)
+}
+
+// replacesFile reports whether the directory dir of upper is where lower has
+// something that is not a directory. whatever hid the layers below dir was
+// lost with it, so the squashed directory needs an opaque marker of its own.
+func (s *squashFs) replacesFile(dir string) (bool, error) {
+	info, err := fs.Stat(s.upper, dir)
+	if missing(err) {
+		return false, nil
+	}
+	if err != nil || !info.IsDir() {
+		return false, err
+	}
+	info, err = fs.Stat(s.lower, dir)
+	if missing(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// squashDir is a directory of upper, merged with lower's unless upper hides
+// it. the listing is only put together once it is read.
+type squashDir struct {
+	s    *squashFs
+	name string
+	info fs.FileInfo
+
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *squashDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *squashDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+func (d *squashDir) Close() error { return nil }
+
+func (d *squashDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// list lists the directory in upper, then adds the entries of lower that
+// upper neither has nor hides, whiteouts included
+func (d *squashDir) list() ([]fs.DirEntry, error) {
+	s := d.s
+	entries, err := fs.ReadDir(s.upper, d.name)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.Name()] = true
+	}
+	hidden, err := hides(s.upper, d.name)
+	if err != nil || hidden || seen[OpaqueMarker] {
+		return entries, err
+	}
+	info, err := fs.Stat(s.lower, d.name)
+	switch {
+	case missing(err):
+		return entries, nil
+	case err != nil:
+		return nil, err
+	case !info.IsDir():
+		entries = append(entries, fs.FileInfoToDirEntry(markerInfo{}))
+		return entries, nil
+	}
+	lower, err := fs.ReadDir(s.lower, d.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range lower {
+		if seen[e.Name()] {
+			continue
+		}
+		hidden, err := hides(s.upper, path.Join(d.name, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if !hidden {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// markerFile is an opaque marker made up by a squash
+type markerFile struct {
+	info markerInfo
+}
+
+func (f *markerFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *markerFile) Read([]byte) (int, error)   { return 0, io.EOF }
+func (f *markerFile) Close() error               { return nil }
+
+type markerInfo struct{}
+
+func (markerInfo) Name() string       { return OpaqueMarker }
+func (markerInfo) Size() int64        { return 0 }
+func (markerInfo) Mode() fs.FileMode  { return 0o644 }
+func (markerInfo) ModTime() time.Time { return time.Time{} }
+func (markerInfo) IsDir() bool        { return false }
+func (markerInfo) Sys() any           { return nil }
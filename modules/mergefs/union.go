@@ -0,0 +1,217 @@
+package mergefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+const (
+	// a file named .wh.<name> in a layer hides <name> in the layers below
+	WhiteoutPrefix = ".wh."
+	// a file with this name in a directory of a layer hides everything in
+	// that directory in the layers below
+	OpaqueMarker = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// unionFs overlays layers, layers[0] on top. a file is served from the
+// topmost layer that has it, directories are merged across layers, and
+// whiteouts in a layer hide files and directories of the layers below, the
+// same way overlayfs and oci image layers do.
+type unionFs struct {
+	layers []fs.FS
+}
+
+func (u *unionFs) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if isWhiteoutPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	var dir *unionDir
+	for i, l := range u.layers {
+		f, err := l.Open(name)
+		switch {
+		case err == nil:
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			if !info.IsDir() {
+				if dir == nil {
+					return f, nil
+				}
+				// a directory above hides files below
+				f.Close()
+				return dir, nil
+			}
+			f.Close()
+			if dir == nil {
+				dir = &unionDir{u: u, name: name, info: info}
+			}
+			dir.layers = append(dir.layers, i)
+			opaque, err := exists(l, path.Join(name, OpaqueMarker))
+			if err != nil {
+				return nil, err
+			}
+			if opaque {
+				return dir, nil
+			}
+		case !missing(err):
+			return nil, err
+		}
+		hidden, err := hides(l, name)
+		if err != nil {
+			return nil, err
+		}
+		if hidden {
+			break
+		}
+	}
+	if dir == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return dir, nil
+}
+
+// hides reports whether layer has a whiteout for name or one of its parent
+// directories, an opaque marker in one of them, or something other than a
+// directory in place of one of them
+func hides(layer fs.FS, name string) (bool, error) {
+	for p := name; p != "."; p = path.Dir(p) {
+		if p != name {
+			info, err := fs.Stat(layer, p)
+			if err == nil && !info.IsDir() {
+				return true, nil
+			}
+			if err != nil && !missing(err) {
+				return false, err
+			}
+		}
+		dir := path.Dir(p)
+		for _, marker := range []string{WhiteoutPrefix + path.Base(p), OpaqueMarker} {
+			ok, err := exists(layer, path.Join(dir, marker))
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func exists(layer fs.FS, name string) (bool, error) {
+	_, err := fs.Stat(layer, name)
+	if err == nil {
+		return true, nil
+	}
+	if missing(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// missing reports whether err means there is nothing at the path, which
+// includes a file where a parent directory was expected
+func missing(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+func isWhiteoutPath(name string) bool {
+	for elem := range strings.SplitSeq(name, "/") {
+		if strings.HasPrefix(elem, WhiteoutPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unionDir is a directory merged from the layers that have it, topmost
+// first. the listing is only put together once it is read.
+type unionDir struct {
+	u      *unionFs
+	name   string
+	info   fs.FileInfo // from the topmost layer
+	layers []int
+
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *unionDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *unionDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+func (d *unionDir) Close() error { return nil }
+
+func (d *unionDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		merged, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range merged {
+			d.entries = append(d.entries, e.DirEntry)
+		}
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// mergedEntry is an entry of a merged listing, and the layer it is from
+type mergedEntry struct {
+	fs.DirEntry
+	layer int
+}
+
+// list lists the directory in each of its layers, topmost first, leaving
+// out whiteouts, the entries they hide, and entries shadowed by a layer
+// above
+func (d *unionDir) list() ([]mergedEntry, error) {
+	var merged []mergedEntry
+	seen := make(map[string]bool)
+	for _, i := range d.layers {
+		entries, err := fs.ReadDir(d.u.layers[i], d.name)
+		if missing(err) {
+			// e.g. a layer that is skipped because it is failing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var whiteouts []string
+		for _, e := range entries {
+			name := e.Name()
+			if hidden, ok := strings.CutPrefix(name, WhiteoutPrefix); ok {
+				whiteouts = append(whiteouts, hidden)
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				merged = append(merged, mergedEntry{DirEntry: e, layer: i})
+			}
+		}
+		// whiteouts only hide the entries of the layers below
+		for _, name := range whiteouts {
+			seen[name] = true
+		}
+	}
+	slices.SortFunc(merged, func(a, b mergedEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return merged, nil
+}
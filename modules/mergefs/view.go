@@ -0,0 +1,120 @@
+package mergefs
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// viewFsPrefix namespaces our entries in the global FileSystems map
+const viewFsPrefix = "merge_view:"
+
+// views are keyed by a bitmask of their conditional layers
+const maxConditionalLayers = 64
+
+// instances numbers every provisioned mergefs
+var instances atomic.Uint64
+
+// view is the union of the layers that are always there, plus a set of the
+// conditional ones. the merge_layers handler points requests at the view of
+// the conditional layers that match them.
+type view struct {
+	name  string // key in the FileSystems map, conditional views only
+	union *unionFs
+	index atomic.Pointer[pathIndex]
+}
+
+func (v *view) Open(name string) (fs.File, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if idx := v.index.Load(); idx != nil {
+		return idx.Open(name)
+	}
+	return v.union.Open(name)
+}
+
+func (v *view) buildIndex() error {
+	idx, err := buildIndex(v.union)
+	if err != nil {
+		return err
+	}
+	v.index.Store(idx)
+	return nil
+}
+
+// build sets up the base view, dropping the views of any previous layers
+func (s *Mergefs) build() {
+	s.dropViews()
+	s.base = s.newView(0)
+	s.indexed.Store(false)
+}
+
+// newView makes the view with the conditional layers set in mask
+func (s *Mergefs) newView(mask uint64) *view {
+	var layers []fs.FS
+	bit := 0
+	for i, l := range s.layers {
+		if s.matchers != nil && s.matchers[i] != nil {
+			on := mask&(1<<bit) != 0
+			bit++
+			if !on {
+				continue
+			}
+		}
+		layers = append(layers, l)
+	}
+	return &view{union: &unionFs{layers: layers}}
+}
+
+// view returns the registered view with the conditional layers set in mask,
+// making it on first use
+func (s *Mergefs) view(mask uint64) *view {
+	s.viewsMu.Lock()
+	defer s.viewsMu.Unlock()
+	if v, ok := s.views[mask]; ok {
+		return v
+	}
+	v := s.newView(mask)
+	v.name = fmt.Sprintf("%s%d-%x", viewFsPrefix, s.id, mask)
+	if s.indexed.Load() {
+		// walking the tree takes a while, so the view is served from the
+		// layers until it is indexed
+		go s.indexView(v)
+	}
+	if s.views == nil {
+		s.views = make(map[uint64]*view)
+	}
+	s.views[mask] = v
+	if s.fileSystems != nil {
+		s.fileSystems.Register(v.name, v)
+	}
+	return v
+}
+
+func (s *Mergefs) indexView(v *view) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if v.index.Load() != nil {
+		// indexed by a BuildIndex in the meantime
+		return
+	}
+	if err := v.buildIndex(); err != nil {
+		s.log.Warn("unable to index view, serving it without", zap.String("view", v.name), zap.Error(err))
+	}
+}
+
+func (s *Mergefs) dropViews() {
+	s.viewsMu.Lock()
+	defer s.viewsMu.Unlock()
+	for _, v := range s.views {
+		if s.fileSystems != nil {
+			s.fileSystems.Unregister(v.name)
+		}
+	}
+	clear(s.views)
+}
@@ -0,0 +1,114 @@
+package uploadfs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gfx-labs/swim/pkg/fsmap"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+// Dav is an http handler that serves an upload filesystem over webdav, so
+// editors can upload, move and delete files with any webdav client. a POST
+// to the root publishes the changes. it does no authentication of its own,
+// put it behind basic_auth or similar.
+type Dav struct {
+	// name of the upload filesystem
+	FileSystem string `json:"filesystem"`
+
+	// the path the handler is served under, e.g. /_dav. webdav responses
+	// hold full paths, so it is not stripped from requests beforehand.
+	Prefix string `json:"prefix,omitempty"`
+
+	log         *zap.Logger
+	fileSystems caddy.FileSystems
+	locks       webdav.LockSystem
+}
+
+func (h *Dav) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.upload_dav",
+		New: func() caddy.Module {
+			return new(Dav)
+		},
+	}
+}
+
+func (h *Dav) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.Args(&h.FileSystem) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			// too many args
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			key := d.Val()
+			switch strings.ToLower(key) {
+			case "prefix":
+				if !d.Args(&h.Prefix) {
+					return d.ArgErr()
+				}
+			default:
+				return d.SyntaxErr("invalid upload_dav option: " + key)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Dav) Provision(ctx caddy.Context) error {
+	h.log = ctx.Logger()
+	if h.FileSystem == "" {
+		return fmt.Errorf("upload_dav: filesystem is required")
+	}
+	h.Prefix = strings.TrimSuffix(h.Prefix, "/")
+	h.fileSystems = ctx.FileSystems()
+	h.locks = webdav.NewMemLS()
+	return nil
+}
+
+func (h *Dav) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// looked up per request, the filesystems may be provisioned after us
+	fsys, ok := h.fileSystems.Get(h.FileSystem)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("upload_dav: filesystem %s not found", h.FileSystem))
+	}
+	u, ok := fsmap.Unwrap(fsys).(*Uploadfs)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("upload_dav: filesystem %s is not an upload filesystem", h.FileSystem))
+	}
+
+	if r.Method == http.MethodPost {
+		if strings.Trim(strings.TrimPrefix(r.URL.Path, h.Prefix), "/") != "" {
+			return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("publish by posting to the root"))
+		}
+		if err := u.Publish(); err != nil {
+			h.log.Error("publish failed", zap.String("filesystem", h.FileSystem), zap.Error(err))
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	dav := &webdav.Handler{
+		Prefix:     h.Prefix,
+		FileSystem: davFs{u},
+		LockSystem: h.locks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				h.log.Debug("webdav request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+			}
+		},
+	}
+	dav.ServeHTTP(w, r)
+	return nil
+}
+
+var _ caddyhttp.MiddlewareHandler = (*Dav)(nil)
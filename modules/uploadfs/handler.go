@@ -0,0 +1,188 @@
+package uploadfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+var _ fs.FS = (*Uploadfs)(nil)
+
+// Uploadfs is a writable filesystem for hot-patching a site. uploads made
+// through the upload_dav handler land in a staging directory layered over
+// the base filesystem, and deletions are recorded there as whiteouts. a
+// publish packs the staged changes, whiteouts included, into an overlay
+// archive layered between the staging directory and the base, and empties
+// the staging directory.
+type Uploadfs struct {
+	// the filesystem the uploads are layered over. it stays the bottom
+	// layer after a publish, so it can keep changing underneath.
+	BaseRaw json.RawMessage `json:"base,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// directory the uploads are kept in until they are published
+	Staging string `json:"staging"`
+
+	// the overlay archive a publish writes, a .zip, .tar or .tar.gz. it holds
+	// everything published so far. publishing is disabled without one.
+	Archive string `json:"archive,omitempty"`
+
+	log *zap.Logger
+
+	// the staging directory over the published changes over the base
+	stack atomic.Pointer[stack]
+	base  fs.FS
+
+	// serializes changes to the staging directory, and publishes
+	mu sync.Mutex
+}
+
+func (u *Uploadfs) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.fs.upload",
+		New: func() caddy.Module {
+			return new(Uploadfs)
+		},
+	}
+}
+
+func (u *Uploadfs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			key := d.Val()
+			switch strings.ToLower(key) {
+			case "staging":
+				if !d.Args(&u.Staging) {
+					return d.ArgErr()
+				}
+			case "archive":
+				if !d.Args(&u.Archive) {
+					return d.ArgErr()
+				}
+			case "base":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				modID := "caddy.fs." + name
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				fsys, ok := unm.(fs.FS)
+				if !ok {
+					return d.Errf("module %s (%T) is not a supported file system implementation", modID, unm)
+				}
+				u.BaseRaw = caddyconfig.JSONModuleObject(fsys, "backend", name, nil)
+			default:
+				return d.SyntaxErr("invalid upload option: " + key)
+			}
+		}
+	}
+	return nil
+}
+
+func (u *Uploadfs) Provision(ctx caddy.Context) error {
+	u.log = ctx.Logger()
+	rp := caddy.NewReplacer()
+	u.Staging = rp.ReplaceAll(u.Staging, "")
+	u.Archive = rp.ReplaceAll(u.Archive, "")
+	if u.Staging == "" {
+		return fmt.Errorf("upload: staging is required")
+	}
+	if err := os.MkdirAll(u.Staging, 0o755); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if u.Archive != "" {
+		if err := checkArchiveType(u.Archive); err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+	}
+
+	if u.BaseRaw != nil {
+		mod, err := ctx.LoadModule(u, "BaseRaw")
+		if err != nil {
+			return fmt.Errorf("upload: loading base: %w", err)
+		}
+		var ok bool
+		if u.base, ok = mod.(fs.FS); !ok {
+			return fmt.Errorf("upload: base module is not fs.FS")
+		}
+	}
+	var (
+		published fs.FS
+		cleanup   func()
+	)
+	if u.Archive != "" {
+		var err error
+		published, cleanup, err = openArchive(u.Archive)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("upload: opening archive: %w", err)
+		}
+	}
+	u.setStack(published, cleanup)
+	u.log.Debug("provisioned upload filesystem", zap.String("staging", u.Staging), zap.String("archive", u.Archive), zap.Bool("base", u.base != nil))
+	return nil
+}
+
+// setStack layers the staging directory over published, which may be nil,
+// over the base. cleanup, if set, is called once the stack is replaced or
+// the filesystem is cleaned up, and the last file opened from it is closed.
+func (u *Uploadfs) setStack(published fs.FS, cleanup func()) {
+	s := newStack(stagedFs{os.DirFS(u.Staging)}, published, u.base, cleanup)
+	if old := u.stack.Swap(s); old != nil {
+		old.release()
+	}
+}
+
+// acquire returns the current stack with a reference taken on it
+func (u *Uploadfs) acquire() (*stack, error) {
+	for {
+		s := u.stack.Load()
+		if s.acquire() {
+			return s, nil
+		}
+		if u.stack.Load() == s {
+			// released by Cleanup
+			return nil, fs.ErrClosed
+		}
+		// swapped out by a publish, retry against the new stack
+	}
+}
+
+func (u *Uploadfs) Open(name string) (fs.File, error) {
+	s, err := u.acquire()
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.merged.Open(name)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	return &stackFile{File: f, s: s}, nil
+}
+
+func (u *Uploadfs) Cleanup() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s := u.stack.Load(); s != nil {
+		s.release()
+	}
+	return nil
+}
+
+// stagingPath is where name goes in the staging directory
+func (u *Uploadfs) stagingPath(name string) string {
+	return filepath.Join(u.Staging, filepath.FromSlash(name))
+}
@@ -0,0 +1,317 @@
+package uploadfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gfx-labs/swim/pkg/archive"
+	_ "github.com/gfx-labs/swim/plugin/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// newSite makes a base directory for an upload filesystem to be layered
+// over, and returns the config of one
+func newSite(t *testing.T) (dir string, config func(staging string) *Uploadfs) {
+	dir = t.TempDir()
+	base := filepath.Join(dir, "base")
+	for name, data := range map[string]string{
+		"index.html":  "v1",
+		"old.html":    "stale",
+		"docs/a.html": "a",
+		"docs/b.html": "b",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(base, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(base, name), []byte(data), 0o644))
+	}
+	return dir, func(staging string) *Uploadfs {
+		return &Uploadfs{
+			BaseRaw: []byte(`{"backend":"localfs","root":` + strconv.Quote(base) + `}`),
+			Staging: filepath.Join(dir, staging),
+			Archive: filepath.Join(dir, "site.zip"),
+		}
+	}
+}
+
+// newDav serves u over webdav under /_dav, and returns a func to make
+// requests with
+func newDav(t *testing.T, ctx caddy.Context, u *Uploadfs) (*Dav, func(method, target, body string, header ...string) int) {
+	h := &Dav{FileSystem: "site", Prefix: "/_dav"}
+	require.NoError(t, h.Provision(ctx))
+	// outside of a caddy config every context has its own map
+	h.fileSystems.Register("site", u)
+	return h, func(method, target, body string, header ...string) int {
+		r := httptest.NewRequest(method, "http://example.com"+target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, h.ServeHTTP(w, r, nil))
+		return w.Code
+	}
+}
+
+func provisionUpload(t *testing.T, ctx caddy.Context, u *Uploadfs) *Uploadfs {
+	require.NoError(t, u.Provision(ctx))
+	t.Cleanup(func() { u.Cleanup() })
+	return u
+}
+
+func readString(fsys fs.FS, name string) string {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// files lists every file of fsys with its contents
+func files(t *testing.T, fsys fs.FS) map[string]string {
+	out := make(map[string]string)
+	require.NoError(t, fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		out[p] = readString(fsys, p)
+		return nil
+	}))
+	return out
+}
+
+func TestUploadDav(t *testing.T) {
+	dir, config := newSite(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	u := provisionUpload(t, ctx, config("staging"))
+	h, do := newDav(t, ctx, u)
+
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/_dav/index.html", "v2"))
+	require.Equal(t, http.StatusConflict, do(http.MethodPut, "/_dav/new/page.html", "nope"), "the parent has to exist")
+	require.Equal(t, http.StatusCreated, do("MKCOL", "/_dav/new", ""))
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/_dav/new/page.html", "page"))
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/_dav/old.html", ""))
+	require.Equal(t, http.StatusCreated, do("MOVE", "/_dav/docs", "", "Destination", "http://example.com/_dav/guides"))
+	require.NotEqual(t, http.StatusCreated, do(http.MethodPut, "/_dav/.wh.index.html", "sneaky"))
+	require.Equal(t, http.StatusMethodNotAllowed, func() int {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/_dav/index.html", nil)
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var herr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &herr)
+		return herr.StatusCode
+	}())
+
+	expected := map[string]string{
+		"index.html":    "v2",
+		"new/page.html": "page",
+		"guides/a.html": "a",
+		"guides/b.html": "b",
+	}
+	require.Equal(t, expected, files(t, u))
+	// nothing is published yet
+	_, err := os.Stat(u.Archive)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a directory made where a removed one was starts out empty
+	require.Equal(t, http.StatusCreated, do("MKCOL", "/_dav/docs", ""))
+	entries, err := fs.ReadDir(u, "docs")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "/_dav/", ""))
+	require.Equal(t, expected, files(t, u), "nothing changes for readers")
+	staged, err := os.ReadDir(u.Staging)
+	require.NoError(t, err)
+	require.Empty(t, staged)
+
+	// the archive only has the changes, whiteouts included
+	require.Equal(t, map[string]string{
+		"index.html":        "v2",
+		"new/page.html":     "page",
+		"guides/a.html":     "a",
+		"guides/b.html":     "b",
+		".wh.old.html":      "",
+		"docs/.wh..wh..opq": "",
+	}, readArchive(t, u.Archive))
+	// and is layered over the base on the next start
+	again := provisionUpload(t, ctx, config("staging2"))
+	require.Equal(t, expected, files(t, again))
+	require.Contains(t, listDirs(t, again), "docs")
+
+	// the base is still there underneath, so changes to it show through
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base", "about.html"), []byte("about"), 0o644))
+	require.Equal(t, "about", readString(u, "about.html"))
+	require.Equal(t, "about", readString(again, "about.html"))
+
+	// and editing goes on from there
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/_dav/guides", ""))
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/_dav/new/page.html", ""))
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/_dav/new/other.html", "other"))
+	expected = map[string]string{"index.html": "v2", "about.html": "about", "new/other.html": "other"}
+	require.Equal(t, expected, files(t, u))
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "/_dav/", ""))
+	require.Equal(t, expected, files(t, u))
+	require.Equal(t, map[string]string{
+		"index.html":        "v2",
+		"new/other.html":    "other",
+		"new/.wh.page.html": "",
+		".wh.guides":        "",
+		".wh.old.html":      "",
+		"docs/.wh..wh..opq": "",
+	}, readArchive(t, u.Archive))
+	again = provisionUpload(t, ctx, config("staging3"))
+	require.Equal(t, expected, files(t, again))
+}
+
+func readArchive(t *testing.T, path string) map[string]string {
+	fsys, _, cleanup, err := archive.OpenZipFs(path)
+	require.NoError(t, err)
+	defer cleanup()
+	return files(t, afero.NewIOFS(fsys))
+}
+
+func listDirs(t *testing.T, fsys fs.FS) []string {
+	var dirs []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return err
+	}))
+	sort.Strings(dirs)
+	return dirs
+}
+
+func TestUploadCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`upload {
+		staging /var/lib/caddy/site
+		archive /srv/site.zip
+		base localfs {
+			root /srv/seed
+		}
+	}`)
+	var u Uploadfs
+	require.NoError(t, u.UnmarshalCaddyfile(d))
+	require.Equal(t, "/var/lib/caddy/site", u.Staging)
+	require.Equal(t, "/srv/site.zip", u.Archive)
+	require.JSONEq(t, `{"backend":"localfs","root":"/srv/seed"}`, string(u.BaseRaw))
+
+	d = caddyfile.NewTestDispenser(`upload_dav site {
+		prefix /_dav
+	}`)
+	var h Dav
+	require.NoError(t, h.UnmarshalCaddyfile(d))
+	require.Equal(t, "site", h.FileSystem)
+	require.Equal(t, "/_dav", h.Prefix)
+
+	require.Error(t, h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`upload_dav site other`)))
+}
+
+func TestUploadInProgress(t *testing.T) {
+	_, config := newSite(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	u := provisionUpload(t, ctx, config("staging"))
+	d := davFs{u}
+
+	f, err := d.OpenFile(context.Background(), "index.html", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("half"))
+	require.NoError(t, err)
+	require.Equal(t, "v1", readString(u, "index.html"), "half written uploads are not served")
+	require.Equal(t, map[string]string{
+		"index.html":  "v1",
+		"old.html":    "stale",
+		"docs/a.html": "a",
+		"docs/b.html": "b",
+	}, files(t, u))
+
+	// nor published, and they survive a publish
+	require.NoError(t, os.WriteFile(filepath.Join(u.Staging, "extra.html"), []byte("extra"), 0o644))
+	require.NoError(t, u.Publish())
+	require.Equal(t, map[string]string{"extra.html": "extra"}, readArchive(t, u.Archive))
+	_, err = f.Write([]byte(" done"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "half done", readString(u, "index.html"))
+
+	// changing part of a file starts from what is there
+	f, err = d.OpenFile(context.Background(), "docs/a.html", os.O_RDWR|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("ppend"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "append", readString(u, "docs/a.html"))
+
+	staged, err := os.ReadDir(u.Staging)
+	require.NoError(t, err)
+	for _, e := range staged {
+		require.False(t, isUpload(e.Name()), "left behind %s", e.Name())
+	}
+}
+
+func TestUploadPublishKeepsOpenFiles(t *testing.T) {
+	_, config := newSite(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	u := provisionUpload(t, ctx, config("staging"))
+	require.NoError(t, os.WriteFile(filepath.Join(u.Staging, "index.html"), []byte("published"), 0o644))
+	require.NoError(t, u.Publish())
+
+	// read from the archive while it is replaced
+	f, err := u.Open("index.html")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(u.Staging, "index.html"), []byte("again"), 0o644))
+	require.NoError(t, u.Publish())
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "published", string(data))
+	require.NoError(t, f.Close())
+	require.Equal(t, "again", readString(u, "index.html"))
+}
+
+func TestUploadSeedBase(t *testing.T) {
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed")
+	require.NoError(t, os.MkdirAll(seed, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(seed, "index.html"), []byte("seed"), 0o644))
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	config := func(staging string) *Uploadfs {
+		return &Uploadfs{
+			BaseRaw: []byte(`{"backend":"localfs","root":` + strconv.Quote(seed) + `}`),
+			Staging: filepath.Join(dir, staging),
+			Archive: filepath.Join(dir, "site.tar.gz"),
+		}
+	}
+
+	u := provisionUpload(t, ctx, config("staging"))
+	require.Equal(t, "seed", readString(u, "index.html"))
+	require.NoError(t, os.WriteFile(filepath.Join(u.Staging, "extra.html"), []byte("extra"), 0o644))
+	require.NoError(t, u.Publish())
+	require.Equal(t, map[string]string{"extra.html": "extra"}, readTarGz(t, filepath.Join(dir, "site.tar.gz")))
+
+	// the base stays the bottom layer after a publish, and across restarts
+	require.NoError(t, os.WriteFile(filepath.Join(seed, "index.html"), []byte("changed"), 0o644))
+	require.Equal(t, "changed", readString(u, "index.html"))
+	again := provisionUpload(t, ctx, config("staging2"))
+	require.Equal(t, map[string]string{"index.html": "changed", "extra.html": "extra"}, files(t, again))
+}
+
+func readTarGz(t *testing.T, path string) map[string]string {
+	fsys, cleanup, err := openArchive(path)
+	require.NoError(t, err)
+	defer cleanup()
+	return files(t, fsys)
+}
@@ -0,0 +1,123 @@
+package uploadfs
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gfx-labs/swim/modules/mergefs"
+	"github.com/gfx-labs/swim/pkg/archive"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+func checkArchiveType(name string) error {
+	switch archive.FiletypeFromName(name) {
+	case ".zip", ".tar", ".tar.gz":
+		return nil
+	}
+	return fmt.Errorf("archive %s is not a .zip, .tar or .tar.gz", name)
+}
+
+// openArchive opens a published overlay archive to serve from
+func openArchive(name string) (fs.FS, func(), error) {
+	var (
+		a       afero.Fs
+		cleanup func()
+		err     error
+	)
+	switch ft := archive.FiletypeFromName(name); ft {
+	case ".zip":
+		a, _, cleanup, err = archive.OpenZipFs(name)
+	case ".tar":
+		a, _, cleanup, err = archive.OpenTarFs(name)
+	default:
+		// compressed, so decompress it to disk for random access
+		var f *os.File
+		if f, err = os.Open(name); err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		a, _, cleanup, err = archive.SpoolFs(ft, f, os.TempDir())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return afero.NewIOFS(a), cleanup, nil
+}
+
+// Publish packs the staged changes, whiteouts included, over what was
+// published before into a new overlay archive, which replaces the previous
+// one atomically. the new archive is layered over the base in place of the
+// old one, and the staging directory is emptied.
+func (u *Uploadfs) Publish() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Archive == "" {
+		return fmt.Errorf("upload: publishing is disabled without an archive")
+	}
+	start := time.Now()
+
+	var changes fs.FS = stagedFs{os.DirFS(u.Staging)}
+	if prev := u.stack.Load().published; prev != nil {
+		changes = mergefs.Squash(changes, prev)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.Archive), "."+filepath.Base(u.Archive)+".*")
+	if err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = archive.WriteArchive(archive.FiletypeFromName(u.Archive), w, changes)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("upload: packing archive: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), u.Archive); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+
+	published, cleanup, err := openArchive(u.Archive)
+	if err != nil {
+		// the staging directory still has the changes, keep serving them
+		return fmt.Errorf("upload: opening published archive: %w", err)
+	}
+	// the new archive has everything that is staged, so the staging
+	// directory can go now without anything changing for readers. the old
+	// archive is closed once the last file read from it is.
+	u.setStack(published, cleanup)
+	if err := u.clearStaging(); err != nil {
+		return fmt.Errorf("upload: clearing staging: %w", err)
+	}
+	u.log.Info("published", zap.String("archive", u.Archive), zap.Duration("took", time.Since(start)))
+	return nil
+}
+
+// clearStaging empties the staging directory, except for uploads that are
+// still being written
+func (u *Uploadfs) clearStaging() error {
+	entries, err := os.ReadDir(u.Staging)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if isUpload(e.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(u.Staging, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package uploadfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gfx-labs/swim/modules/mergefs"
+)
+
+// stack is the staging directory over the published changes, if any, over
+// the base. it is reference counted like vfs revisions, so that the archive
+// of a stack which a publish replaced stays open until the last request
+// reading from it closes its file.
+type stack struct {
+	merged *mergefs.Mergefs
+	// the published changes over the base, what staging is layered over
+	lower fs.FS
+	// the published archive as packed, whiteouts and all, or nil
+	published fs.FS
+	cleanup   func()
+
+	// open files, plus one for as long as the stack is current
+	refs atomic.Int64
+}
+
+func newStack(staging, published, base fs.FS, cleanup func()) *stack {
+	var below []fs.FS
+	for _, l := range []fs.FS{published, base} {
+		if l != nil {
+			below = append(below, l)
+		}
+	}
+	lower := new(mergefs.Mergefs)
+	lower.BuildLayers(below)
+	merged := new(mergefs.Mergefs)
+	merged.BuildLayers(append([]fs.FS{staging}, below...))
+	s := &stack{
+		merged:    merged,
+		lower:     lower,
+		published: published,
+		cleanup:   cleanup,
+	}
+	s.refs.Store(1)
+	return s
+}
+
+// acquire takes a reference, failing if the stack was already released
+func (s *stack) acquire() bool {
+	for {
+		n := s.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *stack) release() {
+	if s.refs.Add(-1) == 0 && s.cleanup != nil {
+		s.cleanup()
+	}
+}
+
+// stackFile holds a reference on its stack until it is closed
+type stackFile struct {
+	fs.File
+	s    *stack
+	once sync.Once
+}
+
+func (f *stackFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.s.release)
+	return err
+}
+
+func (f *stackFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *stackFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *stackFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, errors.ErrUnsupported
+}
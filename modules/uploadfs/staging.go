@@ -0,0 +1,403 @@
+package uploadfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gfx-labs/swim/modules/mergefs"
+	"golang.org/x/net/webdav"
+)
+
+var _ webdav.FileSystem = davFs{}
+
+// davFs is the webdav view of an Uploadfs. reads see the staging directory
+// over the layers below, writes go to a temporary file in the staging
+// directory which is renamed into place once it is closed, and removals of
+// what the layers below have leave whiteouts behind.
+type davFs struct {
+	u *Uploadfs
+}
+
+// clean turns a webdav path into an fs.FS one
+func clean(name string) (string, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	for elem := range strings.SplitSeq(name, "/") {
+		if strings.HasPrefix(elem, mergefs.WhiteoutPrefix) {
+			// reserved for whiteouts
+			return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+	}
+	return name, nil
+}
+
+func (d davFs) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	name, err := clean(name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := d.u.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer st.release()
+	return fs.Stat(st.merged, name)
+}
+
+func (d davFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		f, err := d.u.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &readOnlyFile{File: f, name: name}, nil
+	}
+
+	d.u.mu.Lock()
+	defer d.u.mu.Unlock()
+	if err := d.checkParent(name); err != nil {
+		return nil, err
+	}
+	info, err := fs.Stat(d.merged(), name)
+	exists := err == nil
+	switch {
+	case exists && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && (!errors.Is(err, fs.ErrNotExist) || flag&os.O_CREATE == 0):
+		return nil, err
+	}
+	tmp, err := d.tempFile()
+	if err != nil {
+		return nil, err
+	}
+	if exists && flag&os.O_TRUNC == 0 {
+		// changed in part, so it needs what is there first
+		err = copyFile(d.merged(), name, tmp)
+	} else {
+		err = os.Chmod(tmp, perm.Perm()&^0o022)
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(tmp, os.O_RDWR|flag&os.O_APPEND, 0)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &uploadFile{File: f, d: d, name: name}, nil
+}
+
+func (d davFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := clean(name)
+	if err != nil {
+		return err
+	}
+	d.u.mu.Lock()
+	defer d.u.mu.Unlock()
+	return d.mkdir(name, perm)
+}
+
+func (d davFs) mkdir(name string, perm os.FileMode) error {
+	if err := d.checkParent(name); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(d.merged(), name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := d.stageDir(path.Dir(name)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(d.u.stagingPath(name), perm); err != nil {
+		return err
+	}
+	return d.unhide(name, true)
+}
+
+func (d davFs) RemoveAll(ctx context.Context, name string) error {
+	name, err := clean(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	d.u.mu.Lock()
+	defer d.u.mu.Unlock()
+	return d.removeAll(name)
+}
+
+func (d davFs) removeAll(name string) error {
+	if err := os.RemoveAll(d.u.stagingPath(name)); err != nil {
+		return err
+	}
+	if !d.inBase(name) {
+		return nil
+	}
+	if err := d.stageDir(path.Dir(name)); err != nil {
+		return err
+	}
+	return os.WriteFile(d.u.stagingPath(whiteout(name)), nil, 0o644)
+}
+
+func (d davFs) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := clean(oldName)
+	if err != nil {
+		return err
+	}
+	newName, err = clean(newName)
+	if err != nil {
+		return err
+	}
+	if oldName == "." || newName == "." {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+	if newName == oldName || strings.HasPrefix(newName, oldName+"/") {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+	d.u.mu.Lock()
+	defer d.u.mu.Unlock()
+	if _, err := fs.Stat(d.merged(), oldName); err != nil {
+		return err
+	}
+	if err := d.copyTree(oldName, newName); err != nil {
+		return err
+	}
+	return d.removeAll(oldName)
+}
+
+// copyTree copies oldName and everything below it in the merged tree to
+// newName in the staging directory
+func (d davFs) copyTree(oldName, newName string) error {
+	merged := d.merged()
+	return fs.WalkDir(merged, oldName, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := newName + strings.TrimPrefix(p, oldName)
+		if e.IsDir() {
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			return d.mkdir(target, info.Mode().Perm()|0o700)
+		}
+		tmp, err := d.tempFile()
+		if err != nil {
+			return err
+		}
+		if err := copyFile(merged, p, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return d.stageFile(tmp, target)
+	})
+}
+
+// merged is the staging directory over the layers below. the stack is only
+// replaced by a publish, so it is safe to use without a reference while
+// holding the lock.
+func (d davFs) merged() fs.FS {
+	return d.u.stack.Load().merged
+}
+
+// tempFile makes an empty file to write an upload to, in the staging
+// directory so it can be renamed into place
+func (d davFs) tempFile() (string, error) {
+	f, err := os.CreateTemp(d.u.Staging, uploadPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// stageFile renames the finished upload tmp into place as name. it must be
+// called with the lock held, and removes tmp if it fails.
+func (d davFs) stageFile(tmp, name string) error {
+	err := d.checkParent(name)
+	if err == nil {
+		err = d.stageDir(path.Dir(name))
+	}
+	if err == nil {
+		err = d.unhide(name, false)
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.u.stagingPath(name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// checkParent fails unless the directory name is in exists
+func (d davFs) checkParent(name string) error {
+	dir := path.Dir(name)
+	info, err := fs.Stat(d.merged(), dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// stageDir makes sure dir exists in the staging directory. it must exist in
+// the merged tree already.
+func (d davFs) stageDir(dir string) error {
+	return os.MkdirAll(d.u.stagingPath(dir), 0o755)
+}
+
+// unhide takes away the whiteout of name, if it has one. a directory that
+// replaces one of the layers below gets an opaque marker instead, so what
+// they had in it stays hidden.
+func (d davFs) unhide(name string, dir bool) error {
+	err := os.Remove(d.u.stagingPath(whiteout(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir {
+		return os.WriteFile(d.u.stagingPath(path.Join(name, mergefs.OpaqueMarker)), nil, 0o644)
+	}
+	return nil
+}
+
+// inBase reports whether the layers below the staging directory have name
+func (d davFs) inBase(name string) bool {
+	_, err := fs.Stat(d.u.stack.Load().lower, name)
+	return err == nil
+}
+
+func whiteout(name string) string {
+	return path.Join(path.Dir(name), mergefs.WhiteoutPrefix+path.Base(name))
+}
+
+// copyFile copies name out of fsys over dst, which must exist
+func copyFile(fsys fs.FS, name, dst string) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode().Perm() | 0o600); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// uploadFile is an upload being written to a temporary file, which takes
+// the place of name once it is closed
+type uploadFile struct {
+	*os.File
+	d    davFs
+	name string
+	once sync.Once
+}
+
+func (f *uploadFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		if err != nil {
+			os.Remove(f.File.Name())
+			return
+		}
+		f.d.u.mu.Lock()
+		defer f.d.u.mu.Unlock()
+		err = f.d.stageFile(f.File.Name(), f.name)
+	})
+	return err
+}
+
+// uploads still being written are kept at the top of the staging directory
+// under a name that is reserved for whiteouts, so they are never served
+const uploadPrefix = mergefs.WhiteoutPrefix + mergefs.WhiteoutPrefix + "upload-"
+
+func isUpload(name string) bool {
+	return strings.HasPrefix(name, uploadPrefix) && !strings.Contains(name, "/")
+}
+
+// stagedFs is the staging directory without the uploads still being written
+type stagedFs struct {
+	fs.FS
+}
+
+func (s stagedFs) Open(name string) (fs.File, error) {
+	if isUpload(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return s.FS.Open(name)
+}
+
+func (s stagedFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(s.FS, name)
+	if name == "." {
+		entries = slices.DeleteFunc(entries, func(e fs.DirEntry) bool { return isUpload(e.Name()) })
+	}
+	return entries, err
+}
+
+// readOnlyFile serves a file of the merged tree over webdav
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *readOnlyFile) Readdir(count int) ([]fs.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	entries, err := d.ReadDir(count)
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+func (f *readOnlyFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
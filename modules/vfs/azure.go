@@ -0,0 +1,258 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/gfx-labs/swim/pkg/archive"
+	"github.com/spf13/afero"
+)
+
+// azureContainer builds a client for the container that an az:// url points
+// at, and returns the blob name in it. credentials are taken from, in order,
+// a connection string, an account key or a sas token; without any of them
+// the container is accessed anonymously. the blob endpoint defaults to the
+// public one of the account, and can be overridden for e.g. azurite.
+func (o *Overlay) azureContainer(u *url.URL) (*container.Client, string, error) {
+	name := u.Host
+	if name == "" {
+		return nil, "", fmt.Errorf("azure: container name is required (az://container/blob)")
+	}
+	blobName := strings.TrimPrefix(u.Path, "/")
+
+	if conn := o.headerOrEnv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+		client, err := container.NewClientFromConnectionString(conn, name, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("azure: %w", err)
+		}
+		return client, blobName, nil
+	}
+
+	account := o.headerOrEnv("AZURE_STORAGE_ACCOUNT")
+	endpoint := o.headerOrEnv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		if account == "" {
+			return nil, "", fmt.Errorf("azure: AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_ENDPOINT is required")
+		}
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	containerUrl := strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(name)
+
+	if key := o.headerOrEnv("AZURE_STORAGE_KEY"); key != "" {
+		if account == "" {
+			return nil, "", fmt.Errorf("azure: AZURE_STORAGE_ACCOUNT is required with AZURE_STORAGE_KEY")
+		}
+		cred, err := container.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, "", fmt.Errorf("azure: %w", err)
+		}
+		client, err := container.NewClientWithSharedKeyCredential(containerUrl, cred, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("azure: %w", err)
+		}
+		return client, blobName, nil
+	}
+	if sas := o.headerOrEnv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		containerUrl += "?" + strings.TrimPrefix(sas, "?")
+	}
+	client, err := container.NewClientWithNoCredential(containerUrl, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("azure: %w", err)
+	}
+	return client, blobName, nil
+}
+
+func isAzureNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+func (o *Overlay) openAzure(u *url.URL) (afero.Fs, func(), error) {
+	ctx := context.Background()
+	client, blobName, err := o.azureContainer(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.NewBlobClient(blobName).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("azure: read %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	h := make(http.Header)
+	if resp.ContentType != nil {
+		h.Set("Content-Type", *resp.ContentType)
+	}
+	if resp.ETag != nil {
+		h.Set("ETag", string(*resp.ETag))
+	}
+	return o.spool(u, h, resp.Body)
+}
+
+// versionAzure returns the ETag of the archive blob
+func (o *Overlay) versionAzure(u *url.URL) (string, error) {
+	client, blobName, err := o.azureContainer(u)
+	if err != nil {
+		return "", err
+	}
+	props, err := client.NewBlobClient(blobName).GetProperties(context.Background(), nil)
+	if err != nil {
+		return "", fmt.Errorf("azure: stat %s: %w", u.Redacted(), err)
+	}
+	if props.ETag == nil {
+		return "", nil
+	}
+	return string(*props.ETag), nil
+}
+
+// azureRanges returns the size of the archive blob and a fetcher for byte
+// ranges of it, pinned to the ETag seen when it was opened
+func (o *Overlay) azureRanges(u *url.URL) (int64, archive.RangeFetcher, error) {
+	ctx := context.Background()
+	client, blobName, err := o.azureContainer(u)
+	if err != nil {
+		return 0, nil, err
+	}
+	blobClient := client.NewBlobClient(blobName)
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("azure: stat %s: %w", u.Redacted(), err)
+	}
+	if props.ContentLength == nil {
+		return 0, nil, fmt.Errorf("azure: %s has no content length", u.Redacted())
+	}
+	fetch := func(off, length int64) (io.ReadCloser, error) {
+		resp, err := blobClient.DownloadStream(ctx, &blob.DownloadStreamOptions{
+			Range: blob.HTTPRange{Offset: off, Count: length},
+			AccessConditions: &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: props.ETag},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("azure: read %s: %w", u.Redacted(), err)
+		}
+		return resp.Body, nil
+	}
+	return *props.ContentLength, fetch, nil
+}
+
+// azureStore serves the blobs under a prefix of an azure container
+type azureStore struct {
+	client *container.Client
+	prefix string
+}
+
+// openAzurePrefix serves a container prefix as a live filesystem
+func (o *Overlay) openAzurePrefix(u *url.URL) (afero.Fs, func(), error) {
+	client, prefix, err := o.azureContainer(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	store := &azureStore{client: client, prefix: prefix}
+	return newBucketFs(store, time.Duration(o.MetadataTTL)), nil, nil
+}
+
+func (s *azureStore) head(ctx context.Context, key string) (*objectInfo, error) {
+	props, err := s.client.NewBlobClient(s.prefix+key).GetProperties(ctx, nil)
+	if err != nil {
+		if isAzureNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	info := &objectInfo{name: path.Base(key)}
+	if props.ContentLength != nil {
+		info.size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.modTime = *props.LastModified
+	}
+	return info, nil
+}
+
+func (s *azureStore) hasPrefix(ctx context.Context, dir string) (bool, error) {
+	prefix := s.prefix + dir
+	p := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:     &prefix,
+		MaxResults: ptr(int32(1)),
+	})
+	out, err := p.NextPage(ctx)
+	if err != nil {
+		return false, err
+	}
+	return out.Segment != nil && len(out.Segment.BlobItems) > 0, nil
+}
+
+func (s *azureStore) list(ctx context.Context, dir string) ([]*objectInfo, error) {
+	var entries []*objectInfo
+	prefix := s.prefix + dir
+	p := s.client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{Prefix: &prefix})
+	for p.More() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if out.Segment == nil {
+			continue
+		}
+		for _, bp := range out.Segment.BlobPrefixes {
+			if bp.Name == nil {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(*bp.Name, prefix), "/")
+			entries = append(entries, &objectInfo{name: name, dir: true})
+		}
+		for _, item := range out.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			name := strings.TrimPrefix(*item.Name, prefix)
+			if name == "" {
+				// directory marker blob
+				continue
+			}
+			info := &objectInfo{name: name}
+			if props := item.Properties; props != nil {
+				if props.ContentLength != nil {
+					info.size = *props.ContentLength
+				}
+				if props.LastModified != nil {
+					info.modTime = *props.LastModified
+				}
+			}
+			entries = append(entries, info)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *objectInfo) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+func (s *azureStore) read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error) {
+	rng := blob.HTTPRange{Offset: off}
+	if length >= 0 {
+		rng.Count = length
+	}
+	resp, err := s.client.NewBlobClient(s.prefix+key).DownloadStream(ctx, &blob.DownloadStreamOptions{Range: rng})
+	if err != nil {
+		if isAzureNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,209 @@
+package vfs_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const azureAccount = "devstoreaccount1"
+
+var azureKey = base64.StdEncoding.EncodeToString([]byte("not a real account key"))
+
+// fakeAzure is a minimal azurite style blob api over one in memory container.
+// it accepts shared key requests for its account and sas requests signed
+// with sig=s3cr3t.
+type fakeAzure struct {
+	container string
+	blobs     map[string]string
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorized := strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azureAccount+":") ||
+		r.URL.Query().Get("sig") == "s3cr3t"
+	if !authorized {
+		w.Header().Set("x-ms-error-code", "NoAuthenticationInformation")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+azureAccount+"/"+f.container)
+	if !ok {
+		w.Header().Set("x-ms-error-code", "ContainerNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if name == "" && r.URL.Query().Get("comp") == "list" {
+		prefix := r.URL.Query().Get("prefix")
+		delim := r.URL.Query().Get("delimiter")
+		var items []string
+		seen := map[string]bool{}
+		for _, k := range slices.Sorted(maps.Keys(f.blobs)) {
+			rest, ok := strings.CutPrefix(k, prefix)
+			if !ok {
+				continue
+			}
+			if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+				p := prefix + rest[:i+1]
+				if !seen[p] {
+					seen[p] = true
+					items = append(items, fmt.Sprintf("<BlobPrefix><Name>%s</Name></BlobPrefix>", p))
+				}
+				continue
+			}
+			items = append(items, fmt.Sprintf("<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>",
+				k, modified.Format(http.TimeFormat), len(f.blobs[k])))
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="%s"><Prefix>%s</Prefix><Blobs>%s</Blobs><NextMarker /></EnumerationResults>`,
+			f.container, prefix, strings.Join(items, ""))
+		return
+	}
+
+	body, ok := f.blobs[name]
+	if !ok {
+		w.Header().Set("x-ms-error-code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if rng := r.Header.Get("x-ms-range"); rng != "" {
+		r.Header.Set("Range", rng)
+	}
+	w.Header().Set("ETag", `"0x8DC0B"`)
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+	http.ServeContent(w, r, "", modified, strings.NewReader(body))
+}
+
+func newFakeAzure(t *testing.T, blobs map[string]string) string {
+	for _, key := range []string{"AZURE_STORAGE_CONNECTION_STRING", "AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_KEY", "AZURE_STORAGE_SAS_TOKEN", "AZURE_STORAGE_ENDPOINT"} {
+		t.Setenv(key, "")
+	}
+	srv := httptest.NewServer(&fakeAzure{container: "site", blobs: blobs})
+	t.Cleanup(srv.Close)
+	return srv.URL + "/" + azureAccount
+}
+
+func TestOverlayAzure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "from azure"})
+	tarball, err := os.ReadFile(path)
+	require.NoError(t, err)
+	endpoint := newFakeAzure(t, map[string]string{"releases/site.tar.gz": string(tarball)})
+
+	for name, headers := range map[string]map[string]string{
+		"shared key": {
+			"AZURE_STORAGE_ACCOUNT":  azureAccount,
+			"AZURE_STORAGE_KEY":      azureKey,
+			"AZURE_STORAGE_ENDPOINT": endpoint,
+		},
+		"sas token": {
+			"AZURE_STORAGE_ENDPOINT":  endpoint,
+			"AZURE_STORAGE_SAS_TOKEN": "?sv=2022-11-02&sp=r&sig=s3cr3t",
+		},
+		"connection string": {
+			"AZURE_STORAGE_CONNECTION_STRING": fmt.Sprintf("DefaultEndpointsProtocol=http;AccountName=%s;AccountKey=%s;BlobEndpoint=%s;", azureAccount, azureKey, endpoint),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range headers {
+				h.Set(k, v)
+			}
+			for _, scheme := range []string{"az", "azblob"} {
+				o := &vfs.Overlay{Root: scheme + "://site/releases/site.tar.gz", Headers: h, CacheDir: t.TempDir()}
+				fs, cleanup, err := o.OpenFilesystem()
+				require.NoError(t, err)
+				body, err := afero.ReadFile(fs, "index.html")
+				require.NoError(t, err)
+				require.Equal(t, "from azure", string(body))
+				cleanup()
+
+				version, err := o.Version()
+				require.NoError(t, err)
+				require.Equal(t, `"0x8DC0B"`, version)
+			}
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		key := newMinisignKey(t)
+		endpoint := newFakeAzure(t, map[string]string{
+			"releases/site.tar.gz":         string(tarball),
+			"releases/site.tar.gz.minisig": key.sign(tarball),
+		})
+		h := http.Header{}
+		h.Set("AZURE_STORAGE_ENDPOINT", endpoint)
+		h.Set("AZURE_STORAGE_SAS_TOKEN", "?sv=2022-11-02&sp=r&sig=s3cr3t")
+		o := &vfs.Overlay{Root: "az://site/releases/site.tar.gz", Headers: h, CacheDir: t.TempDir(), PublicKey: key.publicKey()}
+		fs, cleanup, err := o.OpenFilesystem()
+		require.NoError(t, err)
+		defer cleanup()
+		body, err := afero.ReadFile(fs, "index.html")
+		require.NoError(t, err)
+		require.Equal(t, "from azure", string(body))
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("AZURE_STORAGE_ENDPOINT", endpoint)
+		o := &vfs.Overlay{Root: "az://site/releases/site.tar.gz", Headers: h}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "401")
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		o := &vfs.Overlay{Root: "az://site/releases/site.tar.gz"}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_ENDPOINT is required")
+	})
+}
+
+func TestOverlayAzurePrefix(t *testing.T) {
+	endpoint := newFakeAzure(t, map[string]string{
+		"dist/index.html":    "<h1>home</h1>",
+		"dist/assets/app.js": "console.log(1)",
+		"other/secret.txt":   "nope",
+	})
+	h := http.Header{}
+	h.Set("AZURE_STORAGE_ACCOUNT", azureAccount)
+	h.Set("AZURE_STORAGE_KEY", azureKey)
+	h.Set("AZURE_STORAGE_ENDPOINT", endpoint)
+	o := &vfs.Overlay{Root: "az://site/dist/", Headers: h}
+
+	afs, cleanup, err := o.OpenFilesystem()
+	require.NoError(t, err)
+	defer cleanup()
+
+	body, err := afero.ReadFile(afs, "assets/app.js")
+	require.NoError(t, err)
+	require.Equal(t, "console.log(1)", string(body))
+
+	info, err := afs.Stat("assets")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	_, err = afs.Stat("secret.txt")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	infos, err := afero.ReadDir(afs, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	require.Equal(t, []string{"assets", "index.html"}, names)
+	require.EqualValues(t, len("<h1>home</h1>"), infos[1].Size())
+}
@@ -0,0 +1,340 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// how long listings and object metadata are cached for
+	defaultMetadataTTL = 10 * time.Second
+
+	// the metadata cache is dropped wholesale once it grows past this
+	maxMetadataEntries = 10_000
+)
+
+// objectInfo describes an object, or a common prefix, under a bucket prefix
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *objectInfo) Name() string       { return i.name }
+func (i *objectInfo) Size() int64        { return i.size }
+func (i *objectInfo) ModTime() time.Time { return i.modTime }
+func (i *objectInfo) IsDir() bool        { return i.dir }
+func (i *objectInfo) Sys() any           { return nil }
+func (i *objectInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// objectStore is the part of an object storage api that bucketFs needs. keys
+// are relative to the served prefix, and directories end in a slash.
+type objectStore interface {
+	// head returns the metadata of an object, or os.ErrNotExist
+	head(ctx context.Context, key string) (*objectInfo, error)
+	// hasPrefix reports whether any object exists under dir
+	hasPrefix(ctx context.Context, dir string) (bool, error)
+	// list returns the objects and prefixes directly under dir
+	list(ctx context.Context, dir string) ([]*objectInfo, error)
+	// read returns length bytes of an object from off, or the rest of it if
+	// length is negative
+	read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error)
+}
+
+// bucketFs is a live, read-only afero.Fs over a prefix of a bucket. object
+// metadata and listings are cached for a short time, contents are streamed
+// from the bucket on every read.
+type bucketFs struct {
+	store objectStore
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]metadataEntry
+}
+
+type metadataEntry struct {
+	info    *objectInfo   // stat results
+	entries []*objectInfo // listings
+	err     error
+	expires time.Time
+}
+
+func newBucketFs(store objectStore, ttl time.Duration) *bucketFs {
+	if ttl <= 0 {
+		ttl = defaultMetadataTTL
+	}
+	return &bucketFs{
+		store: store,
+		ttl:   ttl,
+		cache: make(map[string]metadataEntry),
+	}
+}
+
+// cached returns the cached entry for key, or fills it with fetch. only
+// successful lookups and missing objects are cached.
+func (b *bucketFs) cached(key string, fetch func() metadataEntry) metadataEntry {
+	now := time.Now()
+	b.mu.Lock()
+	e, ok := b.cache[key]
+	b.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e
+	}
+	e = fetch()
+	if e.err != nil && !errors.Is(e.err, os.ErrNotExist) {
+		return e
+	}
+	e.expires = now.Add(b.ttl)
+	b.mu.Lock()
+	if len(b.cache) >= maxMetadataEntries {
+		clear(b.cache)
+	}
+	b.cache[key] = e
+	b.mu.Unlock()
+	return e
+}
+
+func cleanObjectKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (b *bucketFs) stat(op, name string) (*objectInfo, error) {
+	key := cleanObjectKey(name)
+	if key == "" {
+		return &objectInfo{name: "/", dir: true}, nil
+	}
+	e := b.cached("stat:"+key, func() metadataEntry {
+		ctx := context.Background()
+		info, err := b.store.head(ctx, key)
+		if err == nil {
+			return metadataEntry{info: info}
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return metadataEntry{err: err}
+		}
+		// not an object, but it may still be a prefix
+		ok, err := b.store.hasPrefix(ctx, key+"/")
+		if err != nil {
+			return metadataEntry{err: err}
+		}
+		if !ok {
+			return metadataEntry{err: os.ErrNotExist}
+		}
+		return metadataEntry{info: &objectInfo{name: path.Base(key), dir: true}}
+	})
+	if e.err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: e.err}
+	}
+	return e.info, nil
+}
+
+func (b *bucketFs) list(key string) ([]*objectInfo, error) {
+	dir := ""
+	if key != "" {
+		dir = key + "/"
+	}
+	e := b.cached("list:"+dir, func() metadataEntry {
+		entries, err := b.store.list(context.Background(), dir)
+		return metadataEntry{entries: entries, err: err}
+	})
+	if e.err != nil {
+		return nil, e.err
+	}
+	// listings answer stats of their children for free
+	expires := time.Now().Add(b.ttl)
+	b.mu.Lock()
+	for _, info := range e.entries {
+		if len(b.cache) >= maxMetadataEntries {
+			break
+		}
+		b.cache["stat:"+path.Join(key, info.name)] = metadataEntry{info: info, expires: expires}
+	}
+	b.mu.Unlock()
+	return e.entries, nil
+}
+
+func (b *bucketFs) Open(name string) (afero.File, error) {
+	info, err := b.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketFile{fs: b, key: cleanObjectKey(name), info: info}, nil
+}
+
+func (b *bucketFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag != os.O_RDONLY {
+		return nil, syscall.EROFS
+	}
+	return b.Open(name)
+}
+
+func (b *bucketFs) Stat(name string) (os.FileInfo, error) {
+	return b.stat("stat", name)
+}
+
+func (b *bucketFs) Name() string                                        { return "bucketfs" }
+func (b *bucketFs) Create(name string) (afero.File, error)              { return nil, syscall.EROFS }
+func (b *bucketFs) Mkdir(name string, perm os.FileMode) error           { return syscall.EROFS }
+func (b *bucketFs) MkdirAll(path string, perm os.FileMode) error        { return syscall.EROFS }
+func (b *bucketFs) Remove(name string) error                            { return syscall.EROFS }
+func (b *bucketFs) RemoveAll(path string) error                         { return syscall.EROFS }
+func (b *bucketFs) Rename(oldname, newname string) error                { return syscall.EROFS }
+func (b *bucketFs) Chmod(name string, mode os.FileMode) error           { return syscall.EROFS }
+func (b *bucketFs) Chown(name string, uid, gid int) error               { return syscall.EROFS }
+func (b *bucketFs) Chtimes(name string, a time.Time, m time.Time) error { return syscall.EROFS }
+
+// bucketFile is an open object or prefix of a bucketFs. reads stream the
+// object from the current offset, and seeking drops the stream so the next
+// read starts a new one.
+type bucketFile struct {
+	fs     *bucketFs
+	key    string
+	info   *objectInfo
+	off    int64
+	body   io.ReadCloser
+	dirPos int
+	closed bool
+}
+
+func (f *bucketFile) Close() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	f.closed = true
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *bucketFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.info.dir {
+		return 0, syscall.EISDIR
+	}
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.fs.store.read(context.Background(), f.key, f.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *bucketFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.info.dir {
+		return 0, syscall.EISDIR
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	length := min(int64(len(p)), f.info.size-off)
+	body, err := f.fs.store.read(context.Background(), f.key, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *bucketFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.info.dir {
+		return 0, syscall.EISDIR
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *bucketFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if !f.info.dir {
+		return nil, syscall.ENOTDIR
+	}
+	entries, err := f.fs.list(f.key)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[min(f.dirPos, len(entries)):]
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if len(entries) > count {
+			entries = entries[:count]
+		}
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e)
+	}
+	f.dirPos += len(entries)
+	return infos, nil
+}
+
+func (f *bucketFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, fi := range infos {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *bucketFile) Name() string                             { return f.key }
+func (f *bucketFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *bucketFile) Sync() error                              { return nil }
+func (f *bucketFile) Write(p []byte) (int, error)              { return 0, syscall.EROFS }
+func (f *bucketFile) WriteAt(p []byte, off int64) (int, error) { return 0, syscall.EROFS }
+func (f *bucketFile) WriteString(s string) (int, error)        { return 0, syscall.EROFS }
+func (f *bucketFile) Truncate(size int64) error                { return syscall.EROFS }
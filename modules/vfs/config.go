@@ -3,10 +3,15 @@ package vfs
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
 )
 
 type Overlay struct {
@@ -14,6 +19,75 @@ type Overlay struct {
 	WorkDir string      `json:"workdir,omitempty"`
 	Type    string      `json:"type,omitempty"`
 	Headers http.Header `json:"request_headers"`
+
+	// directory that remote archives are spooled into. defaults to a
+	// directory under the system temp dir.
+	CacheDir string `json:"cache_dir,omitempty"`
+
+	// directory of spooled archives shared by every overlay that names it,
+	// keyed by source and version. archives found there are served without
+	// fetching them again, also across config reloads. the least recently
+	// used ones are evicted once it grows past SharedCacheSize bytes, which
+	// defaults to 1GiB.
+	SharedCache     string `json:"shared_cache,omitempty"`
+	SharedCacheSize int64  `json:"shared_cache_size,omitempty"`
+
+	// fetch remote zips on demand with range requests instead of
+	// downloading them up front
+	Lazy bool `json:"lazy,omitempty"`
+
+	// how often to poll the source for a new archive. zero disables polling.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// how many times to retry a failed load at startup, and the delay before
+	// the first retry. the delay doubles after every attempt.
+	Retries      int            `json:"retries,omitempty"`
+	RetryBackoff caddy.Duration `json:"retry_backoff,omitempty"`
+
+	// directory to keep a copy of the last successfully loaded archive in.
+	// it is served when the source is unreachable at startup.
+	LastKnownGood string `json:"last_known_good,omitempty"`
+
+	// expected sha256 of the archive, as hex with an optional "sha256:" prefix
+	Sha256 string `json:"sha256,omitempty"`
+
+	// minisign public key the archive must be signed with, and where to find
+	// its detached signature. the signature defaults to the root with
+	// .minisig appended.
+	PublicKey string `json:"public_key,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// how to authenticate to s3: anonymous, static, default, assume_role or
+	// web_identity. when unset, static keys are used if present and access
+	// is anonymous otherwise.
+	S3Credentials string `json:"s3_credentials,omitempty"`
+
+	// how long object metadata and listings are cached for when serving a
+	// bucket prefix. defaults to 10s.
+	MetadataTTL caddy.Duration `json:"metadata_ttl,omitempty"`
+
+	// http client settings for http(s), webdav and oci sources. the timeout
+	// limits connecting and waiting for response headers, not reading the
+	// body. failed requests are retried HttpRetries times on network errors,
+	// 429s and 5xxs. CaBundle is a pem file of root certificates trusted
+	// instead of the system ones, and ClientCert/ClientKey are pem files of
+	// a certificate to present for mtls. Proxy overrides the proxy taken
+	// from the environment.
+	Timeout            caddy.Duration `json:"timeout,omitempty"`
+	HttpRetries        int            `json:"http_retries,omitempty"`
+	CaBundle           string         `json:"ca_bundle,omitempty"`
+	ClientCert         string         `json:"client_cert,omitempty"`
+	ClientKey          string         `json:"client_key,omitempty"`
+	Proxy              string         `json:"proxy,omitempty"`
+	InsecureSkipVerify bool           `json:"insecure_skip_verify,omitempty"`
+
+	log *zap.Logger
+
+	httpClientMu sync.Mutex
+	client       *http.Client
+
+	s3CredsMu sync.Mutex
+	s3Creds   aws.CredentialsProvider
 }
 
 func (co *Overlay) String() string {
@@ -39,32 +113,166 @@ func (co *Overlay) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		co.Type = d.Val()
 	}
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
-		vKey := d.Val()
-		switch strings.ToLower(vKey) {
-		case "header":
-			var k, v string
-			if !d.Args(&k, &v) {
-				return d.ArgErr()
-			}
-			co.Headers.Add(k, v)
-		case "workdir":
-			if !d.Args(&co.WorkDir) {
-				// not enough args
-				return d.ArgErr()
-			}
-		case "type":
-			if !d.Args(&co.Type) {
-				// not enough args
-				return d.ArgErr()
-			}
-		case "root":
-			if !d.Args(&co.Root) {
-				// not enough args
-				return d.ArgErr()
+		if err := co.unmarshalOption(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalOption parses the block option at the cursor
+func (co *Overlay) unmarshalOption(d *caddyfile.Dispenser) error {
+	vKey := d.Val()
+	switch strings.ToLower(vKey) {
+	case "header":
+		var k, v string
+		if !d.Args(&k, &v) {
+			return d.ArgErr()
+		}
+		co.Headers.Add(k, v)
+	case "workdir":
+		if !d.Args(&co.WorkDir) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "type":
+		if !d.Args(&co.Type) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "root":
+		if !d.Args(&co.Root) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "cache_dir":
+		if !d.Args(&co.CacheDir) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "shared_cache":
+		if !d.Args(&co.SharedCache) {
+			// not enough args
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid shared_cache size: %s", d.Val())
 			}
+			co.SharedCacheSize = int64(size)
+		}
+	case "lazy":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		co.Lazy = true
+	case "refresh_interval":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid refresh_interval: %s", d.Val())
+		}
+		co.RefreshInterval = caddy.Duration(dur)
+	case "metadata_ttl":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid metadata_ttl: %s", d.Val())
+		}
+		co.MetadataTTL = caddy.Duration(dur)
+	case "retries":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 0 {
+			return d.Errf("invalid retries: %s", d.Val())
+		}
+		co.Retries = n
+	case "retry_backoff":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid retry_backoff: %s", d.Val())
+		}
+		co.RetryBackoff = caddy.Duration(dur)
+	case "last_known_good":
+		if !d.Args(&co.LastKnownGood) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "sha256":
+		if !d.Args(&co.Sha256) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "public_key":
+		if !d.Args(&co.PublicKey) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "signature":
+		if !d.Args(&co.Signature) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "s3_credentials":
+		if !d.Args(&co.S3Credentials) {
+			// not enough args
+			return d.ArgErr()
+		}
+		switch co.S3Credentials {
+		case s3CredentialsAnonymous, s3CredentialsStatic, s3CredentialsDefault, s3CredentialsAssumeRole, s3CredentialsWebIdentity:
 		default:
-			return d.SyntaxErr("invalid overlay option: " + vKey)
+			return d.Errf("invalid s3_credentials: %s", co.S3Credentials)
+		}
+	case "timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid timeout: %s", d.Val())
+		}
+		co.Timeout = caddy.Duration(dur)
+	case "http_retries":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 0 {
+			return d.Errf("invalid http_retries: %s", d.Val())
+		}
+		co.HttpRetries = n
+	case "ca_bundle":
+		if !d.Args(&co.CaBundle) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "client_cert":
+		if !d.Args(&co.ClientCert, &co.ClientKey) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "proxy":
+		if !d.Args(&co.Proxy) {
+			// not enough args
+			return d.ArgErr()
+		}
+	case "insecure_skip_verify":
+		if d.NextArg() {
+			return d.ArgErr()
 		}
+		co.InsecureSkipVerify = true
+	default:
+		return d.SyntaxErr("invalid overlay option: " + vKey)
 	}
 	return nil
 }
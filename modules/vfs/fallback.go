@@ -0,0 +1,245 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
+
+	// how often to retry the source while serving a last known good copy,
+	// when refresh_interval is not set
+	defaultRecoveryInterval = time.Minute
+)
+
+func (o *Overlay) logger() *zap.Logger {
+	if o.log == nil {
+		return zap.NewNop()
+	}
+	return o.log
+}
+
+// redactedRoot returns the root with any password in it masked
+func (o *Overlay) redactedRoot() string {
+	return redactRoot(o.Root)
+}
+
+func redactRoot(root string) string {
+	u, err := url.Parse(root)
+	if err != nil {
+		return root
+	}
+	return u.Redacted()
+}
+
+// lastKnownGoodPath returns where the last known good copy of the root is
+// kept. the name is derived from the root so several overlays can share a dir.
+func (o *Overlay) lastKnownGoodPath() string {
+	sum := sha256.Sum256([]byte(o.Root))
+	return filepath.Join(o.LastKnownGood, "lkg-"+hex.EncodeToString(sum[:16]))
+}
+
+// OpenLastKnownGood opens the last known good copy of the source, if there
+// is one. it is served exactly like a local archive, once it is verified
+// against the current integrity options, with the signature saved next to it
+// since the source may be unreachable.
+func (o *Overlay) OpenLastKnownGood() (afero.Fs, func(), error) {
+	if o.LastKnownGood == "" {
+		return nil, nil, fmt.Errorf("no last_known_good dir configured")
+	}
+	path := o.lastKnownGoodPath()
+	var v *verifier
+	if o.verifies() {
+		var sig []byte
+		if o.PublicKey != "" {
+			var err error
+			if sig, err = o.readSmall(&url.URL{Path: path + ".minisig"}); err != nil {
+				return nil, nil, fmt.Errorf("last known good signature: %w", err)
+			}
+		}
+		var err error
+		if v, err = o.signedVerifier(path+".minisig", sig); err != nil {
+			return nil, nil, err
+		}
+	}
+	fs, cleanup, err := o.openArchiveFile(&url.URL{Path: path}, v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cleanup == nil {
+		cleanup = func() {}
+	}
+	return o.chroot(fs), cleanup, nil
+}
+
+// lastKnownGoodWriter writes a copy of an archive next to its final path,
+// and only replaces the previous copy on commit. write errors are held until
+// commit, so a failing copy never interrupts the stream it is teed from.
+type lastKnownGoodWriter struct {
+	path string
+	file *os.File
+	err  error
+	// signature of the archive, saved next to it
+	sig []byte
+}
+
+func newLastKnownGoodWriter(path string) (*lastKnownGoodWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create last known good dir: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+	return &lastKnownGoodWriter{path: path, file: f}, nil
+}
+
+func (w *lastKnownGoodWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// commit atomically replaces the previous copy
+func (w *lastKnownGoodWriter) commit() error {
+	if w.file == nil {
+		return nil
+	}
+	f := w.file
+	w.file = nil
+	err := errors.Join(w.err, f.Sync(), f.Close())
+	if err == nil && w.sig != nil {
+		// a signature that does not match the copy fails verification, so
+		// a crash in between never has an unverified copy served
+		err = writeFileAtomic(w.path+".minisig", w.sig)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err = errors.Join(err, f.Sync(), f.Close()); err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// abort removes the temporary copy unless it was committed
+func (w *lastKnownGoodWriter) abort() {
+	if w.file == nil {
+		return
+	}
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.file = nil
+}
+
+// loadWithRetry loads the source, retrying with exponential backoff
+func (s *Vfs) loadWithRetry(ctx context.Context, version string) error {
+	backoff := time.Duration(s.Overlay.RetryBackoff)
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.load(version)
+		if err == nil || attempt > s.Overlay.Retries {
+			return err
+		}
+		s.log.Warn("vfs load failed, retrying",
+			zap.Any("fs", s.Overlay),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// loadLastKnownGood swaps in the last known good copy as a stale revision
+func (s *Vfs) loadLastKnownGood() error {
+	srv, cleanup, err := s.Overlay.OpenLastKnownGood()
+	if err != nil {
+		return err
+	}
+	rev := newRevision(srv, "", cleanup)
+	rev.stale = true
+	if old := s.cur.Swap(rev); old != nil {
+		old.release()
+	}
+	s.setStale(true)
+	return nil
+}
+
+// registerMetrics registers the vfs metrics with the config's registry. all
+// vfs instances in a config share one collector, labelled by root.
+func (s *Vfs) registerMetrics(reg *prometheus.Registry) {
+	if reg == nil {
+		return
+	}
+	stale := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "swim",
+		Subsystem: "vfs",
+		Name:      "stale",
+		Help:      "Whether the vfs is serving a last known good copy because its source is unreachable.",
+	}, []string{"root"})
+	if err := reg.Register(stale); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			s.log.Warn("unable to register vfs metrics", zap.Error(err))
+			return
+		}
+		stale = are.ExistingCollector.(*prometheus.GaugeVec)
+	}
+	s.stale = stale
+}
+
+// forgetMetrics removes the metrics labelled with the root, for instances
+// that come and go such as tenants
+func (s *Vfs) forgetMetrics() {
+	if s.stale != nil {
+		s.stale.DeleteLabelValues(s.Overlay.redactedRoot())
+	}
+}
+
+func (s *Vfs) setStale(stale bool) {
+	if s.stale == nil {
+		return
+	}
+	v := 0.0
+	if stale {
+		v = 1
+	}
+	s.stale.WithLabelValues(s.Overlay.redactedRoot()).Set(v)
+}
@@ -0,0 +1,172 @@
+package vfs_test
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer serves the archive at path with the given etag, or 503 while
+// down is set. failFirst requests fail before it starts serving.
+type flakyServer struct {
+	path      string
+	etag      atomic.Value
+	down      atomic.Bool
+	failFirst atomic.Int64
+	requests  atomic.Int64
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := f.requests.Add(1)
+	if f.down.Load() || n <= f.failFirst.Load() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if etag, ok := f.etag.Load().(string); ok {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeFile(w, r, f.path)
+}
+
+func staleMetric(t *testing.T, ctx caddy.Context) float64 {
+	t.Helper()
+	families, err := ctx.GetMetricsRegistry().Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() == "swim_vfs_stale" {
+			require.Len(t, mf.GetMetric(), 1)
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("swim_vfs_stale not registered")
+	return 0
+}
+
+func TestVfsRetriesStartupFetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "hello"})
+	f := &flakyServer{path: path}
+	f.failFirst.Store(2)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	v := &vfs.Vfs{Overlay: &vfs.Overlay{
+		Root:         srv.URL + "/site.tar.gz",
+		CacheDir:     t.TempDir(),
+		Retries:      2,
+		RetryBackoff: caddy.Duration(time.Millisecond),
+	}}
+	require.NoError(t, v.Provision(ctx))
+	defer v.Cleanup()
+
+	data, err := fs.ReadFile(v, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.EqualValues(t, 3, f.requests.Load())
+}
+
+func TestVfsRetriesExhausted(t *testing.T) {
+	f := &flakyServer{}
+	f.down.Store(true)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	v := &vfs.Vfs{Overlay: &vfs.Overlay{
+		Root:         srv.URL + "/site.tar.gz",
+		CacheDir:     t.TempDir(),
+		Retries:      1,
+		RetryBackoff: caddy.Duration(time.Millisecond),
+	}}
+	require.ErrorContains(t, v.Provision(ctx), "503")
+	require.EqualValues(t, 2, f.requests.Load())
+}
+
+func TestVfsServesLastKnownGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "v1"})
+	f := &flakyServer{path: path}
+	f.etag.Store(`"v1"`)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	lkg := t.TempDir()
+	overlay := func() *vfs.Overlay {
+		return &vfs.Overlay{
+			Root:            srv.URL + "/site.tar.gz",
+			CacheDir:        t.TempDir(),
+			LastKnownGood:   lkg,
+			RetryBackoff:    caddy.Duration(time.Millisecond),
+			RefreshInterval: caddy.Duration(10 * time.Millisecond),
+		}
+	}
+
+	// a successful load leaves a copy behind
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	v := &vfs.Vfs{Overlay: overlay()}
+	require.NoError(t, v.Provision(ctx))
+	require.Zero(t, staleMetric(t, ctx))
+	require.NoError(t, v.Cleanup())
+	cancel()
+	entries, err := os.ReadDir(lkg)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// the source goes away, the copy is served instead
+	f.down.Store(true)
+	writeTar(t, path, map[string]string{"index.html": "v2"})
+	f.etag.Store(`"v2"`)
+
+	ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	v = &vfs.Vfs{Overlay: overlay()}
+	require.NoError(t, v.Provision(ctx))
+	defer v.Cleanup()
+
+	data, err := fs.ReadFile(v, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(data))
+	require.Equal(t, 1.0, staleMetric(t, ctx))
+
+	// and replaced once the source is back
+	f.down.Store(false)
+	require.Eventually(t, func() bool {
+		data, err := fs.ReadFile(v, "index.html")
+		return err == nil && string(data) == "v2"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, staleMetric(t, ctx))
+}
+
+func TestVfsLastKnownGoodMissing(t *testing.T) {
+	f := &flakyServer{}
+	f.down.Store(true)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	v := &vfs.Vfs{Overlay: &vfs.Overlay{
+		Root:          srv.URL + "/site.tar.gz",
+		CacheDir:      t.TempDir(),
+		LastKnownGood: t.TempDir(),
+	}}
+	err := v.Provision(ctx)
+	require.ErrorContains(t, err, "503")
+	require.ErrorContains(t, err, "last known good")
+}
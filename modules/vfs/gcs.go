@@ -3,28 +3,44 @@ package vfs
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/gfx-labs/swim/pkg/archive"
 	"github.com/spf13/afero"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
-func (o *Overlay) openGcs(u *url.URL) (afero.Fs, error) {
-	ctx := context.Background()
-
+// gcsObject builds a gcs client from the overlay settings and returns a handle
+// to the object that the url points at. the caller must close the client.
+func (o *Overlay) gcsObject(ctx context.Context, u *url.URL) (*storage.Client, *storage.ObjectHandle, error) {
 	bucket := u.Host
 	key := strings.TrimPrefix(u.Path, "/")
 	if bucket == "" {
-		return nil, fmt.Errorf("gcs: bucket name is required (gs://bucket/key)")
+		return nil, nil, fmt.Errorf("gcs: bucket name is required (gs://bucket/key)")
 	}
 	if key == "" {
-		return nil, fmt.Errorf("gcs: object key is required (gs://bucket/key)")
+		return nil, nil, fmt.Errorf("gcs: object key is required (gs://bucket/key)")
+	}
+	client, err := o.gcsClient(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
+	return client, client.Bucket(bucket).Object(key), nil
+}
 
+// gcsClient builds a gcs client from the overlay settings
+func (o *Overlay) gcsClient(ctx context.Context) (*storage.Client, error) {
 	var opts []option.ClientOption
 
 	// credentials priority: base64-encoded JSON > file path > anonymous
@@ -52,21 +68,154 @@ func (o *Overlay) openGcs(u *url.URL) (afero.Fs, error) {
 	if err != nil {
 		return nil, fmt.Errorf("gcs: create client: %w", err)
 	}
+	return client, nil
+}
+
+func (o *Overlay) openGcs(u *url.URL) (afero.Fs, func(), error) {
+	ctx := context.Background()
+
+	client, obj, err := o.gcsObject(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer client.Close()
 
-	rc, err := client.Bucket(bucket).Object(key).NewReader(ctx)
+	// the reader does not report the etag, so read the generation it names
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gcs: stat gs://%s/%s: %w", obj.BucketName(), obj.ObjectName(), err)
+	}
+	rc, err := obj.Generation(attrs.Generation).NewReader(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("gcs: read gs://%s/%s: %w", bucket, key, err)
+		return nil, nil, fmt.Errorf("gcs: read gs://%s/%s: %w", obj.BucketName(), obj.ObjectName(), err)
 	}
 	defer rc.Close()
 
-	ft := o.Type
-	if ft == "" {
-		ft = archive.FiletypeFromName(u.String())
+	h := make(http.Header)
+	h.Set("Content-Type", rc.Attrs.ContentType)
+	h.Set("ETag", attrs.Etag)
+	return o.spool(u, h, rc)
+}
+
+// versionGcs returns the ETag of the archive object
+func (o *Overlay) versionGcs(u *url.URL) (string, error) {
+	ctx := context.Background()
+
+	client, obj, err := o.gcsObject(ctx, u)
+	if err != nil {
+		return "", err
 	}
-	fs, err := archive.FilesystemFromReader(ft, rc)
+	defer client.Close()
+
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
+		return "", fmt.Errorf("gcs: stat gs://%s/%s: %w", obj.BucketName(), obj.ObjectName(), err)
+	}
+	return attrs.Etag, nil
+}
+
+// gcsRanges returns the size of the archive object and a fetcher for byte
+// ranges of it, pinned to the generation seen when it was opened. the
+// returned close function releases the client.
+func (o *Overlay) gcsRanges(u *url.URL) (int64, archive.RangeFetcher, func(), error) {
+	ctx := context.Background()
+
+	client, obj, err := o.gcsObject(ctx, u)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		client.Close()
+		return 0, nil, nil, fmt.Errorf("gcs: stat gs://%s/%s: %w", obj.BucketName(), obj.ObjectName(), err)
+	}
+	pinned := obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	fetch := func(off, length int64) (io.ReadCloser, error) {
+		rc, err := pinned.NewRangeReader(ctx, off, length)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: read gs://%s/%s: %w", obj.BucketName(), obj.ObjectName(), err)
+		}
+		return rc, nil
+	}
+	return attrs.Size, fetch, func() { client.Close() }, nil
+}
+
+// gcsStore serves the objects under a prefix of a gcs bucket
+type gcsStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// openGcsPrefix serves a bucket prefix as a live filesystem
+func (o *Overlay) openGcsPrefix(u *url.URL) (afero.Fs, func(), error) {
+	if u.Host == "" {
+		return nil, nil, fmt.Errorf("gcs: bucket name is required (gs://bucket/prefix/)")
+	}
+	client, err := o.gcsClient(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	store := &gcsStore{
+		bucket: client.Bucket(u.Host),
+		prefix: strings.TrimPrefix(u.Path, "/"),
+	}
+	return newBucketFs(store, time.Duration(o.MetadataTTL)), func() { client.Close() }, nil
+}
+
+func (s *gcsStore) head(ctx context.Context, key string) (*objectInfo, error) {
+	attrs, err := s.bucket.Object(s.prefix + key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return &objectInfo{name: path.Base(key), size: attrs.Size, modTime: attrs.Updated}, nil
+}
+
+func (s *gcsStore) hasPrefix(ctx context.Context, dir string) (bool, error) {
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix + dir})
+	_, err := it.Next()
+	if errors.Is(err, iterator.Done) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *gcsStore) list(ctx context.Context, dir string) ([]*objectInfo, error) {
+	var entries []*objectInfo
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix + dir, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			name := strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, s.prefix+dir), "/")
+			entries = append(entries, &objectInfo{name: name, dir: true})
+			continue
+		}
+		name := strings.TrimPrefix(attrs.Name, s.prefix+dir)
+		if name == "" {
+			// directory marker object
+			continue
+		}
+		entries = append(entries, &objectInfo{name: name, size: attrs.Size, modTime: attrs.Updated})
+	}
+	slices.SortFunc(entries, func(a, b *objectInfo) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+func (s *gcsStore) read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error) {
+	rc, err := s.bucket.Object(s.prefix+key).NewRangeReader(ctx, off, length)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, os.ErrNotExist
+		}
 		return nil, err
 	}
-	return fs, nil
+	return rc, nil
 }
@@ -0,0 +1,404 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/spf13/afero"
+)
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// gitSource is a parsed git+https:// or git+file:// url. the ref to serve is
+// taken from the fragment, e.g. git+https://github.com/org/docs.git#gh-pages,
+// and may be a branch, a tag or a full commit hash. it defaults to HEAD.
+type gitSource struct {
+	url string
+	// url with any password masked, for errors
+	name string
+	ref  string
+	auth transport.AuthMethod
+}
+
+func (o *Overlay) gitSource(u *url.URL) (*gitSource, error) {
+	remote := *u
+	remote.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	remote.Fragment = ""
+	remote.RawFragment = ""
+	s := &gitSource{url: remote.String(), name: remote.Redacted(), ref: u.Fragment}
+	if user, pass := o.headerOrEnv("GIT_USERNAME"), o.headerOrEnv("GIT_PASSWORD"); pass != "" {
+		if user == "" {
+			// most forges accept any user name along with a token
+			user = "git"
+		}
+		s.auth = &githttp.BasicAuth{Username: user, Password: pass}
+	}
+	return s, nil
+}
+
+// resolve lists the remote refs and returns the full name and hash of the
+// ref. a commit hash resolves to itself with an empty name.
+func (s *gitSource) resolve(ctx context.Context) (plumbing.ReferenceName, plumbing.Hash, error) {
+	if commitHash.MatchString(s.ref) {
+		return "", plumbing.NewHash(s.ref), nil
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{s.url}})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: s.auth})
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("git: list %s: %w", s.name, err)
+	}
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+	var candidates []plumbing.ReferenceName
+	if s.ref == "" {
+		candidates = []plumbing.ReferenceName{plumbing.HEAD}
+	} else {
+		candidates = []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName(s.ref),
+			plumbing.NewTagReferenceName(s.ref),
+			plumbing.ReferenceName(s.ref),
+		}
+	}
+	for _, name := range candidates {
+		ref, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if ref.Type() == plumbing.SymbolicReference {
+			if ref, ok = byName[ref.Target()]; !ok {
+				continue
+			}
+		}
+		return ref.Name(), ref.Hash(), nil
+	}
+	return "", plumbing.ZeroHash, fmt.Errorf("git: ref %q not found in %s", s.ref, s.name)
+}
+
+// openGit clones the ref into a bare repository in the cache dir and serves
+// the tree of its commit
+func (o *Overlay) openGit(u *url.URL) (afero.Fs, func(), error) {
+	if o.verifies() {
+		return nil, nil, fmt.Errorf("git sources are verified by commit, pin the ref to a commit hash instead")
+	}
+	ctx := context.Background()
+	src, err := o.gitSource(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, hash, err := src.resolve(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(o.cacheDir(), 0o700); err != nil {
+		return nil, nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	dir, err := os.MkdirTemp(o.cacheDir(), "git-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	opts := &git.CloneOptions{
+		URL:  src.url,
+		Auth: src.auth,
+		Tags: git.NoTags,
+	}
+	if name != "" {
+		opts.ReferenceName = name
+		opts.SingleBranch = true
+		// local clones are cheap, and not every local transport is shallow capable
+		if u.Scheme != "git+file" {
+			opts.Depth = 1
+		}
+	}
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	repo, err := git.CloneContext(ctx, storage, nil, opts)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("git: clone %s: %w", src.name, err)
+	}
+	commit, err := gitCommit(repo, hash)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("git: %s at %s: %w", src.name, hash, err)
+	}
+	fs, err := newGitTreeFs(repo.Storer, commit)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("git: %s at %s: %w", src.name, hash, err)
+	}
+	return fs, cleanup, nil
+}
+
+// gitCommit returns the commit at hash, peeling annotated tags
+func gitCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	commit, err := repo.CommitObject(hash)
+	if err == nil {
+		return commit, nil
+	}
+	tag, tagErr := repo.TagObject(hash)
+	if tagErr != nil {
+		return nil, err
+	}
+	return tag.Commit()
+}
+
+// versionGit returns the commit the ref currently points at
+func (o *Overlay) versionGit(u *url.URL) (string, error) {
+	src, err := o.gitSource(u)
+	if err != nil {
+		return "", err
+	}
+	_, hash, err := src.resolve(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// gitTreeFs is a read-only afero.Fs over the tree of a commit. the tree is
+// indexed once, and blobs are read from the repository when opened. every
+// entry carries the commit time, since git does not record file times.
+// symlinks and submodules are left out.
+type gitTreeFs struct {
+	storer  storer.EncodedObjectStorer
+	entries map[string]*gitEntry
+
+	// the on-disk object storage is not safe for concurrent reads
+	mu sync.Mutex
+}
+
+type gitEntry struct {
+	name     string // absolute slash-separated path
+	hash     plumbing.Hash
+	size     int64
+	dir      bool
+	modTime  time.Time
+	children []string // sorted base names, directories only
+}
+
+func (e *gitEntry) info() os.FileInfo {
+	return &objectInfo{name: path.Base(e.name), size: e.size, modTime: e.modTime, dir: e.dir}
+}
+
+func newGitTreeFs(s storer.EncodedObjectStorer, commit *object.Commit) (*gitTreeFs, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	modTime := commit.Committer.When
+	g := &gitTreeFs{
+		storer:  s,
+		entries: map[string]*gitEntry{"/": {name: "/", dir: true, modTime: modTime}},
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, te, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &gitEntry{name: "/" + name, hash: te.Hash, modTime: modTime}
+		switch te.Mode {
+		case filemode.Dir:
+			e.dir = true
+		case filemode.Regular, filemode.Executable, filemode.Deprecated:
+			if e.size, err = tree.Size(name); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		g.entries[e.name] = e
+		parent := g.entries[path.Dir(e.name)]
+		parent.children = append(parent.children, path.Base(e.name))
+	}
+	for _, e := range g.entries {
+		sort.Strings(e.children)
+	}
+	return g, nil
+}
+
+func (g *gitTreeFs) lookup(op, name string) (*gitEntry, error) {
+	e, ok := g.entries[path.Clean("/"+name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (g *gitTreeFs) Open(name string) (afero.File, error) {
+	e, err := g.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &gitFile{fs: g, entry: e}
+	if !e.dir {
+		// blobs are usually delta compressed in a pack, so there is no
+		// random access into them. files are read whole on open.
+		data, err := g.readBlob(e.hash)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		f.data = bytes.NewReader(data)
+	}
+	return f, nil
+}
+
+func (g *gitTreeFs) readBlob(hash plumbing.Hash) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	blob, err := object.GetBlob(g.storer, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (g *gitTreeFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag != os.O_RDONLY {
+		return nil, syscall.EROFS
+	}
+	return g.Open(name)
+}
+
+func (g *gitTreeFs) Stat(name string) (os.FileInfo, error) {
+	e, err := g.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(), nil
+}
+
+func (g *gitTreeFs) Name() string                                        { return "gittreefs" }
+func (g *gitTreeFs) Create(name string) (afero.File, error)              { return nil, syscall.EROFS }
+func (g *gitTreeFs) Mkdir(name string, perm os.FileMode) error           { return syscall.EROFS }
+func (g *gitTreeFs) MkdirAll(path string, perm os.FileMode) error        { return syscall.EROFS }
+func (g *gitTreeFs) Remove(name string) error                            { return syscall.EROFS }
+func (g *gitTreeFs) RemoveAll(path string) error                         { return syscall.EROFS }
+func (g *gitTreeFs) Rename(oldname, newname string) error                { return syscall.EROFS }
+func (g *gitTreeFs) Chmod(name string, mode os.FileMode) error           { return syscall.EROFS }
+func (g *gitTreeFs) Chown(name string, uid, gid int) error               { return syscall.EROFS }
+func (g *gitTreeFs) Chtimes(name string, a time.Time, m time.Time) error { return syscall.EROFS }
+
+// gitFile is an open entry of a gitTreeFs
+type gitFile struct {
+	fs     *gitTreeFs
+	entry  *gitEntry
+	data   *bytes.Reader // nil for directories
+	dirPos int
+	closed bool
+}
+
+func (f *gitFile) Close() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *gitFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.Read(p)
+}
+
+func (f *gitFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.ReadAt(p, off)
+}
+
+func (f *gitFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.Seek(offset, whence)
+}
+
+func (f *gitFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.data != nil {
+		return nil, syscall.ENOTDIR
+	}
+	names := f.entry.children[f.dirPos:]
+	if count > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > count {
+			names = names[:count]
+		}
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		infos = append(infos, f.fs.entries[path.Join(f.entry.name, n)].info())
+	}
+	f.dirPos += len(names)
+	return infos, nil
+}
+
+func (f *gitFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, fi := range infos {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *gitFile) Name() string                             { return f.entry.name }
+func (f *gitFile) Stat() (os.FileInfo, error)               { return f.entry.info(), nil }
+func (f *gitFile) Sync() error                              { return nil }
+func (f *gitFile) Write(p []byte) (int, error)              { return 0, syscall.EROFS }
+func (f *gitFile) WriteAt(p []byte, off int64) (int, error) { return 0, syscall.EROFS }
+func (f *gitFile) WriteString(s string) (int, error)        { return 0, syscall.EROFS }
+func (f *gitFile) Truncate(size int64) error                { return syscall.EROFS }
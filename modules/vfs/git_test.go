@@ -0,0 +1,158 @@
+package vfs_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// gitRepo is a local repository to clone from
+type gitRepo struct {
+	t    *testing.T
+	dir  string
+	repo *git.Repository
+}
+
+func newGitRepo(t *testing.T) *gitRepo {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	return &gitRepo{t: t, dir: dir, repo: repo}
+}
+
+func (g *gitRepo) url() string {
+	return "git+file://" + g.dir
+}
+
+// commit replaces the worktree with files and commits it
+func (g *gitRepo) commit(files map[string]string) plumbing.Hash {
+	wt, err := g.repo.Worktree()
+	require.NoError(g.t, err)
+	entries, err := os.ReadDir(g.dir)
+	require.NoError(g.t, err)
+	for _, e := range entries {
+		if e.Name() != ".git" {
+			require.NoError(g.t, os.RemoveAll(filepath.Join(g.dir, e.Name())))
+		}
+	}
+	for name, body := range files {
+		p := filepath.Join(g.dir, name)
+		require.NoError(g.t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(g.t, os.WriteFile(p, []byte(body), 0o644))
+	}
+	require.NoError(g.t, wt.AddWithOptions(&git.AddOptions{All: true}))
+	hash, err := wt.Commit("update", &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: "ci", Email: "ci@example.com", When: time.Unix(1700000000, 0)},
+	})
+	require.NoError(g.t, err)
+	return hash
+}
+
+func (g *gitRepo) checkout(branch string, create bool) {
+	wt, err := g.repo.Worktree()
+	require.NoError(g.t, err)
+	require.NoError(g.t, wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: create}))
+}
+
+func TestOverlayGit(t *testing.T) {
+	g := newGitRepo(t)
+	first := g.commit(map[string]string{"readme.md": "source"})
+	tag, err := g.repo.CreateTag("v1", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "ci", Email: "ci@example.com", When: time.Unix(1700000000, 0)},
+		Message: "v1",
+	})
+	require.NoError(t, err)
+	g.checkout("gh-pages", true)
+	pages := g.commit(map[string]string{"site/index.html": "pages", "site/css/main.css": "body{}"})
+	g.checkout("master", false)
+	head := g.commit(map[string]string{"readme.md": "head"})
+
+	for _, tc := range []struct {
+		ref     string
+		workdir string
+		file    string
+		body    string
+		version plumbing.Hash
+	}{
+		{"", "", "readme.md", "head", head},
+		{"master", "", "readme.md", "head", head},
+		// annotated tags are versioned by the tag object
+		{"v1", "", "readme.md", "source", tag.Hash()},
+		{"gh-pages", "site", "index.html", "pages", pages},
+		{pages.String(), "/site", "css/main.css", "body{}", pages},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			root := g.url()
+			if tc.ref != "" {
+				root += "#" + tc.ref
+			}
+			o := &vfs.Overlay{Root: root, WorkDir: tc.workdir, CacheDir: t.TempDir()}
+			fs, cleanup, err := o.OpenFilesystem()
+			require.NoError(t, err)
+
+			body, err := afero.ReadFile(fs, tc.file)
+			require.NoError(t, err)
+			require.Equal(t, tc.body, string(body))
+
+			info, err := fs.Stat(tc.file)
+			require.NoError(t, err)
+			require.EqualValues(t, len(tc.body), info.Size())
+
+			version, err := o.Version()
+			require.NoError(t, err)
+			require.Equal(t, tc.version.String(), version)
+
+			cleanup()
+			entries, err := os.ReadDir(o.CacheDir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+
+	t.Run("readdir", func(t *testing.T) {
+		o := &vfs.Overlay{Root: g.url() + "#gh-pages", WorkDir: "site", CacheDir: t.TempDir()}
+		fs, cleanup, err := o.OpenFilesystem()
+		require.NoError(t, err)
+		defer cleanup()
+
+		entries, err := afero.ReadDir(fs, "/")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, "css", entries[0].Name())
+		require.True(t, entries[0].IsDir())
+		require.Equal(t, "index.html", entries[1].Name())
+		require.Equal(t, time.Unix(1700000000, 0).Unix(), entries[1].ModTime().Unix())
+
+		_, err = fs.Stat("readme.md")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("missing ref", func(t *testing.T) {
+		o := &vfs.Overlay{Root: g.url() + "#nope", CacheDir: t.TempDir()}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, `ref "nope" not found`)
+	})
+
+	t.Run("credentials are kept out of errors", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		root := strings.Replace(srv.URL, "http://", "git+http://ci:s3cr3t@", 1) + "/org/docs.git"
+		o := &vfs.Overlay{Root: root, CacheDir: t.TempDir()}
+		_, _, err := o.OpenFilesystem()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "ci:xxxxx@")
+		require.NotContains(t, err.Error(), "s3cr3t")
+	})
+}
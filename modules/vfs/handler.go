@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io/fs"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/spf13/afero"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -17,12 +19,16 @@ var _ fs.FS = (*Vfs)(nil)
 type Vfs struct {
 	Overlay *Overlay `json:"overlay"`
 
-	a afero.Fs
+	// current revision of the filesystem, swapped atomically on refresh.
+	// requests that already opened a file keep reading from the old revision.
+	cur atomic.Pointer[revision]
 
-	log *zap.Logger
+	log   *zap.Logger
+	stale *prometheus.GaugeVec
 
-	fs.FS
-	closers []func()
+	refreshStop chan struct{}
+	refreshWg   sync.WaitGroup
+	closers     []func()
 }
 
 func (s *Vfs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -41,7 +47,23 @@ func (s *Vfs) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 func (s *Vfs) Open(name string) (fs.File, error) {
 	name = strings.Trim(name, "/")
-	return s.FS.Open(name)
+	for {
+		rev := s.cur.Load()
+		if !rev.acquire() {
+			if s.cur.Load() == rev {
+				// released by Cleanup
+				return nil, fs.ErrClosed
+			}
+			// swapped out under us, retry against the new revision
+			continue
+		}
+		f, err := rev.fs.Open(name)
+		if err != nil {
+			rev.release()
+			return nil, err
+		}
+		return &revisionFile{File: f, rev: rev}, nil
+	}
 }
 
 func (s *Vfs) CaddyModule() caddy.ModuleInfo {
@@ -56,20 +78,114 @@ func (s *Vfs) CaddyModule() caddy.ModuleInfo {
 func (s *Vfs) Provision(ctx caddy.Context) error {
 	s.log = ctx.Logger()
 	s.log.Debug("initializing vfs", zap.Any("fs", s.Overlay))
-	start := time.Now()
 	s.Overlay.resolvePlaceholders()
-	srv, err := s.Overlay.OpenFilesystem()
-	if err != nil {
-		return fmt.Errorf("initialize overlay %s: %w", s.Overlay.String(), err)
+	if hasRequestPlaceholders(s.Overlay.Root) {
+		return fmt.Errorf("root %s depends on the request, serve it with the vfs_tenants handler instead", s.Overlay.Root)
+	}
+	return s.provision(ctx)
+}
+
+// provision loads an overlay whose placeholders are already resolved
+func (s *Vfs) provision(ctx caddy.Context) error {
+	start := time.Now()
+	s.Overlay.log = s.log
+	s.registerMetrics(ctx.GetMetricsRegistry())
+
+	// only probe the version when we will be polling for changes
+	var version string
+	if s.Overlay.RefreshInterval > 0 {
+		var err error
+		version, err = s.Overlay.Version()
+		if err != nil {
+			s.log.Warn("unable to read vfs source version", zap.Any("fs", s.Overlay), zap.Error(err))
+		}
+	}
+	if err := s.loadWithRetry(ctx, version); err != nil {
+		if s.Overlay.LastKnownGood == "" {
+			return fmt.Errorf("initialize overlay %s: %w", s.Overlay.String(), err)
+		}
+		if lkgErr := s.loadLastKnownGood(); lkgErr != nil {
+			return fmt.Errorf("initialize overlay %s: %w (last known good: %w)", s.Overlay.String(), err, lkgErr)
+		}
+		s.log.Warn("vfs source unreachable, serving stale last known good copy", zap.Any("fs", s.Overlay), zap.Error(err))
 	}
-	s.a = srv
-	s.FS = afero.NewIOFS(s.a)
 	s.log.Debug("initialized vfs", zap.Any("fs", s.Overlay), zap.Duration("took", time.Since(start)))
 
+	interval := time.Duration(s.Overlay.RefreshInterval)
+	if interval <= 0 && s.cur.Load().stale {
+		// keep trying the source until it comes back
+		interval = defaultRecoveryInterval
+	}
+	if interval > 0 {
+		s.refreshStop = make(chan struct{})
+		s.refreshWg.Add(1)
+		go s.runRefresher(interval)
+	}
+	return nil
+}
+
+// load opens the source and swaps it in as the current revision
+func (s *Vfs) load(version string) error {
+	srv, cleanup, err := s.Overlay.OpenFilesystem()
+	if err != nil {
+		return err
+	}
+	if old := s.cur.Swap(newRevision(srv, version, cleanup)); old != nil {
+		old.release()
+	}
+	s.setStale(false)
+	return nil
+}
+
+// runRefresher polls the source until Cleanup is called. without a refresh
+// interval it only runs until a stale revision has been replaced.
+func (s *Vfs) runRefresher(interval time.Duration) {
+	defer s.refreshWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.refresh(); err != nil {
+				s.log.Warn("vfs refresh failed, serving previous revision", zap.Any("fs", s.Overlay), zap.Bool("stale", s.cur.Load().stale), zap.Error(err))
+			}
+			if s.Overlay.RefreshInterval <= 0 && !s.cur.Load().stale {
+				return
+			}
+		case <-s.refreshStop:
+			return
+		}
+	}
+}
+
+// refresh reloads the source if its version changed since the last load,
+// or unconditionally while serving a stale copy
+func (s *Vfs) refresh() error {
+	version, err := s.Overlay.Version()
+	if err != nil {
+		return err
+	}
+	cur := s.cur.Load()
+	if !cur.stale && (version == "" || version == cur.version) {
+		return nil
+	}
+	start := time.Now()
+	if err := s.load(version); err != nil {
+		return err
+	}
+	s.log.Info("reloaded vfs", zap.Any("fs", s.Overlay), zap.String("version", version), zap.Duration("took", time.Since(start)))
 	return nil
 }
 
 func (s *Vfs) Cleanup() error {
+	if s.refreshStop != nil {
+		close(s.refreshStop)
+	}
+	s.refreshWg.Wait()
+	if rev := s.cur.Load(); rev != nil {
+		rev.release()
+	}
 	for _, closer := range s.closers {
 		closer()
 	}
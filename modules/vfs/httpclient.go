@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// the delay before the first retry of a failed http request. it doubles
+// after every attempt.
+const httpRetryBackoff = 250 * time.Millisecond
+
+// httpClient returns the client for http(s), webdav and oci sources. it is
+// built once per overlay so connections are reused across reloads. without
+// any http options this is http.DefaultClient.
+func (o *Overlay) httpClient() (*http.Client, error) {
+	o.httpClientMu.Lock()
+	defer o.httpClientMu.Unlock()
+	if o.client != nil {
+		return o.client, nil
+	}
+	client, err := o.newHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	o.client = client
+	return client, nil
+}
+
+// doHttp sends req with the client of the overlay
+func (o *Overlay) doHttp(req *http.Request) (*http.Response, error) {
+	client, err := o.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func (o *Overlay) newHttpClient() (*http.Client, error) {
+	if o.Timeout == 0 && o.HttpRetries == 0 && o.CaBundle == "" && o.ClientCert == "" && o.ClientKey == "" && o.Proxy == "" && !o.InsecureSkipVerify {
+		return http.DefaultClient, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.CaBundle != "" {
+		pem, err := os.ReadFile(o.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("ca_bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_bundle: no certificates found in %s", o.CaBundle)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if o.ClientCert != "" || o.ClientKey != "" {
+		if o.ClientCert == "" || o.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert: both a certificate and a key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client_cert: %w", err)
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	if o.Proxy != "" {
+		proxy, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	if o.Timeout > 0 {
+		// bodies are not limited, large archives take as long as they take
+		timeout := time.Duration(o.Timeout)
+		t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		t.TLSHandshakeTimeout = timeout
+		t.ResponseHeaderTimeout = timeout
+	}
+
+	var rt http.RoundTripper = t
+	if o.HttpRetries > 0 {
+		rt = &retryTransport{next: t, retries: o.HttpRetries, backoff: httpRetryBackoff}
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// retryTransport retries requests that fail before a usable response
+// arrives: network errors, 429s and 5xxs. only the request is retried, a
+// body that breaks off halfway is reported to the caller as is.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt == t.retries || !retryable(resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
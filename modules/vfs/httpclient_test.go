@@ -0,0 +1,164 @@
+package vfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// tarballHandler serves a tarball with an index.html saying body
+func tarballHandler(t *testing.T, body string) http.HandlerFunc {
+	path := filepath.Join(t.TempDir(), "site.tar")
+	writeTar(t, path, map[string]string{"index.html": body})
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	}
+}
+
+func writePem(t *testing.T, typ string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+	return path
+}
+
+func TestOverlayHttpTls(t *testing.T) {
+	srv := httptest.NewTLSServer(tarballHandler(t, "over tls"))
+	defer srv.Close()
+	root := srv.URL + "/site.tar"
+
+	t.Run("untrusted", func(t *testing.T) {
+		o := &vfs.Overlay{Root: root}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "certificate")
+	})
+
+	t.Run("ca bundle", func(t *testing.T) {
+		o := &vfs.Overlay{Root: root, CacheDir: t.TempDir(), CaBundle: writePem(t, "CERTIFICATE", srv.Certificate().Raw)}
+		require.Equal(t, "over tls", readFile(t, o, "index.html"))
+		version, err := o.Version()
+		require.NoError(t, err)
+		require.Equal(t, `"v1"`, version)
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		o := &vfs.Overlay{Root: root, CacheDir: t.TempDir(), InsecureSkipVerify: true}
+		require.Equal(t, "over tls", readFile(t, o, "index.html"))
+	})
+
+	t.Run("bad ca bundle", func(t *testing.T) {
+		o := &vfs.Overlay{Root: root, CaBundle: writePem(t, "NOT A CERTIFICATE", []byte("x"))}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "ca_bundle: no certificates found")
+	})
+}
+
+func TestOverlayHttpClientCert(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(tarballHandler(t, "mtls"))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/site.tar", InsecureSkipVerify: true}
+	_, _, err = o.OpenFilesystem()
+	require.Error(t, err, "the server requires a client certificate")
+
+	o = &vfs.Overlay{
+		Root:               srv.URL + "/site.tar",
+		CacheDir:           t.TempDir(),
+		InsecureSkipVerify: true,
+		ClientCert:         writePem(t, "CERTIFICATE", der),
+		ClientKey:          writePem(t, "PRIVATE KEY", keyDer),
+	}
+	require.Equal(t, "mtls", readFile(t, o, "index.html"))
+}
+
+func TestOverlayHttpRetries(t *testing.T) {
+	serve := tarballHandler(t, "eventually")
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serve(w, r)
+	}))
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/site.tar", HttpRetries: 1}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "503")
+
+	requests.Store(0)
+	o = &vfs.Overlay{Root: srv.URL + "/site.tar", CacheDir: t.TempDir(), HttpRetries: 2}
+	require.Equal(t, "eventually", readFile(t, o, "index.html"))
+	require.EqualValues(t, 3, requests.Load())
+}
+
+func TestOverlayHttpTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/site.tar", Timeout: caddy.Duration(50 * time.Millisecond)}
+	start := time.Now()
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "timeout")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestOverlayHttpProxy(t *testing.T) {
+	serve := tarballHandler(t, "via proxy")
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a forward proxy sees the absolute url of the target
+		if r.URL.Host != "artifacts.internal" {
+			http.Error(w, "unexpected target "+r.URL.Host, http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+		serve(w, r)
+	}))
+	defer proxy.Close()
+
+	o := &vfs.Overlay{Root: "http://artifacts.internal/site.tar", CacheDir: t.TempDir(), Proxy: proxy.URL}
+	require.Equal(t, "via proxy", readFile(t, o, "index.html"))
+	require.EqualValues(t, 1, proxied.Load())
+}
@@ -0,0 +1,52 @@
+package vfs
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gfx-labs/swim/pkg/archive"
+	"github.com/spf13/afero"
+)
+
+// openLazy opens a remote zip without downloading it. the central directory
+// and individual entries are fetched on demand with range requests and kept
+// in a block cache in the cache dir.
+func (o *Overlay) openLazy(u *url.URL) (afero.Fs, func(), error) {
+	if o.Type != "" && o.Type != ".zip" {
+		return nil, nil, fmt.Errorf("lazy mode requires a .zip archive, got %s", o.Type)
+	}
+	if o.verifies() {
+		// the archive is never read in full, so there is nothing to hash
+		return nil, nil, fmt.Errorf("integrity verification is not supported in lazy mode")
+	}
+	var (
+		size    int64
+		fetch   archive.RangeFetcher
+		closeFn = func() {}
+		err     error
+	)
+	switch u.Scheme {
+	case "http", "https":
+		size, fetch, err = o.httpRanges(u)
+	case "s3":
+		size, fetch, err = o.s3Ranges(u)
+	case "gs":
+		size, fetch, closeFn, err = o.gcsRanges(u)
+	case "az", "azblob":
+		size, fetch, err = o.azureRanges(u)
+	default:
+		return nil, nil, fmt.Errorf("lazy mode is not supported for scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, cleanup, err := archive.OpenRangeZipFs(fetch, size, o.cacheDir())
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+	return fs, func() {
+		cleanup()
+		closeFn()
+	}, nil
+}
@@ -0,0 +1,91 @@
+package vfs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func buildLazyZip(t *testing.T) []byte {
+	t.Helper()
+	big := make([]byte, 4*1024*1024)
+	_, err := rand.Read(big)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "big.bin", Method: zip.Store})
+	require.NoError(t, err)
+	_, err = w.Write(big)
+	require.NoError(t, err)
+	w, err = zw.Create("index.html")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("lazy"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestOverlayLazyZip(t *testing.T) {
+	data := buildLazyZip(t)
+
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		cw := &countingWriter{ResponseWriter: w, n: &served}
+		http.ServeContent(cw, r, "site.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/site.zip", CacheDir: t.TempDir(), Lazy: true}
+	fs, cleanup, err := o.OpenFilesystem()
+	require.NoError(t, err)
+	defer cleanup()
+
+	body, err := afero.ReadFile(fs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "lazy", string(body))
+
+	// only the central directory and the small entry are downloaded
+	require.Less(t, served.Load(), int64(len(data)/2))
+}
+
+func TestOverlayLazyRequiresRanges(t *testing.T) {
+	data := buildLazyZip(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ignore the Range header entirely
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/site.zip", CacheDir: t.TempDir(), Lazy: true}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "does not support range requests")
+}
+
+func TestOverlayLazyRejectsTarball(t *testing.T) {
+	o := &vfs.Overlay{Root: "https://example.com/site.tar.gz", Type: ".tar.gz", Lazy: true}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "lazy mode requires a .zip archive")
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
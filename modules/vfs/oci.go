@@ -0,0 +1,406 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gfx-labs/swim/pkg/archive"
+	"github.com/spf13/afero"
+)
+
+const (
+	// maximum size of a manifest, as recommended by the distribution spec
+	maxManifestSize = 4 * 1024 * 1024
+
+	// oras names every file or directory it pushes with this annotation
+	ociTitleAnnotation = "org.opencontainers.image.title"
+
+	// oras pushes single files with this media type whatever their contents
+	ociLayerTar = "application/vnd.oci.image.layer.v1.tar"
+)
+
+var ociManifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an image manifest or an image index
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociClient pulls from a single repository of an oci registry
+type ociClient struct {
+	o         *Overlay
+	base      string
+	repo      string
+	reference string // tag or digest
+
+	// bearer token from the registry's token service, if it asked for one
+	token string
+}
+
+// newOciClient parses an oci://registry/repository[:tag][@digest] url. the
+// tag defaults to latest, and a digest always wins over a tag.
+func (o *Overlay) newOciClient(u *url.URL) (*ociClient, error) {
+	repo := strings.Trim(u.Path, "/")
+	if u.Host == "" || repo == "" {
+		return nil, fmt.Errorf("oci: expected oci://registry/repository[:tag][@digest], got %s", u.Redacted())
+	}
+	reference := "latest"
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, reference = repo[:i], repo[i+1:]
+		if !strings.HasPrefix(reference, "sha256:") {
+			return nil, fmt.Errorf("oci: unsupported digest: %s", reference)
+		}
+		// a tag next to the digest is informational only
+		if j := strings.LastIndex(repo, ":"); j > strings.LastIndex(repo, "/") {
+			repo = repo[:j]
+		}
+	} else if j := strings.LastIndex(repo, ":"); j > strings.LastIndex(repo, "/") {
+		repo, reference = repo[:j], repo[j+1:]
+	}
+
+	scheme := "https"
+	switch strings.ToLower(o.headerOrEnv("OCI_PLAIN_HTTP")) {
+	case "true", "t", "yes":
+		scheme = "http"
+	}
+	return &ociClient{
+		o:         o,
+		base:      scheme + "://" + u.Host + "/v2/" + repo,
+		repo:      repo,
+		reference: reference,
+	}, nil
+}
+
+func (c *ociClient) pinned() bool {
+	return strings.HasPrefix(c.reference, "sha256:")
+}
+
+func (c *ociClient) send(method, url string, accept []string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.o.Headers {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	return c.o.doHttp(req)
+}
+
+// do sends a request, fetching a token and retrying once if the registry
+// answers with a bearer challenge
+func (c *ociClient) do(method, url string, accept ...string) (*http.Response, error) {
+	resp, err := c.send(method, url, accept)
+	if err != nil {
+		return nil, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || c.token != "" || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if c.token, err = c.fetchToken(challenge); err != nil {
+		return nil, err
+	}
+	return c.send(method, url, accept)
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken exchanges the configured credentials, if any, for a pull token
+func (c *ociClient) fetchToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("oci: bearer challenge without realm: %s", challenge)
+	}
+	tokenUrl, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("oci: invalid token realm: %w", err)
+	}
+	q := tokenUrl.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repo + ":pull"
+	}
+	q.Set("scope", scope)
+	tokenUrl.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenUrl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth := c.o.Headers.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := c.o.doHttp(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("oci: unable to get registry token: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("oci: decode registry token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// manifest fetches the manifest for reference, verifying it when reference is
+// a digest. an image index with a single manifest is followed.
+func (c *ociClient) manifest(reference string) (*ociManifest, error) {
+	resp, err := c.do(http.MethodGet, c.base+"/manifests/"+reference, ociManifestTypes...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("oci: unable to get manifest %s:%s: %s", c.repo, reference, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("oci: manifest %s:%s is larger than %d bytes", c.repo, reference, maxManifestSize)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		sum := sha256.Sum256(data)
+		if got := "sha256:" + hex.EncodeToString(sum[:]); got != reference {
+			return nil, fmt.Errorf("oci: manifest digest mismatch: expected %s, got %s", reference, got)
+		}
+	}
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("oci: decode manifest %s:%s: %w", c.repo, reference, err)
+	}
+	if len(m.Layers) == 0 && len(m.Manifests) > 0 {
+		if len(m.Manifests) > 1 {
+			return nil, fmt.Errorf("oci: %s:%s is an index of %d manifests, reference one by digest", c.repo, reference, len(m.Manifests))
+		}
+		return c.manifest(m.Manifests[0].Digest)
+	}
+	if len(m.Layers) == 0 {
+		return nil, fmt.Errorf("oci: manifest %s:%s has no layers", c.repo, reference)
+	}
+	return m, nil
+}
+
+// openOci pulls an artifact and serves its layers stacked in order, so later
+// layers win on conflicts. archive layers are unpacked, and layers that are
+// plain files named by oras are placed at their title.
+func (o *Overlay) openOci(u *url.URL) (afero.Fs, func(), error) {
+	if o.verifies() {
+		return nil, nil, fmt.Errorf("oci artifacts are verified by digest, pin the reference with @sha256: instead")
+	}
+	c, err := o.newOciClient(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := c.manifest(c.reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cleanups []func()
+	cleanup := func() {
+		for _, fn := range cleanups {
+			fn()
+		}
+	}
+	var (
+		fs       afero.Fs
+		filesDir string
+	)
+	for _, layer := range m.Layers {
+		layerFs, layerCleanup, err := o.openOciLayer(c, layer, &filesDir, &cleanups)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, layerCleanup)
+		if layerFs == nil {
+			// plain file, added to the files dir below
+			continue
+		}
+		if fs == nil {
+			fs = layerFs
+		} else {
+			fs = afero.NewCopyOnWriteFs(fs, layerFs)
+		}
+	}
+	if filesDir != "" {
+		files := afero.NewBasePathFs(afero.NewOsFs(), filesDir)
+		if fs == nil {
+			fs = files
+		} else {
+			fs = afero.NewCopyOnWriteFs(fs, files)
+		}
+	}
+	return fs, cleanup, nil
+}
+
+// openOciLayer downloads a single layer, verifying its digest. archives are
+// spooled and returned as a filesystem. plain files are written into
+// *filesDir, which is created on first use with its removal added to
+// *cleanups, and a nil filesystem is returned.
+func (o *Overlay) openOciLayer(c *ociClient, layer ociDescriptor, filesDir *string, cleanups *[]func()) (afero.Fs, func(), error) {
+	algo, want, ok := strings.Cut(layer.Digest, ":")
+	if !ok || algo != "sha256" {
+		return nil, nil, fmt.Errorf("oci: unsupported layer digest: %s", layer.Digest)
+	}
+	resp, err := c.do(http.MethodGet, c.base+"/blobs/"+layer.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("oci: unable to get layer %s: %s", layer.Digest, resp.Status)
+	}
+	digest := sha256.New()
+	body := io.TeeReader(resp.Body, digest)
+	title := layer.Annotations[ociTitleAnnotation]
+
+	ft := o.Type
+	rd := body
+	if ft == "" {
+		// oras labels single files as a plain layer tar whatever they hold,
+		// so only trust that media type for untitled layers
+		h := make(http.Header)
+		if title == "" || layer.MediaType != ociLayerTar {
+			h.Set("Content-Type", layer.MediaType)
+		}
+		ft, rd, err = archive.DetectFiletype(title, h, body)
+		if err != nil && (title == "" || !errors.Is(err, archive.ErrUnknownFiletype)) {
+			return nil, nil, fmt.Errorf("oci: layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	if ft == "" {
+		if err := o.writeOciFile(filesDir, cleanups, title, rd); err != nil {
+			return nil, nil, err
+		}
+		if err := verifyOciDigest(body, digest, want, layer.Digest); err != nil {
+			return nil, nil, err
+		}
+		return nil, func() {}, nil
+	}
+	fs, _, cleanup, err := archive.SpoolFs(ft, rd, o.cacheDir())
+	if err != nil {
+		// a corrupt layer usually fails to unpack first, report the digest
+		if verr := verifyOciDigest(body, digest, want, layer.Digest); verr != nil {
+			return nil, nil, verr
+		}
+		return nil, nil, fmt.Errorf("oci: layer %s: %w", layer.Digest, err)
+	}
+	if err := verifyOciDigest(body, digest, want, layer.Digest); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return fs, cleanup, nil
+}
+
+// writeOciFile writes a plain file layer to its title under the files dir
+func (o *Overlay) writeOciFile(filesDir *string, cleanups *[]func(), title string, r io.Reader) error {
+	if *filesDir == "" {
+		if err := os.MkdirAll(o.cacheDir(), 0o700); err != nil {
+			return fmt.Errorf("create spool dir: %w", err)
+		}
+		dir, err := os.MkdirTemp(o.cacheDir(), "files-*")
+		if err != nil {
+			return fmt.Errorf("create spool dir: %w", err)
+		}
+		*filesDir = dir
+		*cleanups = append(*cleanups, func() { os.RemoveAll(dir) })
+	}
+	name := filepath.Join(*filesDir, filepath.FromSlash(path.Clean("/"+title)))
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("oci: write %s: %w", title, err)
+	}
+	return f.Close()
+}
+
+// verifyOciDigest drains the rest of the layer and checks its digest
+func verifyOciDigest(body io.Reader, digest hash.Hash, want, name string) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(digest.Sum(nil)); got != want {
+		return fmt.Errorf("oci: layer digest mismatch: expected %s, got sha256:%s", name, got)
+	}
+	return nil
+}
+
+// versionOci returns the digest of the manifest the reference points at
+func (o *Overlay) versionOci(u *url.URL) (string, error) {
+	c, err := o.newOciClient(u)
+	if err != nil {
+		return "", err
+	}
+	if c.pinned() {
+		return c.reference, nil
+	}
+	resp, err := c.do(http.MethodHead, c.base+"/manifests/"+c.reference, ociManifestTypes...)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("oci: unable to stat manifest %s:%s: %s", c.repo, c.reference, resp.Status)
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
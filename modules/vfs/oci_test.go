@@ -0,0 +1,230 @@
+package vfs_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry serves a single repository and requires a bearer token from
+// its token endpoint, which in turn requires basic auth
+type fakeRegistry struct {
+	repo      string
+	manifests map[string][]byte // by tag and digest
+	blobs     map[string][]byte
+	url       string
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (f *fakeRegistry) addBlob(data []byte) string {
+	d := digestOf(data)
+	f.blobs[d] = data
+	return d
+}
+
+func (f *fakeRegistry) push(tag string, layers []map[string]any) string {
+	data, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.empty.v1+json", "digest": f.addBlob([]byte("{}")), "size": 2},
+		"layers":        layers,
+	})
+	d := digestOf(data)
+	f.manifests[tag] = data
+	f.manifests[d] = data
+	return d
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "ci" || pass != "hunter2" || r.URL.Query().Get("scope") != "repository:"+f.repo+":pull" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "pull-token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+f.url+`/token",service="fake",scope="repository:`+f.repo+`:pull"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"+f.repo+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	kind, ref, _ := strings.Cut(rest, "/")
+	switch kind {
+	case "manifests":
+		data, ok := f.manifests[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digestOf(data))
+		if r.Method != http.MethodHead {
+			w.Write(data)
+		}
+	case "blobs":
+		data, ok := f.blobs[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, string) {
+	f := &fakeRegistry{repo: "org/site", manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	return f, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func ociOverlay(root string) *vfs.Overlay {
+	h := http.Header{}
+	h.Set("OCI_PLAIN_HTTP", "true")
+	// ci:hunter2
+	h.Set("Authorization", "Basic Y2k6aHVudGVyMg==")
+	return &vfs.Overlay{Root: root, Headers: h}
+}
+
+func TestOverlayOci(t *testing.T) {
+	f, host := newFakeRegistry(t)
+
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "from layer", "robots.txt": "overridden"})
+	tarball, err := os.ReadFile(path)
+	require.NoError(t, err)
+	robots := []byte("User-agent: *")
+
+	digest := f.push("v1", []map[string]any{
+		{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"digest":    f.addBlob(tarball),
+			"size":      len(tarball),
+		},
+		{
+			// how oras pushes a single plain file
+			"mediaType":   "application/vnd.oci.image.layer.v1.tar",
+			"digest":      f.addBlob(robots),
+			"size":        len(robots),
+			"annotations": map[string]string{"org.opencontainers.image.title": "robots.txt"},
+		},
+	})
+
+	for _, root := range []string{
+		"oci://" + host + "/org/site:v1",
+		"oci://" + host + "/org/site@" + digest,
+		"oci://" + host + "/org/site:v1@" + digest,
+	} {
+		t.Run(root, func(t *testing.T) {
+			o := ociOverlay(root)
+			o.CacheDir = t.TempDir()
+			fs, cleanup, err := o.OpenFilesystem()
+			require.NoError(t, err)
+
+			body, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "from layer", string(body))
+			body, err = afero.ReadFile(fs, "robots.txt")
+			require.NoError(t, err)
+			require.Equal(t, string(robots), string(body))
+
+			version, err := o.Version()
+			require.NoError(t, err)
+			require.Equal(t, digest, version)
+
+			cleanup()
+			entries, err := os.ReadDir(o.CacheDir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
+
+func TestOverlayOciDigestMismatch(t *testing.T) {
+	f, host := newFakeRegistry(t)
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "hello"})
+	tarball, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	layerDigest := f.addBlob(tarball)
+	digest := f.push("v1", []map[string]any{
+		{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layerDigest, "size": len(tarball)},
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		f.manifests[digest] = f.manifests["v1"][:len(f.manifests["v1"])-1]
+		defer func() { f.manifests[digest] = f.manifests["v1"] }()
+
+		o := ociOverlay("oci://" + host + "/org/site@" + digest)
+		o.CacheDir = t.TempDir()
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "manifest digest mismatch")
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		f.blobs[layerDigest] = append(append([]byte{}, tarball...), 0)
+		defer func() { f.blobs[layerDigest] = tarball }()
+
+		o := ociOverlay("oci://" + host + "/org/site:v1")
+		o.CacheDir = t.TempDir()
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "layer digest mismatch")
+	})
+
+	t.Run("after a file layer", func(t *testing.T) {
+		f.blobs[layerDigest] = append(append([]byte{}, tarball...), 0)
+		defer func() { f.blobs[layerDigest] = tarball }()
+		robots := []byte("User-agent: *")
+		f.push("v2", []map[string]any{
+			{
+				"mediaType":   "application/vnd.oci.image.layer.v1.tar",
+				"digest":      f.addBlob(robots),
+				"size":        len(robots),
+				"annotations": map[string]string{"org.opencontainers.image.title": "robots.txt"},
+			},
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layerDigest, "size": len(tarball)},
+		})
+
+		o := ociOverlay("oci://" + host + "/org/site:v2")
+		o.CacheDir = t.TempDir()
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "layer digest mismatch")
+		entries, err := os.ReadDir(o.CacheDir)
+		require.NoError(t, err)
+		require.Empty(t, entries, "the files dir is removed")
+	})
+}
+
+func TestOverlayOciAuth(t *testing.T) {
+	f, host := newFakeRegistry(t)
+	f.push("v1", []map[string]any{})
+
+	o := &vfs.Overlay{Root: "oci://" + host + "/org/site:v1", Headers: http.Header{"Oci_plain_http": {"true"}}}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "unable to get registry token: 401")
+}
@@ -2,12 +2,17 @@ package vfs
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/gfx-labs/swim/pkg/archive"
 	"github.com/spf13/afero"
+	"go.uber.org/zap"
 )
 
 func (o *Overlay) resolvePlaceholders() {
@@ -19,96 +24,407 @@ func (o *Overlay) resolvePlaceholders() {
 	}
 	o.WorkDir = rp.ReplaceAll(o.WorkDir, "")
 	o.Type = rp.ReplaceAll(o.Type, "")
-	o.Root = rp.ReplaceAll(o.Root, "")
+	// request placeholders are left for the vfs_tenants handler to fill in
+	o.Root = rp.ReplaceKnown(o.Root, "")
+	o.CacheDir = rp.ReplaceAll(o.CacheDir, "")
+	o.SharedCache = rp.ReplaceAll(o.SharedCache, "")
+	o.LastKnownGood = rp.ReplaceAll(o.LastKnownGood, "")
+	o.Sha256 = rp.ReplaceAll(o.Sha256, "")
+	o.PublicKey = rp.ReplaceAll(o.PublicKey, "")
+	o.Signature = rp.ReplaceAll(o.Signature, "")
+	o.S3Credentials = rp.ReplaceAll(o.S3Credentials, "")
+	o.CaBundle = rp.ReplaceAll(o.CaBundle, "")
+	o.ClientCert = rp.ReplaceAll(o.ClientCert, "")
+	o.ClientKey = rp.ReplaceAll(o.ClientKey, "")
+	o.Proxy = rp.ReplaceAll(o.Proxy, "")
 }
-func (o *Overlay) OpenFilesystem() (afero.Fs, error) {
-	fs, err := o.openRawFilesystem()
+
+// OpenFilesystem opens the source as a read-only afero.Fs. remote archives
+// are spooled into the cache dir and served from disk. the returned cleanup
+// function releases the archive and must be called once the fs is unused.
+func (o *Overlay) OpenFilesystem() (afero.Fs, func(), error) {
+	fs, cleanup, err := o.openRawFilesystem()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if cleanup == nil {
+		cleanup = func() {}
 	}
+	return o.chroot(fs), cleanup, nil
+}
+
+// chroot makes fs read-only and rooted at the working dir
+func (o *Overlay) chroot(fs afero.Fs) afero.Fs {
 	wd := o.WorkDir
 	if wd == "" {
 		wd = "/"
 	}
-	ofs := afero.NewBasePathFs(fs, wd)
-	ofs = afero.NewReadOnlyFs(afero.NewCacheOnReadFs(
-		ofs,
-		afero.NewMemMapFs(),
-		0,
-	))
-	return ofs, nil
+	return afero.NewReadOnlyFs(afero.NewBasePathFs(fs, wd))
+}
+
+// cacheDir returns the directory that remote archives are spooled into
+func (o *Overlay) cacheDir() string {
+	if o.CacheDir != "" {
+		return o.CacheDir
+	}
+	return filepath.Join(os.TempDir(), "swim-vfs")
 }
 
 // opens the filesystem before changing the working dir
-func (o *Overlay) openRawFilesystem() (afero.Fs, error) {
+func (o *Overlay) openRawFilesystem() (afero.Fs, func(), error) {
 	u, err := url.Parse(o.Root)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if o.isPrefix(u) {
+		if o.verifies() {
+			return nil, nil, fmt.Errorf("%s is a prefix, integrity verification requires an archive", u.Redacted())
+		}
+		switch u.Scheme {
+		case "s3":
+			return o.openS3Prefix(u)
+		case "gs":
+			return o.openGcsPrefix(u)
+		case "az", "azblob":
+			return o.openAzurePrefix(u)
+		case "sftp":
+			return o.openSftpPrefix(u)
+		case "webdav", "webdavs":
+			return o.openWebdavPrefix(u)
+		}
+	}
+	if o.Lazy && u.Scheme != "file" && u.Scheme != "" {
+		return o.openLazy(u)
 	}
 	switch u.Scheme {
 	case "file", "":
 		return o.openFile(u)
 	case "http", "https":
-		return o.openHttp(u)
+		return o.openCached(u, o.openHttp)
+	case "s3":
+		return o.openCached(u, o.openS3)
+	case "gs":
+		return o.openCached(u, o.openGcs)
+	case "az", "azblob":
+		return o.openCached(u, o.openAzure)
+	case "sftp":
+		return o.openCached(u, o.openSftp)
+	case "webdav", "webdavs":
+		return o.openCached(u, o.openWebdav)
+	case "oci":
+		return o.openOci(u)
+	case "git+https", "git+http", "git+file":
+		return o.openGit(u)
+	default:
+		return nil, nil, fmt.Errorf("unrecognized scheme: %s", u.Scheme)
+	}
+}
+
+// isPrefix reports whether u points at a bucket prefix or a remote directory
+// rather than an archive. prefixes are served live, file by file.
+func (o *Overlay) isPrefix(u *url.URL) bool {
+	switch u.Scheme {
+	case "s3", "gs", "az", "azblob", "sftp", "webdav", "webdavs":
+		return strings.HasSuffix(u.Path, "/")
+	}
+	return false
+}
+
+// filetype picks the archive type of r. an explicit type always wins,
+// otherwise it is detected from the url path, the response headers (if any)
+// and finally the magic bytes of the stream. the returned reader replaces r.
+func (o *Overlay) filetype(u *url.URL, h http.Header, r io.Reader) (string, io.Reader, error) {
+	if o.Type != "" {
+		return o.Type, r, nil
+	}
+	ft, rd, err := archive.DetectFiletype(u.Path, h, r)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	return ft, rd, nil
+}
+
+// Version returns an opaque identifier for the current revision of the
+// source. it changes whenever the underlying archive changes. an empty string
+// means the source does not support change detection.
+func (o *Overlay) Version() (string, error) {
+	u, err := url.Parse(o.Root)
+	if err != nil {
+		return "", err
+	}
+	if o.isPrefix(u) {
+		// served live, never needs a reload
+		return "", nil
+	}
+	switch u.Scheme {
+	case "file", "":
+		return o.versionFile(u)
+	case "http", "https":
+		return o.versionHttp(u)
 	case "s3":
-		return o.openS3(u)
+		return o.versionS3(u)
 	case "gs":
-		return o.openGcs(u)
+		return o.versionGcs(u)
+	case "az", "azblob":
+		return o.versionAzure(u)
+	case "sftp":
+		return o.versionSftp(u)
+	case "webdav", "webdavs":
+		return o.versionWebdav(u)
+	case "oci":
+		return o.versionOci(u)
+	case "git+https", "git+http", "git+file":
+		return o.versionGit(u)
 	default:
-		return nil, fmt.Errorf("unrecognized scheme: %s", u.Scheme)
+		return "", fmt.Errorf("unrecognized scheme: %s", u.Scheme)
 	}
 }
 
-func (o *Overlay) openFile(u *url.URL) (afero.Fs, error) {
+func (o *Overlay) openFile(u *url.URL) (afero.Fs, func(), error) {
 	// see if its a directory
 	info, err := os.Stat(u.Path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if info.IsDir() {
-		return afero.NewBasePathFs(afero.NewOsFs(), u.Path), nil
+		if o.verifies() {
+			return nil, nil, fmt.Errorf("%s is a directory, integrity verification requires an archive", u.Path)
+		}
+		return afero.NewBasePathFs(afero.NewOsFs(), u.Path), nil, nil
 	}
-	ft := o.Type
-	if ft == "" {
-		ft = archive.FiletypeFromName(u.String())
+	v, err := o.newVerifier(u)
+	if err != nil {
+		return nil, nil, err
 	}
+	return o.openArchiveFile(u, v)
+}
+
+// openArchiveFile opens a local archive after checking it with v, if set.
+// the archive is checked and served from the same handle, so a file replaced
+// in between is never served unchecked.
+func (o *Overlay) openArchiveFile(u *url.URL, v *verifier) (afero.Fs, func(), error) {
 	file, err := os.Open(u.Path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	fs, err := archive.FilesystemFromReader(ft, file)
+	keep := false
+	defer func() {
+		if !keep {
+			file.Close()
+		}
+	}()
+	if err := v.verifyReader(file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", u.Path, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	ft, rd, err := o.filetype(u, nil, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	// uncompressed archives are served in place, anything else is spooled
+	switch ft {
+	case ".zip":
+		fs, _, cleanup, err := archive.OpenZipFile(file)
+		keep = err == nil
+		return fs, cleanup, err
+	case ".tar":
+		fs, _, cleanup, err := archive.OpenTarFile(file)
+		keep = err == nil
+		return fs, cleanup, err
+	}
+	fs, _, cleanup, err := archive.SpoolFs(ft, rd, o.cacheDir())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return fs, nil
+	return fs, cleanup, nil
 }
 
-func (o *Overlay) openHttp(u *url.URL) (afero.Fs, error) {
+func (o *Overlay) openHttp(u *url.URL) (afero.Fs, func(), error) {
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for k, v := range o.Headers {
 		for _, vv := range v {
 			req.Header.Add(k, vv)
 		}
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := o.doHttp(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unable to get network resource: %s", resp.Status)
+		return nil, nil, fmt.Errorf("unable to get network resource: %s", resp.Status)
 	}
-	ft := o.Type
-	// TODO: perhaps we can also introspect via http content type?
-	if ft == "" {
-		ft = archive.FiletypeFromName(u.String())
+	return o.spool(u, resp.Header, resp.Body)
+}
+
+// spool detects the type of a remote archive and spools it into the cache
+// dir, or the shared cache if there is one. the raw archive is verified
+// against the integrity options while it is spooled, and when a last known
+// good dir is configured it is copied there as well once it has been spooled
+// and verified.
+func (o *Overlay) spool(u *url.URL, h http.Header, r io.Reader) (afero.Fs, func(), error) {
+	ft, rd, err := o.filetype(u, h, r)
+	if err != nil {
+		return nil, nil, err
 	}
-	fs, err := archive.FilesystemFromReader(ft, resp.Body)
+	v, err := o.newVerifier(u)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var lkg *lastKnownGoodWriter
+	var copies []io.Writer
+	if v != nil {
+		copies = append(copies, v)
+	}
+	if o.LastKnownGood != "" {
+		lkg, err = newLastKnownGoodWriter(o.lastKnownGoodPath())
+		if err != nil {
+			return nil, nil, err
+		}
+		if v != nil {
+			lkg.sig = v.sigData
+		}
+		defer lkg.abort()
+		copies = append(copies, lkg)
+	}
+	if len(copies) == 0 {
+		fs, cleanup, commit, err := o.spoolFs(ft, rd, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		commit()
+		return fs, cleanup, nil
+	}
+
+	tee := io.TeeReader(rd, io.MultiWriter(copies...))
+	fs, cleanup, commit, err := o.spoolFs(ft, tee, h)
+	if err != nil {
+		// a tampered or truncated archive usually fails to unpack first,
+		// report that rather than the decompression error
+		if v != nil {
+			if _, cerr := io.Copy(io.Discard, tee); cerr == nil {
+				if verr := v.verify(); verr != nil {
+					return nil, nil, fmt.Errorf("%s: %w", u.Redacted(), verr)
+				}
+			}
+		}
+		return nil, nil, err
+	}
+	// decompressors may stop short of the end of the stream
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if v != nil {
+		if err := v.verify(); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+		}
+	}
+	commit()
+	if lkg != nil {
+		// the copy is best effort, failing to save it must not fail the load
+		if err := lkg.commit(); err != nil {
+			o.logger().Warn("unable to save last known good archive", zap.String("root", o.redactedRoot()), zap.Error(err))
+		}
+	}
+	return fs, cleanup, nil
+}
+
+// httpRanges returns the size of the resource and a fetcher for byte ranges
+// of it. ranges are conditional on the ETag, so a resource replaced while it
+// is being served fails loudly instead of mixing old and new bytes.
+func (o *Overlay) httpRanges(u *url.URL) (int64, archive.RangeFetcher, error) {
+	newRequest := func(method string) (*http.Request, error) {
+		req, err := http.NewRequest(method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range o.Headers {
+			for _, vv := range v {
+				req.Header.Add(k, vv)
+			}
+		}
+		return req, nil
+	}
+	req, err := newRequest(http.MethodHead)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := o.doHttp(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, nil, fmt.Errorf("unable to stat network resource: %s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, nil, fmt.Errorf("network resource has no content length")
+	}
+	etag := resp.Header.Get("ETag")
+
+	fetch := func(off, length int64) (io.ReadCloser, error) {
+		req, err := newRequest(http.MethodGet)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		resp, err := o.doHttp(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil, fmt.Errorf("server does not support range requests")
+			}
+			return nil, fmt.Errorf("unable to get network resource range: %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return resp.ContentLength, fetch, nil
+}
+
+// versionFile returns the mtime and size of the archive. directories are
+// served live from disk, so they never need a reload.
+func (o *Overlay) versionFile(u *url.URL) (string, error) {
+	info, err := os.Stat(u.Path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil
+	}
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(info.Size(), 10), nil
+}
+
+// versionHttp returns the ETag of the resource, falling back to Last-Modified
+func (o *Overlay) versionHttp(u *url.URL) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range o.Headers {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	resp, err := o.doHttp(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unable to stat network resource: %s", resp.Status)
 	}
-	return fs, nil
+	return headerVersion(resp.Header), nil
 }
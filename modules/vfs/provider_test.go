@@ -0,0 +1,78 @@
+package vfs_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayDetectsHttpArchiveType(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, src, map[string]string{"index.html": "hello"})
+	data, err := os.ReadFile(src)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+	}{
+		{
+			name: "extension in path with query string",
+			path: "/site.tar.gz?X-Amz-Signature=abc",
+		},
+		{
+			name:    "content disposition",
+			path:    "/download/123",
+			headers: map[string]string{"Content-Disposition": `attachment; filename="site.tgz"`},
+		},
+		{
+			name:    "content type",
+			path:    "/releases/latest",
+			headers: map[string]string{"Content-Type": "application/gzip"},
+		},
+		{
+			name:    "magic bytes",
+			path:    "/releases/latest",
+			headers: map[string]string{"Content-Type": "application/octet-stream"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+				w.Write(data)
+			}))
+			defer srv.Close()
+
+			o := &vfs.Overlay{Root: srv.URL + tt.path, CacheDir: t.TempDir()}
+			fs, cleanup, err := o.OpenFilesystem()
+			require.NoError(t, err)
+			defer cleanup()
+
+			body, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(body))
+		})
+	}
+}
+
+func TestOverlayRejectsUnknownArchiveType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>login page</html>"))
+	}))
+	defer srv.Close()
+
+	o := &vfs.Overlay{Root: srv.URL + "/releases/latest", CacheDir: t.TempDir()}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "unable to detect archive type")
+}
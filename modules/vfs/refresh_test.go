@@ -0,0 +1,171 @@
+package vfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTar atomically replaces path with a tar archive containing the given
+// files, gzipped if path ends in .gz
+func writeTar(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for name, body := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0o644,
+			Size: int64(len(body)),
+		}))
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	require.NoError(t, os.WriteFile(path+".tmp", buf.Bytes(), 0o644))
+	require.NoError(t, os.Rename(path+".tmp", path))
+}
+
+func TestVfsRefreshSwapsArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar")
+	writeTar(t, path, map[string]string{"index.html": "v1"})
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	v := &vfs.Vfs{Overlay: &vfs.Overlay{
+		Root:            path,
+		RefreshInterval: caddy.Duration(10 * time.Millisecond),
+	}}
+	require.NoError(t, v.Provision(ctx))
+	defer v.Cleanup()
+
+	data, err := fs.ReadFile(v, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(data))
+
+	// hold a file open across the swap
+	f, err := v.Open("index.html")
+	require.NoError(t, err)
+	defer f.Close()
+
+	writeTar(t, path, map[string]string{"index.html": "v2"})
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	require.Eventually(t, func() bool {
+		data, err := fs.ReadFile(v, "index.html")
+		return err == nil && string(data) == "v2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	buf := make([]byte, 2)
+	_, err = f.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(buf))
+}
+
+func TestVfsRefreshReleasesOldArchive(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	path := filepath.Join(dir, "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "v1"})
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	v := &vfs.Vfs{Overlay: &vfs.Overlay{
+		Root:            path,
+		CacheDir:        cacheDir,
+		RefreshInterval: caddy.Duration(10 * time.Millisecond),
+	}}
+	require.NoError(t, v.Provision(ctx))
+
+	spooled := func() int {
+		entries, err := os.ReadDir(cacheDir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+	require.Equal(t, 1, spooled())
+
+	f, err := v.Open("index.html")
+	require.NoError(t, err)
+
+	writeTar(t, path, map[string]string{"index.html": "v2"})
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	require.Eventually(t, func() bool {
+		data, err := fs.ReadFile(v, "index.html")
+		return err == nil && string(data) == "v2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the old archive stays on disk while a file from it is open
+	require.Equal(t, 2, spooled())
+	require.NoError(t, f.Close())
+	require.Equal(t, 1, spooled())
+
+	require.NoError(t, v.Cleanup())
+	require.Equal(t, 0, spooled())
+}
+
+func TestOverlayVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "etag",
+			headers: map[string]string{"ETag": `"abc"`, "Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"},
+			want:    `"abc"`,
+		},
+		{
+			name:    "last modified",
+			headers: map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"},
+			want:    "Mon, 02 Jan 2006 15:04:05 GMT",
+		},
+		{
+			name: "no validators",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodHead, r.Method)
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+			}))
+			defer srv.Close()
+
+			o := &vfs.Overlay{Root: srv.URL + "/archive.tar.gz"}
+			got, err := o.Version()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+)
+
+// revision is one opened copy of the source archive. it is reference counted
+// so that a revision which has been swapped out by a refresh keeps its
+// backing files until the last request reading from it closes its file.
+type revision struct {
+	fs      fs.FS
+	version string
+	cleanup func()
+
+	// stale revisions are a last known good copy served while the source
+	// is unreachable
+	stale bool
+
+	// open files, plus one for as long as the revision is current
+	refs atomic.Int64
+}
+
+func newRevision(a afero.Fs, version string, cleanup func()) *revision {
+	r := &revision{
+		fs:      afero.NewIOFS(a),
+		version: version,
+		cleanup: cleanup,
+	}
+	r.refs.Store(1)
+	return r
+}
+
+// acquire takes a reference, failing if the revision was already released
+func (r *revision) acquire() bool {
+	for {
+		n := r.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (r *revision) release() {
+	if r.refs.Add(-1) == 0 && r.cleanup != nil {
+		r.cleanup()
+	}
+}
+
+// revisionFile holds a reference on its revision until it is closed
+type revisionFile struct {
+	fs.File
+	rev  *revision
+	once sync.Once
+}
+
+func (f *revisionFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.rev.release)
+	return err
+}
+
+func (f *revisionFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *revisionFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (f *revisionFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, errors.ErrUnsupported
+}
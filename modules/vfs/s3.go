@@ -2,14 +2,24 @@ package vfs
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/gfx-labs/swim/pkg/archive"
 	"github.com/spf13/afero"
 )
@@ -22,10 +32,9 @@ func (o *Overlay) headerOrEnv(key string) string {
 	return x
 }
 
-func (o *Overlay) openS3(u *url.URL) (afero.Fs, error) {
-	ctx := context.Background()
-	accessKeyId := o.headerOrEnv("AWS_ACCESS_KEY_ID")
-	secretAccessKey := o.headerOrEnv("AWS_SECRET_ACCESS_KEY")
+// s3Client builds an s3 client from the overlay settings and resolves the
+// bucket and key that the url points at
+func (o *Overlay) s3Client(ctx context.Context, u *url.URL) (client *s3.Client, bucket string, key string, err error) {
 	usePathStyle := o.headerOrEnv("AWS_USE_PATH_STYLE")
 	bucketName := o.headerOrEnv("AWS_BUCKET_NAME")
 	endpointUrl := o.headerOrEnv("AWS_ENDPOINT_URL")
@@ -37,25 +46,13 @@ func (o *Overlay) openS3(u *url.URL) (afero.Fs, error) {
 		region = "us-east-1"
 	}
 
-	// Create config with appropriate credentials
-	var cfg aws.Config
-	var err error
-	
-	// If no credentials provided or they are explicitly empty, use anonymous access
-	if (accessKeyId == "" && secretAccessKey == "") {
-		cfg, err = config.LoadDefaultConfig(ctx,
-			config.WithRegion(region),
-			config.WithCredentialsProvider(aws.AnonymousCredentials{}),
-		)
-	} else {
-		// Use provided credentials
-		cfg, err = config.LoadDefaultConfig(ctx,
-			config.WithRegion(region),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyId, secretAccessKey, "")),
-		)
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, "", "", err
 	}
+	cfg.Credentials, err = o.s3Credentials(cfg)
 	if err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
 
 	// Create S3 client with options including custom endpoint resolver
@@ -64,7 +61,7 @@ func (o *Overlay) openS3(u *url.URL) (afero.Fs, error) {
 			o.BaseEndpoint = aws.String(endpointUrl)
 		},
 	}
-	
+
 	switch strings.ToLower(usePathStyle) {
 	case "true", "t", "yes":
 		opts = append(opts, func(o *s3.Options) {
@@ -76,12 +73,11 @@ func (o *Overlay) openS3(u *url.URL) (afero.Fs, error) {
 		})
 	}
 
-	s3Client := s3.NewFromConfig(cfg, opts...)
-	
+	client = s3.NewFromConfig(cfg, opts...)
+
 	// Parse bucket and key
-	var bucket, key string
 	path := strings.TrimPrefix(u.Path, "/")
-	
+
 	// If bucket name is explicitly provided, use it
 	if bucketName != "" {
 		bucket = bucketName
@@ -96,23 +92,294 @@ func (o *Overlay) openS3(u *url.URL) (afero.Fs, error) {
 			}
 		}
 	}
-	
+	return client, bucket, key, nil
+}
+
+// s3 credential modes
+const (
+	s3CredentialsAnonymous   = "anonymous"
+	s3CredentialsStatic      = "static"
+	s3CredentialsDefault     = "default"
+	s3CredentialsAssumeRole  = "assume_role"
+	s3CredentialsWebIdentity = "web_identity"
+)
+
+// s3Credentials returns the credentials provider for the configured mode. the
+// provider is built once per overlay, so assumed role credentials are cached
+// and refreshed across requests instead of being fetched for every one.
+func (o *Overlay) s3Credentials(cfg aws.Config) (aws.CredentialsProvider, error) {
+	o.s3CredsMu.Lock()
+	defer o.s3CredsMu.Unlock()
+	if o.s3Creds != nil {
+		return o.s3Creds, nil
+	}
+	creds, err := o.newS3Credentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	o.s3Creds = creds
+	return creds, nil
+}
+
+func (o *Overlay) newS3Credentials(cfg aws.Config) (aws.CredentialsProvider, error) {
+	accessKeyId := o.headerOrEnv("AWS_ACCESS_KEY_ID")
+	secretAccessKey := o.headerOrEnv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := o.headerOrEnv("AWS_SESSION_TOKEN")
+	var static aws.CredentialsProvider
+	if accessKeyId != "" || secretAccessKey != "" {
+		static = credentials.NewStaticCredentialsProvider(accessKeyId, secretAccessKey, sessionToken)
+	}
+
+	mode := o.S3Credentials
+	if mode == "" {
+		// static keys if there are any, otherwise anonymous access
+		mode = s3CredentialsAnonymous
+		if static != nil {
+			mode = s3CredentialsStatic
+		}
+	}
+	switch mode {
+	case s3CredentialsAnonymous:
+		return aws.AnonymousCredentials{}, nil
+	case s3CredentialsStatic:
+		if accessKeyId == "" || secretAccessKey == "" {
+			return nil, fmt.Errorf("s3: static credentials require AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return static, nil
+	case s3CredentialsDefault:
+		// env, shared config and profiles, sso, web identity, ecs and imds
+		return cfg.Credentials, nil
+	case s3CredentialsAssumeRole:
+		roleArn := o.headerOrEnv("AWS_ROLE_ARN")
+		if roleArn == "" {
+			return nil, fmt.Errorf("s3: assume_role credentials require AWS_ROLE_ARN")
+		}
+		// the role is assumed with the static keys if set, otherwise the
+		// default chain
+		base := cfg.Credentials
+		if static != nil {
+			base = static
+		}
+		externalId := o.headerOrEnv("AWS_EXTERNAL_ID")
+		provider := stscreds.NewAssumeRoleProvider(o.stsClient(cfg, base), roleArn, func(ao *stscreds.AssumeRoleOptions) {
+			ao.RoleSessionName = o.roleSessionName()
+			if externalId != "" {
+				ao.ExternalID = aws.String(externalId)
+			}
+		})
+		return aws.NewCredentialsCache(provider), nil
+	case s3CredentialsWebIdentity:
+		roleArn := o.headerOrEnv("AWS_ROLE_ARN")
+		tokenFile := o.headerOrEnv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if roleArn == "" || tokenFile == "" {
+			return nil, fmt.Errorf("s3: web_identity credentials require AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		// AssumeRoleWithWebIdentity is an unsigned call
+		provider := stscreds.NewWebIdentityRoleProvider(o.stsClient(cfg, aws.AnonymousCredentials{}), roleArn, stscreds.IdentityTokenFile(tokenFile), func(wo *stscreds.WebIdentityRoleOptions) {
+			wo.RoleSessionName = o.roleSessionName()
+		})
+		return aws.NewCredentialsCache(provider), nil
+	default:
+		return nil, fmt.Errorf("s3: unknown credentials mode: %s", mode)
+	}
+}
+
+// stsClient returns an sts client signing with creds. AWS_ENDPOINT_URL_STS
+// points it at a non aws sts, such as minio's.
+func (o *Overlay) stsClient(cfg aws.Config, creds aws.CredentialsProvider) *sts.Client {
+	return sts.NewFromConfig(cfg, func(so *sts.Options) {
+		so.Credentials = creds
+		if endpoint := o.headerOrEnv("AWS_ENDPOINT_URL_STS"); endpoint != "" {
+			so.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
+
+func (o *Overlay) roleSessionName() string {
+	if name := o.headerOrEnv("AWS_ROLE_SESSION_NAME"); name != "" {
+		return name
+	}
+	return "swim"
+}
+
+func (o *Overlay) openS3(u *url.URL) (afero.Fs, func(), error) {
+	ctx := context.Background()
+	s3Client, bucket, key, err := o.s3Client(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	oo, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer oo.Body.Close()
-	ft := o.Type
-	// TODO: perhaps we can also introspect via http content type?
-	if ft == "" {
-		ft = archive.FiletypeFromName(u.String())
+	h := make(http.Header)
+	h.Set("Content-Type", aws.ToString(oo.ContentType))
+	h.Set("Content-Disposition", aws.ToString(oo.ContentDisposition))
+	h.Set("ETag", aws.ToString(oo.ETag))
+	return o.spool(u, h, oo.Body)
+}
+
+// versionS3 returns the ETag of the archive object
+func (o *Overlay) versionS3(u *url.URL) (string, error) {
+	ctx := context.Background()
+	s3Client, bucket, key, err := o.s3Client(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(head.ETag), nil
+}
+
+// s3Ranges returns the size of the archive object and a fetcher for byte
+// ranges of it, pinned to the ETag seen when it was opened
+func (o *Overlay) s3Ranges(u *url.URL) (int64, archive.RangeFetcher, error) {
+	ctx := context.Background()
+	s3Client, bucket, key, err := o.s3Client(ctx, u)
+	if err != nil {
+		return 0, nil, err
 	}
-	fs, err := archive.FilesystemFromReader(ft, oo.Body)
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
+		return 0, nil, err
+	}
+	fetch := func(off, length int64) (io.ReadCloser, error) {
+		oo, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", off, off+length-1)),
+			IfMatch: head.ETag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return oo.Body, nil
+	}
+	return aws.ToInt64(head.ContentLength), fetch, nil
+}
+
+// s3Store serves the objects under a prefix of an s3 bucket
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// openS3Prefix serves a bucket prefix as a live filesystem
+func (o *Overlay) openS3Prefix(u *url.URL) (afero.Fs, func(), error) {
+	client, bucket, key, err := o.s3Client(context.Background(), u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bucket == "" {
+		return nil, nil, fmt.Errorf("s3: bucket name is required")
+	}
+	store := &s3Store{client: client, bucket: bucket, prefix: key}
+	return newBucketFs(store, time.Duration(o.MetadataTTL)), nil, nil
+}
+
+func isS3NotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
+
+func (s *s3Store) head(ctx context.Context, key string) (*objectInfo, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return &objectInfo{
+		name:    path.Base(key),
+		size:    aws.ToInt64(head.ContentLength),
+		modTime: aws.ToTime(head.LastModified),
+	}, nil
+}
+
+func (s *s3Store) hasPrefix(ctx context.Context, dir string) (bool, error) {
+	out, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.prefix + dir),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(out.Contents) > 0, nil
+}
+
+func (s *s3Store) list(ctx context.Context, dir string) ([]*objectInfo, error) {
+	var entries []*objectInfo
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix + dir),
+		Delimiter: aws.String("/"),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cp := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(cp.Prefix), s.prefix+dir), "/")
+			entries = append(entries, &objectInfo{name: name, dir: true})
+		}
+		for _, obj := range out.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix+dir)
+			if name == "" {
+				// directory marker object
+				continue
+			}
+			entries = append(entries, &objectInfo{
+				name:    name,
+				size:    aws.ToInt64(obj.Size),
+				modTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	slices.SortFunc(entries, func(a, b *objectInfo) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+func (s *s3Store) read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", off)
+	if length >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", off, off+length-1)
+	}
+	oo, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Range:  aws.String(rng),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, os.ErrNotExist
+		}
 		return nil, err
 	}
-	return fs, nil
-}
\ No newline at end of file
+	return oo.Body, nil
+}
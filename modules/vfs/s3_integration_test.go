@@ -2,6 +2,7 @@ package vfs_test
 
 import (
 	"net/http"
+	"os"
 	"testing"
 
 	"github.com/gfx-labs/swim/modules/vfs"
@@ -67,7 +68,7 @@ func TestS3Integration(t *testing.T) {
 			}
 
 			// Attempt to open the S3 URL
-			fs, err := overlay.OpenFilesystem()
+			fs, cleanup, err := overlay.OpenFilesystem()
 			
 			if tt.wantErr {
 				require.Error(t, err, "Expected error but got none")
@@ -76,6 +77,7 @@ func TestS3Integration(t *testing.T) {
 			
 			require.NoError(t, err, "Failed to open S3 URL")
 			require.NotNil(t, fs, "Filesystem should not be nil")
+			defer cleanup()
 			
 			// Try to stat the root to verify the filesystem works
 			_, err = fs.Stat("/")
@@ -84,3 +86,38 @@ func TestS3Integration(t *testing.T) {
 	}
 }
 
+
+// TestS3MinioIntegration runs against a local minio, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	SWIM_MINIO_ENDPOINT=http://localhost:9000 SWIM_MINIO_ROOT=s3://localhost/bucket/site.tar.gz \
+//	SWIM_MINIO_USER=minioadmin SWIM_MINIO_PASSWORD=minioadmin go test -run Minio ./modules/vfs
+func TestS3MinioIntegration(t *testing.T) {
+	endpoint := os.Getenv("SWIM_MINIO_ENDPOINT")
+	if testing.Short() || endpoint == "" {
+		t.Skip("Skipping minio integration test, SWIM_MINIO_ENDPOINT is not set")
+	}
+
+	for _, mode := range []string{"static", "assume_role"} {
+		t.Run(mode, func(t *testing.T) {
+			overlay := &vfs.Overlay{
+				Root:          os.Getenv("SWIM_MINIO_ROOT"),
+				Headers:       http.Header{},
+				S3Credentials: mode,
+			}
+			overlay.Headers.Set("AWS_ENDPOINT_URL", endpoint)
+			overlay.Headers.Set("AWS_ENDPOINT_URL_STS", endpoint)
+			overlay.Headers.Set("AWS_USE_PATH_STYLE", "true")
+			overlay.Headers.Set("AWS_ACCESS_KEY_ID", os.Getenv("SWIM_MINIO_USER"))
+			overlay.Headers.Set("AWS_SECRET_ACCESS_KEY", os.Getenv("SWIM_MINIO_PASSWORD"))
+			// minio accepts any role arn for AssumeRole
+			overlay.Headers.Set("AWS_ROLE_ARN", "arn:minio:iam:::role/swim")
+
+			fs, cleanup, err := overlay.OpenFilesystem()
+			require.NoError(t, err)
+			defer cleanup()
+			_, err = fs.Stat("/")
+			require.NoError(t, err)
+		})
+	}
+}
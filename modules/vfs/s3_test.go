@@ -0,0 +1,381 @@
+package vfs_test
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAws is an s3 endpoint that records how requests were signed, plus an
+// sts endpoint that hands out session credentials
+type fakeAws struct {
+	mu       sync.Mutex
+	auth     []string
+	tokens   []string
+	stsCalls []map[string]string
+}
+
+func (f *fakeAws) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		call := map[string]string{}
+		for k := range r.PostForm {
+			call[k] = r.PostForm.Get(k)
+		}
+		call["Authorization"] = r.Header.Get("Authorization")
+		f.stsCalls = append(f.stsCalls, call)
+		action := call["Action"]
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE</AccessKeyId>
+      <SecretAccessKey>rolesecret</SecretAccessKey>
+      <SessionToken>roletoken</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</%[1]sResponse>`, action)
+		return
+	}
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.tokens = append(f.tokens, r.Header.Get("X-Amz-Security-Token"))
+	w.Header().Set("ETag", `"abc"`)
+	w.Header().Set("Content-Length", "0")
+}
+
+// clearAwsEnv makes sure the host's aws settings do not leak into a test
+func clearAwsEnv(t *testing.T) {
+	for _, k := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_ROLE_ARN",
+		"AWS_EXTERNAL_ID", "AWS_ROLE_SESSION_NAME", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_BUCKET_NAME",
+	} {
+		t.Setenv(k, "")
+	}
+}
+
+func TestOverlayS3Credentials(t *testing.T) {
+	clearAwsEnv(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("oidc-token"), 0o600))
+
+	tests := []struct {
+		name      string
+		mode      string
+		headers   map[string]string
+		wantAuth  string
+		wantToken string
+		wantSts   map[string]string
+		wantErr   string
+	}{
+		{
+			name:     "anonymous by default",
+			wantAuth: "",
+		},
+		{
+			name:     "static by default when keys are set",
+			headers:  map[string]string{"AWS_ACCESS_KEY_ID": "AKIDSTATIC", "AWS_SECRET_ACCESS_KEY": "secret"},
+			wantAuth: "Credential=AKIDSTATIC/",
+		},
+		{
+			name: "static with session token",
+			mode: "static",
+			headers: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "ASIASESSION",
+				"AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_SESSION_TOKEN":     "session",
+			},
+			wantAuth:  "Credential=ASIASESSION/",
+			wantToken: "session",
+		},
+		{
+			name:    "static without keys",
+			mode:    "static",
+			wantErr: "require AWS_ACCESS_KEY_ID",
+		},
+		{
+			name: "anonymous ignores keys",
+			mode: "anonymous",
+			headers: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "AKIDSTATIC",
+				"AWS_SECRET_ACCESS_KEY": "secret",
+			},
+			wantAuth: "",
+		},
+		{
+			name: "assume role with external id",
+			mode: "assume_role",
+			headers: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "AKIDBASE",
+				"AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_ROLE_ARN":          "arn:aws:iam::123456789012:role/site",
+				"AWS_EXTERNAL_ID":       "ext-123",
+			},
+			wantAuth:  "Credential=ASIAROLE/",
+			wantToken: "roletoken",
+			wantSts: map[string]string{
+				"Action":          "AssumeRole",
+				"RoleArn":         "arn:aws:iam::123456789012:role/site",
+				"ExternalId":      "ext-123",
+				"RoleSessionName": "swim",
+			},
+		},
+		{
+			name:    "assume role without role",
+			mode:    "assume_role",
+			wantErr: "require AWS_ROLE_ARN",
+		},
+		{
+			name: "web identity",
+			mode: "web_identity",
+			headers: map[string]string{
+				"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/site",
+				"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile,
+				"AWS_ROLE_SESSION_NAME":       "pod",
+			},
+			wantAuth:  "Credential=ASIAROLE/",
+			wantToken: "roletoken",
+			wantSts: map[string]string{
+				"Action":           "AssumeRoleWithWebIdentity",
+				"WebIdentityToken": "oidc-token",
+				"RoleSessionName":  "pod",
+				"Authorization":    "",
+			},
+		},
+		{
+			name:    "unknown mode",
+			mode:    "magic",
+			wantErr: "unknown credentials mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAws{}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+
+			h := http.Header{}
+			h.Set("AWS_ENDPOINT_URL", srv.URL)
+			h.Set("AWS_ENDPOINT_URL_STS", srv.URL)
+			h.Set("AWS_USE_PATH_STYLE", "true")
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			o := &vfs.Overlay{Root: "s3://s3.example.com/bucket/site.zip", Headers: h, S3Credentials: tt.mode}
+			version, err := o.Version()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, `"abc"`, version)
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			require.Len(t, f.auth, 1)
+			if tt.wantAuth == "" {
+				require.Empty(t, f.auth[0])
+			} else {
+				require.True(t, strings.Contains(f.auth[0], tt.wantAuth), f.auth[0])
+			}
+			require.Equal(t, tt.wantToken, f.tokens[0])
+			if tt.wantSts == nil {
+				require.Empty(t, f.stsCalls)
+				return
+			}
+			require.Len(t, f.stsCalls, 1)
+			for k, v := range tt.wantSts {
+				require.Equal(t, v, f.stsCalls[0][k], k)
+			}
+		})
+	}
+}
+
+func TestOverlayS3CredentialsCached(t *testing.T) {
+	clearAwsEnv(t)
+	f := &fakeAws{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	h := http.Header{}
+	h.Set("AWS_ENDPOINT_URL", srv.URL)
+	h.Set("AWS_ENDPOINT_URL_STS", srv.URL)
+	h.Set("AWS_USE_PATH_STYLE", "true")
+	h.Set("AWS_ACCESS_KEY_ID", "AKIDBASE")
+	h.Set("AWS_SECRET_ACCESS_KEY", "secret")
+	h.Set("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/site")
+	o := &vfs.Overlay{Root: "s3://s3.example.com/bucket/site.zip", Headers: h, S3Credentials: "assume_role"}
+	for range 3 {
+		_, err := o.Version()
+		require.NoError(t, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.Len(t, f.auth, 3)
+	require.Len(t, f.stsCalls, 1)
+}
+
+// fakeBucket is a minimal path style s3 api over an in memory bucket
+type fakeBucket struct {
+	bucket  string
+	objects map[string]string
+	mu      sync.Mutex
+	calls   map[string]int
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if key == "" && r.URL.Query().Get("list-type") == "2" {
+		f.calls["list"]++
+		prefix := r.URL.Query().Get("prefix")
+		delim := r.URL.Query().Get("delimiter")
+		var contents, prefixes []string
+		seen := map[string]bool{}
+		for _, k := range slices.Sorted(maps.Keys(f.objects)) {
+			rest, ok := strings.CutPrefix(k, prefix)
+			if !ok {
+				continue
+			}
+			if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+				p := prefix + rest[:i+1]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, fmt.Sprintf("<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", p))
+				}
+				continue
+			}
+			contents = append(contents, fmt.Sprintf("<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+				k, len(f.objects[k]), modified.Format(time.RFC3339)))
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>%s%s</ListBucketResult>`,
+			f.bucket, prefix, len(contents)+len(prefixes), strings.Join(contents, ""), strings.Join(prefixes, ""))
+		return
+	}
+
+	body, ok := f.objects[key]
+	if !ok {
+		f.calls["miss"]++
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+		}
+		return
+	}
+	f.calls[r.Method]++
+	w.Header().Set("ETag", `"etag"`)
+	http.ServeContent(w, r, "", modified, strings.NewReader(body))
+}
+
+func TestOverlayS3Prefix(t *testing.T) {
+	clearAwsEnv(t)
+	f := &fakeBucket{
+		bucket: "bucket",
+		calls:  map[string]int{},
+		objects: map[string]string{
+			"dist/index.html":         "<h1>home</h1>",
+			"dist/assets/app.js":      "console.log(1)",
+			"dist/assets/css/app.css": "body{}",
+			"other/secret.txt":        "nope",
+		},
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	h := http.Header{}
+	h.Set("AWS_ENDPOINT_URL", srv.URL)
+	h.Set("AWS_USE_PATH_STYLE", "true")
+	o := &vfs.Overlay{Root: "s3://s3.example.com/bucket/dist/", Headers: h}
+
+	version, err := o.Version()
+	require.NoError(t, err)
+	require.Empty(t, version)
+
+	afs, cleanup, err := o.OpenFilesystem()
+	require.NoError(t, err)
+	defer cleanup()
+
+	body, err := afero.ReadFile(afs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "<h1>home</h1>", string(body))
+
+	info, err := afs.Stat("assets")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	_, err = afs.Stat("secret.txt")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = afs.Stat("../other/secret.txt")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	infos, err := afero.ReadDir(afs, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	require.Equal(t, []string{"assets", "index.html"}, names)
+
+	infos, err = afero.ReadDir(afs, "assets")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "app.js", infos[0].Name())
+	require.EqualValues(t, len("console.log(1)"), infos[0].Size())
+	require.Equal(t, "css", infos[1].Name())
+	require.True(t, infos[1].IsDir())
+
+	// listings and stats are cached
+	f.mu.Lock()
+	lists := f.calls["list"]
+	f.mu.Unlock()
+	_, err = afero.ReadDir(afs, "assets")
+	require.NoError(t, err)
+	_, err = afs.Stat("assets/app.js")
+	require.NoError(t, err)
+	f.mu.Lock()
+	require.Equal(t, lists, f.calls["list"])
+	f.mu.Unlock()
+
+	// range requests are passed through to the bucket
+	fileSrv := httptest.NewServer(http.FileServer(http.FS(afero.NewIOFS(afs))))
+	defer fileSrv.Close()
+	req, err := http.NewRequest(http.MethodGet, fileSrv.URL+"/assets/app.js", nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=8-10")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "log", string(body))
+}
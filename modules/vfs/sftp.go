@@ -0,0 +1,311 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpConfig builds the ssh client config for an sftp:// url. the user and
+// password may be given in the url, otherwise they are taken from
+// SFTP_USERNAME and SFTP_PASSWORD. a pem encoded SFTP_PRIVATE_KEY is offered
+// before the password. the host key is checked against SFTP_HOST_KEY, or the
+// SFTP_KNOWN_HOSTS file, which defaults to ~/.ssh/known_hosts.
+func (o *Overlay) sftpConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	user := u.User.Username()
+	if user == "" {
+		user = o.headerOrEnv("SFTP_USERNAME")
+	}
+	if user == "" {
+		return nil, fmt.Errorf("sftp: a user is required (sftp://user@host/path or SFTP_USERNAME)")
+	}
+
+	var auth []ssh.AuthMethod
+	if key := o.headerOrEnv("SFTP_PRIVATE_KEY"); key != "" {
+		var signer ssh.Signer
+		var err error
+		if pass := o.headerOrEnv("SFTP_PRIVATE_KEY_PASSPHRASE"); pass != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(pass))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sftp: SFTP_PRIVATE_KEY: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		password = o.headerOrEnv("SFTP_PASSWORD")
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp: SFTP_PRIVATE_KEY or SFTP_PASSWORD is required")
+	}
+
+	hostKey, err := o.sftpHostKey()
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+func (o *Overlay) sftpHostKey() (ssh.HostKeyCallback, error) {
+	if key := o.headerOrEnv("SFTP_HOST_KEY"); key != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("sftp: SFTP_HOST_KEY: %w", err)
+		}
+		return ssh.FixedHostKey(pub), nil
+	}
+	file := o.headerOrEnv("SFTP_KNOWN_HOSTS")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("sftp: SFTP_HOST_KEY or SFTP_KNOWN_HOSTS is required: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	cb, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: SFTP_HOST_KEY or SFTP_KNOWN_HOSTS is required: %w", err)
+	}
+	return cb, nil
+}
+
+// dialSftp opens an sftp session to the host of u. the returned function
+// closes both the session and the ssh connection under it.
+func (o *Overlay) dialSftp(u *url.URL) (*sftp.Client, func(), error) {
+	config, err := o.sftpConfig(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sftp: dial %s: %w", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("sftp: %w", err)
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+	}, nil
+}
+
+// sftpVersion identifies a remote file by its mtime and size, like local ones
+func sftpVersion(info os.FileInfo) string {
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(info.Size(), 10)
+}
+
+func (o *Overlay) openSftp(u *url.URL) (afero.Fs, func(), error) {
+	client, closeFn, err := o.dialSftp(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeFn()
+	f, err := client.Open(u.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sftp: read %s: %w", u.Redacted(), err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("sftp: stat %s: %w", u.Redacted(), err)
+	}
+	h := make(http.Header)
+	h.Set("ETag", sftpVersion(info))
+	return o.spool(u, h, f)
+}
+
+// versionSftp returns the mtime and size of the remote archive
+func (o *Overlay) versionSftp(u *url.URL) (string, error) {
+	client, closeFn, err := o.dialSftp(u)
+	if err != nil {
+		return "", err
+	}
+	defer closeFn()
+	info, err := client.Stat(u.Path)
+	if err != nil {
+		return "", fmt.Errorf("sftp: stat %s: %w", u.Redacted(), err)
+	}
+	return sftpVersion(info), nil
+}
+
+// sftpStore serves the files under a directory of an sftp server. the
+// session is opened on first use and opened again once it breaks.
+type sftpStore struct {
+	o   *Overlay
+	u   *url.URL
+	dir string
+
+	mu      sync.Mutex
+	client  *sftp.Client
+	closeFn func()
+}
+
+// openSftpPrefix serves a remote directory as a live filesystem
+func (o *Overlay) openSftpPrefix(u *url.URL) (afero.Fs, func(), error) {
+	store := &sftpStore{o: o, u: u, dir: u.Path}
+	// fail provisioning early on bad credentials or a missing directory
+	if _, err := store.session(); err != nil {
+		return nil, nil, err
+	}
+	return newBucketFs(store, time.Duration(o.MetadataTTL)), store.close, nil
+}
+
+func (s *sftpStore) session() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	client, closeFn, err := s.o.dialSftp(s.u)
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Stat(s.dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	if err != nil {
+		closeFn()
+		return nil, fmt.Errorf("sftp: %s: %w", s.u.Redacted(), err)
+	}
+	s.client, s.closeFn = client, closeFn
+	return client, nil
+}
+
+// check drops the session if err means the connection is gone
+func (s *sftpStore) check(client *sftp.Client, err error) error {
+	if err == nil || !(errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)) {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.closeFn()
+		s.client, s.closeFn = nil, nil
+	}
+	return err
+}
+
+func (s *sftpStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.closeFn()
+		s.client, s.closeFn = nil, nil
+	}
+}
+
+func (s *sftpStore) head(ctx context.Context, key string) (*objectInfo, error) {
+	client, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Stat(path.Join(s.dir, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, os.ErrNotExist
+		}
+		return nil, s.check(client, err)
+	}
+	if info.IsDir() {
+		// directories are found via hasPrefix
+		return nil, os.ErrNotExist
+	}
+	return &objectInfo{name: path.Base(key), size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (s *sftpStore) hasPrefix(ctx context.Context, dir string) (bool, error) {
+	client, err := s.session()
+	if err != nil {
+		return false, err
+	}
+	info, err := client.Stat(path.Join(s.dir, dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, s.check(client, err)
+	}
+	return info.IsDir(), nil
+}
+
+func (s *sftpStore) list(ctx context.Context, dir string) ([]*objectInfo, error) {
+	client, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := client.ReadDir(path.Join(s.dir, dir))
+	if err != nil {
+		return nil, s.check(client, err)
+	}
+	entries := make([]*objectInfo, 0, len(infos))
+	for _, info := range infos {
+		switch {
+		case info.IsDir():
+			entries = append(entries, &objectInfo{name: info.Name(), modTime: info.ModTime(), dir: true})
+		case info.Mode().IsRegular():
+			entries = append(entries, &objectInfo{name: info.Name(), size: info.Size(), modTime: info.ModTime()})
+		}
+	}
+	slices.SortFunc(entries, func(a, b *objectInfo) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+func (s *sftpStore) read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error) {
+	client, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(path.Join(s.dir, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, os.ErrNotExist
+		}
+		return nil, s.check(client, err)
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
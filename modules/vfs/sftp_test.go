@@ -0,0 +1,200 @@
+package vfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSftpServer serves the local filesystem read-only over sftp. it accepts
+// the user deploy with the password hunter2 or clientKey, and returns its
+// address and host key in authorized_keys format.
+func newSftpServer(t *testing.T, clientKey ssh.PublicKey) (string, string) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "deploy" && string(pass) == "hunter2" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "deploy" && clientKey != nil && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSftp(conn, config)
+		}
+	}()
+	return l.Addr().String(), string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+}
+
+func serveSftp(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(ch, sftp.ReadOnly())
+					if err == nil {
+						server.Serve()
+					}
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestOverlaySftp(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+	privPem := string(pem.EncodeToMemory(block))
+
+	addr, hostKey := newSftpServer(t, clientKey)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "site.tar.gz")
+	writeTar(t, archive, map[string]string{"index.html": "from sftp"})
+
+	for name, tc := range map[string]struct {
+		user    string
+		headers map[string]string
+	}{
+		"password in url": {user: "deploy:hunter2@"},
+		"password header": {headers: map[string]string{"SFTP_USERNAME": "deploy", "SFTP_PASSWORD": "hunter2"}},
+		"private key":     {user: "deploy@", headers: map[string]string{"SFTP_PRIVATE_KEY": privPem}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("SFTP_HOST_KEY", hostKey)
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			o := &vfs.Overlay{Root: "sftp://" + tc.user + addr + archive, Headers: h, CacheDir: t.TempDir()}
+			require.Equal(t, "from sftp", readFile(t, o, "index.html"))
+
+			// sftp reports mtimes in seconds
+			info, err := os.Stat(archive)
+			require.NoError(t, err)
+			version, err := o.Version()
+			require.NoError(t, err)
+			require.Equal(t, strconv.FormatInt(info.ModTime().Truncate(time.Second).UnixNano(), 10)+"-"+strconv.FormatInt(info.Size(), 10), version)
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		tarball, err := os.ReadFile(archive)
+		require.NoError(t, err)
+		key := newMinisignKey(t)
+		require.NoError(t, os.WriteFile(archive+".minisig", []byte(key.sign(tarball)), 0o644))
+		h := http.Header{}
+		h.Set("SFTP_HOST_KEY", hostKey)
+		o := &vfs.Overlay{Root: "sftp://deploy:hunter2@" + addr + archive, Headers: h, CacheDir: t.TempDir(), PublicKey: key.publicKey()}
+		require.Equal(t, "from sftp", readFile(t, o, "index.html"))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("SFTP_HOST_KEY", hostKey)
+		o := &vfs.Overlay{Root: "sftp://deploy:nope@" + addr + archive, Headers: h}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "unable to authenticate")
+	})
+
+	t.Run("unknown host key", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		otherKey, err := ssh.NewPublicKey(other)
+		require.NoError(t, err)
+		h := http.Header{}
+		h.Set("SFTP_HOST_KEY", string(ssh.MarshalAuthorizedKey(otherKey)))
+		o := &vfs.Overlay{Root: "sftp://deploy:hunter2@" + addr + archive, Headers: h}
+		_, _, err = o.OpenFilesystem()
+		require.ErrorContains(t, err, "host key mismatch")
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		site := filepath.Join(dir, "dist")
+		require.NoError(t, os.MkdirAll(filepath.Join(site, "assets"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>home</h1>"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(site, "assets", "app.js"), []byte("console.log(1)"), 0o644))
+
+		h := http.Header{}
+		h.Set("SFTP_HOST_KEY", hostKey)
+		o := &vfs.Overlay{Root: "sftp://deploy:hunter2@" + addr + site + "/", Headers: h, MetadataTTL: caddy.Duration(time.Nanosecond)}
+		afs, cleanup, err := o.OpenFilesystem()
+		require.NoError(t, err)
+		defer cleanup()
+
+		body, err := afero.ReadFile(afs, "assets/app.js")
+		require.NoError(t, err)
+		require.Equal(t, "console.log(1)", string(body))
+
+		infos, err := afero.ReadDir(afs, "/")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "assets", infos[0].Name())
+		require.True(t, infos[0].IsDir())
+		require.EqualValues(t, len("<h1>home</h1>"), infos[1].Size())
+
+		// changes show up without a reload
+		require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>new</h1>"), 0o644))
+		body, err = afero.ReadFile(afs, "index.html")
+		require.NoError(t, err)
+		require.Equal(t, "<h1>new</h1>", string(body))
+
+		version, err := o.Version()
+		require.NoError(t, err)
+		require.Empty(t, version)
+	})
+}
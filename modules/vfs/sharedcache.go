@@ -0,0 +1,271 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gfx-labs/swim/pkg/archive"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// default size limit of a shared cache dir
+const defaultSharedCacheSize = 1 << 30
+
+var sharedCacheEntryName = regexp.MustCompile(`^[0-9a-f]{64}\.(zip|tar)$`)
+
+// sharedCache is a directory of spooled archives keyed by source and
+// version. every overlay pointing at the same dir shares one, so the same
+// archive is only fetched once across filesystems and config reloads.
+// entries are evicted least recently used first once the dir grows past its
+// size limit. the mtime of an entry is its last use, so the order survives
+// restarts.
+//
+// evicted entries are unlinked while they may still be open, which is fine
+// on unix: the file lives on until the last revision serving it is released.
+type sharedCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+var (
+	sharedCachesMu sync.Mutex
+	sharedCaches   = make(map[string]*sharedCache)
+)
+
+// sharedCache returns the shared cache of the overlay, or nil if it has
+// none. the most recently configured size limit of a dir applies.
+func (o *Overlay) sharedCache() *sharedCache {
+	if o.SharedCache == "" {
+		return nil
+	}
+	dir := filepath.Clean(o.SharedCache)
+	maxBytes := o.SharedCacheSize
+	if maxBytes <= 0 {
+		maxBytes = defaultSharedCacheSize
+	}
+	sharedCachesMu.Lock()
+	defer sharedCachesMu.Unlock()
+	c, ok := sharedCaches[dir]
+	if !ok {
+		c = &sharedCache{dir: dir, locks: make(map[string]*keyLock)}
+		sharedCaches[dir] = c
+	}
+	c.mu.Lock()
+	c.maxBytes = maxBytes
+	c.mu.Unlock()
+	return c
+}
+
+// sharedCacheKey returns the cache key of the archive at version. it covers
+// everything that decides how the archive is spooled and verified, so
+// entries are never served to an overlay with different expectations. an
+// unversioned source has no key and is never cached.
+func (o *Overlay) sharedCacheKey(version string) string {
+	if version == "" {
+		return ""
+	}
+	h := sha256.New()
+	for _, s := range []string{o.Root, version, o.Type, o.Sha256, o.PublicKey, o.Signature} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// headerVersion returns the version of a fetched archive from its response
+// headers, the same way Version does for http sources
+func headerVersion(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// openCached serves the current version of the source from the shared cache,
+// and falls back to open when it is not cached yet. concurrent loads of the
+// same archive wait for each other, so it is only fetched once.
+func (o *Overlay) openCached(u *url.URL, open func(*url.URL) (afero.Fs, func(), error)) (afero.Fs, func(), error) {
+	c := o.sharedCache()
+	if c == nil {
+		return open(u)
+	}
+	version, err := o.Version()
+	if err != nil {
+		// let the fetch report the problem
+		return open(u)
+	}
+	key := o.sharedCacheKey(version)
+	if key == "" {
+		return open(u)
+	}
+	unlock := c.lock(key)
+	defer unlock()
+	if fs, cleanup, ok := c.open(key); ok {
+		o.logger().Debug("serving archive from shared cache", zap.String("root", o.redactedRoot()), zap.String("version", version))
+		return fs, cleanup, nil
+	}
+	return open(u)
+}
+
+// spoolFs unpacks r into the cache dir, or into the shared cache when the
+// overlay has one and the archive is versioned. shared cache entries only
+// become visible to other overlays once commit is called.
+func (o *Overlay) spoolFs(ft string, r io.Reader, h http.Header) (fs afero.Fs, cleanup func(), commit func(), err error) {
+	c := o.sharedCache()
+	key := o.sharedCacheKey(headerVersion(h))
+	if c == nil || key == "" {
+		fs, _, cleanup, err := archive.SpoolFs(ft, r, o.cacheDir())
+		return fs, cleanup, func() {}, err
+	}
+	return c.spool(key, ft, r, o.logger())
+}
+
+func (c *sharedCache) lock(key string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &keyLock{}
+		c.locks[key] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		c.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(c.locks, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// open opens the entry for key and marks it as used
+func (c *sharedCache) open(key string) (afero.Fs, func(), bool) {
+	for _, ext := range []string{".zip", ".tar"} {
+		path := filepath.Join(c.dir, key+ext)
+		fs, _, cleanup, err := archive.OpenSpooledFs(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// a damaged entry is fetched again
+			os.Remove(path)
+			return nil, nil, false
+		}
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return fs, cleanup, true
+	}
+	return nil, nil, false
+}
+
+// spool unpacks r into a temporary file in the cache dir. commit moves it
+// into place as the entry for key and evicts old entries, until then the
+// cleanup function removes it.
+func (c *sharedCache) spool(key, ft string, r io.Reader, log *zap.Logger) (afero.Fs, func(), func(), error) {
+	path, err := archive.SpoolFile(ft, r, c.dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fs, _, fsCleanup, err := archive.OpenSpooledFs(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, nil, err
+	}
+	var (
+		mu        sync.Mutex
+		committed bool
+	)
+	cleanup := func() {
+		fsCleanup()
+		mu.Lock()
+		defer mu.Unlock()
+		if !committed {
+			os.Remove(path)
+		}
+	}
+	commit := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		entry := filepath.Join(c.dir, key+filepath.Ext(path))
+		// the open file handle follows the rename
+		if err := os.Rename(path, entry); err != nil {
+			log.Warn("unable to add archive to shared cache", zap.String("dir", c.dir), zap.Error(err))
+			return
+		}
+		committed = true
+		c.evict(entry, log)
+	}
+	return fs, cleanup, commit, nil
+}
+
+// evict removes the least recently used entries until the cache fits its
+// size limit. keep is never removed, even when it alone is over the limit.
+func (c *sharedCache) evict(keep string, log *zap.Logger) {
+	c.mu.Lock()
+	maxBytes := c.maxBytes
+	c.mu.Unlock()
+
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Warn("unable to list shared cache", zap.String("dir", c.dir), zap.Error(err))
+		return
+	}
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		entries []entry
+		total   int64
+	)
+	for _, de := range dirEntries {
+		if !sharedCacheEntryName.MatchString(de.Name()) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{filepath.Join(c.dir, de.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("unable to evict archive from shared cache", zap.String("path", e.path), zap.Error(err))
+			continue
+		}
+		log.Debug("evicted archive from shared cache", zap.String("path", e.path), zap.Int64("size", e.size))
+		total -= e.size
+	}
+}
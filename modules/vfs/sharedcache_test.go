@@ -0,0 +1,158 @@
+package vfs_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// archiveServer serves tarballs by path with an etag, and counts downloads
+type archiveServer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	etags map[string]string
+	gets  atomic.Int64
+}
+
+func (s *archiveServer) put(t *testing.T, name, etag string, files map[string]string) {
+	path := filepath.Join(t.TempDir(), name)
+	writeTar(t, path, files)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files["/"+name] = data
+	s.etags["/"+name] = etag
+}
+
+func (s *archiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.files[r.URL.Path]
+	etag := s.etags[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodGet {
+		s.gets.Add(1)
+		w.Write(data)
+	}
+}
+
+func newArchiveServer(t *testing.T) (*archiveServer, string) {
+	s := &archiveServer{files: map[string][]byte{}, etags: map[string]string{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+var cacheEntry = regexp.MustCompile(`^[0-9a-f]{64}\.tar$`)
+
+func cacheEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		require.Regexp(t, cacheEntry, e.Name(), "temporary files are cleaned up")
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func readFile(t *testing.T, o *vfs.Overlay, name string) string {
+	t.Helper()
+	fs, cleanup, err := o.OpenFilesystem()
+	require.NoError(t, err)
+	defer cleanup()
+	body, err := afero.ReadFile(fs, name)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestOverlaySharedCache(t *testing.T) {
+	srv, base := newArchiveServer(t)
+	srv.put(t, "site.tar.gz", `"v1"`, map[string]string{"index.html": "one"})
+	dir := t.TempDir()
+
+	// two filesystems, or a reload, share the download
+	for range 3 {
+		o := &vfs.Overlay{Root: base + "/site.tar.gz", SharedCache: dir, CacheDir: t.TempDir()}
+		require.Equal(t, "one", readFile(t, o, "index.html"))
+	}
+	require.EqualValues(t, 1, srv.gets.Load())
+	require.Len(t, cacheEntries(t, dir), 1)
+
+	// a new version is fetched, and the old one stays until it is evicted
+	srv.put(t, "site.tar.gz", `"v2"`, map[string]string{"index.html": "two"})
+	o := &vfs.Overlay{Root: base + "/site.tar.gz", SharedCache: dir}
+	require.Equal(t, "two", readFile(t, o, "index.html"))
+	require.Equal(t, "two", readFile(t, o, "index.html"))
+	require.EqualValues(t, 2, srv.gets.Load())
+	require.Len(t, cacheEntries(t, dir), 2)
+
+	// different expectations never share an entry
+	o = &vfs.Overlay{Root: base + "/site.tar.gz", SharedCache: dir, Sha256: strings.Repeat("0", 64)}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "sha256 mismatch")
+	require.EqualValues(t, 3, srv.gets.Load())
+	require.Len(t, cacheEntries(t, dir), 2)
+}
+
+func TestOverlaySharedCacheEviction(t *testing.T) {
+	srv, base := newArchiveServer(t)
+	srv.put(t, "a.tar", `"a"`, map[string]string{"index.html": "a"})
+	srv.put(t, "b.tar", `"b"`, map[string]string{"index.html": "b"})
+	srv.put(t, "c.tar", `"c"`, map[string]string{"index.html": "c"})
+	dir := t.TempDir()
+
+	open := func(name string) string {
+		// room for two of the tarballs
+		o := &vfs.Overlay{Root: base + "/" + name, SharedCache: dir, SharedCacheSize: 2 * 2048}
+		return readFile(t, o, "index.html")
+	}
+	require.Equal(t, "a", open("a.tar"))
+	require.Equal(t, "b", open("b.tar"))
+	require.Len(t, cacheEntries(t, dir), 2)
+
+	// a was used last, so b goes
+	require.Equal(t, "a", open("a.tar"))
+	require.Equal(t, "c", open("c.tar"))
+	require.Len(t, cacheEntries(t, dir), 2)
+	require.EqualValues(t, 3, srv.gets.Load())
+
+	require.Equal(t, "a", open("a.tar"))
+	require.EqualValues(t, 3, srv.gets.Load())
+	require.Equal(t, "b", open("b.tar"))
+	require.EqualValues(t, 4, srv.gets.Load())
+}
+
+func TestOverlaySharedCacheConcurrent(t *testing.T) {
+	srv, base := newArchiveServer(t)
+	srv.put(t, "site.tar.gz", `"v1"`, map[string]string{"index.html": "one"})
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o := &vfs.Overlay{Root: base + "/site.tar.gz", SharedCache: dir}
+			require.Equal(t, "one", readFile(t, o, "index.html"))
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 1, srv.gets.Load())
+}
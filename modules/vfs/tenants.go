@@ -0,0 +1,399 @@
+package vfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// how many archives a vfs_tenants handler keeps open by default
+const defaultMaxFilesystems = 100
+
+// tenantFsPrefix namespaces our entries in the global FileSystems map
+const tenantFsPrefix = "vfs_tenants:"
+
+// how long a root that failed to load is answered with the same error before
+// it is tried again
+const failedLoadTTL = 30 * time.Second
+
+// Tenants is an http handler that serves a different archive per request.
+// the root of its overlay may contain request placeholders, e.g.
+// s3://sites/{http.request.host.labels.2}.tar.gz, and every distinct root it
+// expands to is opened on first use and kept open for later requests. once
+// more than MaxFilesystems are open, the least recently used one is closed,
+// as soon as no request is using it anymore.
+// the filesystem of the request is registered in caddy's FileSystems map and
+// named in the "fs" variable, so file_server and try_files serve from it.
+type Tenants struct {
+	Overlay *Overlay `json:"overlay"`
+
+	// how many archives to keep open. defaults to 100.
+	MaxFilesystems int `json:"max_filesystems,omitempty"`
+
+	ctx         caddy.Context
+	log         *zap.Logger
+	fileSystems caddy.FileSystems
+
+	mu      sync.Mutex
+	tenants map[string]*list.Element // of *tenant, by expanded root
+	lru     *list.List               // most recently used first
+	loads   singleflight.Group
+	// set by Cleanup, after which loads that finish are closed right away
+	closed bool
+	// numbers the loads, so a root opened again never takes the name of
+	// the copy it replaces while that is still registered
+	loaded uint64
+
+	// recently failed roots, at most MaxFilesystems of them
+	failures   map[string]failedLoad
+	failureTTL time.Duration
+}
+
+// failedLoad is the error a root failed to load with, until it expires
+type failedLoad struct {
+	err     error
+	expires time.Time
+}
+
+// tenant is an open archive of a Tenants handler
+type tenant struct {
+	root string
+	name string // key in the FileSystems map
+	vfs  *Vfs
+
+	// the rest is guarded by Tenants.mu. requests pin the tenant they are
+	// served from, and an evicted tenant is only closed once it is unpinned.
+	pins    int
+	evicted bool
+	closed  bool
+}
+
+func (t *Tenants) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.vfs_tenants",
+		New: func() caddy.Module {
+			return new(Tenants)
+		},
+	}
+}
+
+func (t *Tenants) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	t.Overlay = &Overlay{Headers: make(http.Header)}
+	for d.Next() {
+		if d.NextArg() {
+			// optional arg
+			t.Overlay.Root = d.Val()
+		}
+		if d.NextArg() {
+			// too many args
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if strings.ToLower(d.Val()) != "max_filesystems" {
+				if err := t.Overlay.unmarshalOption(d); err != nil {
+					return err
+				}
+				continue
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return d.Errf("invalid max_filesystems: %s", d.Val())
+			}
+			t.MaxFilesystems = n
+		}
+	}
+	return nil
+}
+
+func (t *Tenants) Provision(ctx caddy.Context) error {
+	t.ctx = ctx
+	t.log = ctx.Logger()
+	if t.Overlay == nil || t.Overlay.Root == "" {
+		return fmt.Errorf("vfs_tenants: root is required")
+	}
+	t.Overlay.resolvePlaceholders()
+	t.Overlay.log = t.log
+	if t.MaxFilesystems <= 0 {
+		t.MaxFilesystems = defaultMaxFilesystems
+	}
+	t.fileSystems = ctx.FileSystems()
+	t.tenants = make(map[string]*list.Element)
+	t.lru = list.New()
+	t.failures = make(map[string]failedLoad)
+	t.failureTTL = failedLoadTTL
+	return nil
+}
+
+func (t *Tenants) Cleanup() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for t.lru.Len() > 0 {
+		t.evict(t.lru.Back().Value.(*tenant))
+	}
+	return nil
+}
+
+func (t *Tenants) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root, err := expandRoot(repl, t.Overlay.Root)
+	if err != nil {
+		t.log.Debug("unable to expand vfs root", zap.String("host", r.Host), zap.Error(err))
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	tn, err := t.open(root)
+	if err != nil {
+		t.log.Debug("unable to open vfs tenant", zap.String("root", redactRoot(root)), zap.Error(err))
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	// the tenant stays registered until the request is done with it
+	defer t.unpin(tn)
+
+	// set the filesystem variable for downstream handlers (file_server, try_files, etc.)
+	caddyhttp.SetVar(r.Context(), "fs", tn.name)
+	return next.ServeHTTP(w, r)
+}
+
+// open returns the tenant for root pinned, opening it if needed. concurrent
+// requests for the same root share one load. a failed load is remembered for
+// a while, so requests for a root that does not exist do not each go to the
+// source.
+func (t *Tenants) open(root string) (*tenant, error) {
+	for {
+		tn, err := t.lookup(root)
+		if tn != nil || err != nil {
+			return tn, err
+		}
+		if err := t.failed(root); err != nil {
+			return nil, err
+		}
+		v, err, _ := t.loads.Do(root, func() (any, error) {
+			t.mu.Lock()
+			e, ok := t.tenants[root]
+			t.mu.Unlock()
+			if ok {
+				return e.Value.(*tenant), nil
+			}
+			tn, err := t.load(root)
+			if err != nil {
+				t.fail(root, err)
+				return nil, err
+			}
+			if !t.add(tn) {
+				return nil, fs.ErrClosed
+			}
+			return tn, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if t.pin(v.(*tenant)) {
+			return v.(*tenant), nil
+		}
+		// closed again before this request got to it, e.g. because more
+		// roots than are kept open were loaded at the same time
+	}
+}
+
+// lookup returns the open tenant for root pinned, or nil if there is none.
+// it fails once the handler is cleaned up.
+func (t *Tenants) lookup(root string) (*tenant, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fs.ErrClosed
+	}
+	e, ok := t.tenants[root]
+	if !ok {
+		return nil, nil
+	}
+	t.lru.MoveToFront(e)
+	tn := e.Value.(*tenant)
+	tn.pins++
+	return tn, nil
+}
+
+// pin keeps tn open until it is unpinned, failing if it is closed already
+func (t *Tenants) pin(tn *tenant) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tn.closed {
+		return false
+	}
+	tn.pins++
+	return true
+}
+
+// unpin closes tn if it was evicted while pinned and this was the last pin
+func (t *Tenants) unpin(tn *tenant) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tn.pins--
+	if tn.pins == 0 && tn.evicted {
+		t.close(tn)
+	}
+}
+
+// failed returns the error root recently failed to load with, if any
+func (t *Tenants) failed(root string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[root]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(f.expires) {
+		delete(t.failures, root)
+		return nil
+	}
+	return f.err
+}
+
+// fail remembers that root failed to load, making room by dropping expired
+// failures, or any failure if none has expired
+func (t *Tenants) fail(root string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if len(t.failures) >= t.MaxFilesystems {
+		for r, f := range t.failures {
+			if now.After(f.expires) {
+				delete(t.failures, r)
+			}
+		}
+	}
+	for r := range t.failures {
+		if len(t.failures) < t.MaxFilesystems {
+			break
+		}
+		delete(t.failures, r)
+	}
+	t.failures[root] = failedLoad{err: err, expires: now.Add(t.failureTTL)}
+}
+
+// load opens root with the options of the handler's overlay
+func (t *Tenants) load(root string) (*tenant, error) {
+	o, err := t.Overlay.withRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	// the load runs on a request, which should not wait out retries. the
+	// failure is remembered instead, and the next request after it expires
+	// tries again.
+	o.Retries = 0
+	v := &Vfs{Overlay: o, log: t.log.With(zap.String("root", o.redactedRoot()))}
+	if err := v.provision(t.ctx); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(root))
+	t.mu.Lock()
+	t.loaded++
+	name := fmt.Sprintf("%s%s-%d", tenantFsPrefix, hex.EncodeToString(sum[:8]), t.loaded)
+	t.mu.Unlock()
+	tn := &tenant{root: root, name: name, vfs: v}
+	if t.fileSystems != nil {
+		t.fileSystems.Register(tn.name, v)
+	}
+	return tn, nil
+}
+
+// add makes tn available to requests and evicts the least recently used
+// tenants beyond the limit. after Cleanup tn is closed instead, and add
+// returns false.
+func (t *Tenants) add(tn *tenant) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		t.close(tn)
+		return false
+	}
+	t.tenants[tn.root] = t.lru.PushFront(tn)
+	for t.lru.Len() > t.MaxFilesystems {
+		old := t.lru.Back().Value.(*tenant)
+		t.evict(old)
+		t.log.Debug("evicted least recently used vfs tenant", zap.String("root", redactRoot(old.root)))
+	}
+	return true
+}
+
+// evict stops handing tn out to new requests, and closes it unless requests
+// still use it, in which case the last of them does
+func (t *Tenants) evict(tn *tenant) {
+	t.lru.Remove(t.tenants[tn.root])
+	delete(t.tenants, tn.root)
+	tn.evicted = true
+	if tn.pins == 0 {
+		t.close(tn)
+	}
+}
+
+// close unregisters a tenant and releases its archive. files that requests
+// already opened stay readable until they are closed.
+func (t *Tenants) close(tn *tenant) {
+	tn.closed = true
+	if t.fileSystems != nil {
+		t.fileSystems.Unregister(tn.name)
+	}
+	tn.vfs.Cleanup()
+	if _, ok := t.tenants[tn.root]; !ok {
+		// the metrics are by root, and a newer copy may be open by now
+		tn.vfs.forgetMetrics()
+	}
+}
+
+// expandRoot fills in the request placeholders of root. every value must be
+// a plain name, so a request can only pick among the archives the template
+// allows and never point it anywhere else.
+func expandRoot(repl *caddy.Replacer, root string) (string, error) {
+	return repl.ReplaceFunc(root, func(variable string, val any) (any, error) {
+		s := caddy.ToString(val)
+		if s == "" {
+			return nil, fmt.Errorf("placeholder {%s} is empty", variable)
+		}
+		if s == "." || s == ".." || strings.ContainsAny(s, "/\\{}?#%@:") {
+			return nil, fmt.Errorf("placeholder {%s} is not a plain name: %q", variable, s)
+		}
+		return s, nil
+	})
+}
+
+// hasRequestPlaceholders reports whether root still has placeholders left
+// after the ones known at provision time were filled in
+func hasRequestPlaceholders(root string) bool {
+	return strings.Contains(root, "{http.")
+}
+
+// withRoot returns a copy of the overlay config that serves root. runtime
+// state such as cached credentials is not copied.
+func (o *Overlay) withRoot(root string) (*Overlay, error) {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Overlay)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	c.Root = root
+	c.log = o.log
+	return c, nil
+}
+
+var _ caddyhttp.MiddlewareHandler = (*Tenants)(nil)
@@ -0,0 +1,290 @@
+package vfs
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTenant runs a request for host through the handler, and reads name
+// from the filesystem it picked
+func serveTenant(t *testing.T, h *Tenants, host, name string) (string, error) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://"+host+"/"+name, nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+	caddyhttp.NewTestReplacer(r)
+
+	var body string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		fsName, _ := caddyhttp.GetVar(r.Context(), "fs").(string)
+		fsys, ok := h.fileSystems.Get(fsName)
+		require.True(t, ok, "filesystem %q is registered", fsName)
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		body = string(data)
+		return err
+	})
+	err := h.ServeHTTP(httptest.NewRecorder(), r, next)
+	return body, err
+}
+
+// writeTenantTar writes a tarball with an index.html that says who it is for
+func writeTenantTar(t *testing.T, path, tenant string) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "index.html", Mode: 0o644, Size: int64(len(tenant))}))
+	_, err = tw.Write([]byte(tenant))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+}
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	for _, tenant := range []string{"alpha", "beta", "gamma"} {
+		writeTenantTar(t, filepath.Join(dir, tenant+".tar"), tenant)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := &Tenants{
+		Overlay:        &Overlay{Root: filepath.Join(dir, "{http.request.host.labels.2}.tar"), CacheDir: t.TempDir()},
+		MaxFilesystems: 2,
+	}
+	require.NoError(t, h.Provision(ctx))
+	defer h.Cleanup()
+
+	for _, tenant := range []string{"alpha", "beta", "alpha", "gamma"} {
+		body, err := serveTenant(t, h, tenant+".sites.test", "index.html")
+		require.NoError(t, err)
+		require.Equal(t, tenant, body)
+	}
+
+	// only two stay open, the others are opened again on demand
+	registered := 0
+	for _, tenant := range []string{"alpha", "beta", "gamma"} {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tenant+".sites.test/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+		caddyhttp.NewTestReplacer(r)
+		h.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if _, ok := h.fileSystems.Get(caddyhttp.GetVar(r.Context(), "fs").(string)); ok {
+				registered++
+			}
+			return nil
+		}))
+	}
+	require.Equal(t, 3, registered, "closed tenants are opened again on demand")
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := serveTenant(t, h, "delta.sites.test", "index.html")
+		var herr caddyhttp.HandlerError
+		require.True(t, errors.As(err, &herr))
+		require.Equal(t, http.StatusNotFound, herr.StatusCode)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("not a plain name", func(t *testing.T) {
+		h := &Tenants{Overlay: &Overlay{Root: filepath.Join(dir, "{http.request.uri.query.site}.tar")}}
+		require.NoError(t, h.Provision(ctx))
+		defer h.Cleanup()
+
+		_, err := serveTenant(t, h, "sites.test", "index.html?site=..%2Fetc%2Fsite")
+		require.ErrorContains(t, err, "is not a plain name")
+		_, err = serveTenant(t, h, "sites.test", "index.html")
+		require.ErrorContains(t, err, "is empty")
+	})
+}
+
+func TestVfsRejectsRequestPlaceholders(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	v := &Vfs{Overlay: &Overlay{Root: "s3://sites/{http.request.host}.tar.gz"}}
+	require.ErrorContains(t, v.Provision(ctx), "vfs_tenants")
+}
+
+func TestTenantsFailuresAndMetrics(t *testing.T) {
+	dir := t.TempDir()
+	for _, tenant := range []string{"alpha", "beta"} {
+		writeTenantTar(t, filepath.Join(dir, tenant+".tar"), tenant)
+	}
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeFile(w, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := &Tenants{
+		Overlay:        &Overlay{Root: srv.URL + "/{http.request.host.labels.2}.tar", CacheDir: t.TempDir(), Retries: 5, RetryBackoff: caddy.Duration(time.Second)},
+		MaxFilesystems: 1,
+	}
+	require.NoError(t, h.Provision(ctx))
+	defer h.Cleanup()
+
+	// a missing tenant is tried once, without retries, and then remembered
+	for range 3 {
+		_, err := serveTenant(t, h, "delta.sites.test", "index.html")
+		require.ErrorContains(t, err, "404")
+	}
+	require.EqualValues(t, 1, requests.Load())
+	for root, f := range h.failures {
+		f.expires = time.Now()
+		h.failures[root] = f
+	}
+	_, err := serveTenant(t, h, "delta.sites.test", "index.html")
+	require.Error(t, err)
+	require.EqualValues(t, 2, requests.Load(), "tried again once the failure expires")
+
+	// closed tenants take their metrics with them
+	for _, tenant := range []string{"alpha", "beta"} {
+		body, err := serveTenant(t, h, tenant+".sites.test", "index.html")
+		require.NoError(t, err)
+		require.Equal(t, tenant, body)
+	}
+	families, err := ctx.GetMetricsRegistry().Gather()
+	require.NoError(t, err)
+	var roots []string
+	for _, mf := range families {
+		if mf.GetName() == "swim_vfs_stale" {
+			for _, m := range mf.GetMetric() {
+				roots = append(roots, m.GetLabel()[0].GetValue())
+			}
+		}
+	}
+	require.Equal(t, []string{srv.URL + "/beta.tar"}, roots)
+}
+
+func init() {
+	caddy.RegisterModule(new(Tenants))
+	caddy.RegisterModule(new(delayHandler))
+}
+
+// delayHandler stands in for the middleware between vfs_tenants and
+// file_server, giving other requests time to run in between
+type delayHandler struct{}
+
+func (*delayHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.vfs_test_delay",
+		New: func() caddy.Module { return new(delayHandler) },
+	}
+}
+
+func (*delayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	time.Sleep(time.Millisecond)
+	return next.ServeHTTP(w, r)
+}
+
+func TestTenantsEvictionUnderLoad(t *testing.T) {
+	// requests for more tenants than stay open, served by a real file_server
+	dir := t.TempDir()
+	for _, tenant := range []string{"alpha", "beta"} {
+		writeTenantTar(t, filepath.Join(dir, tenant+".tar"), tenant)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	config, err := json.Marshal(map[string]any{
+		"admin": map[string]any{"disabled": true, "config": map[string]any{"persist": false}},
+		"apps": map[string]any{"http": map[string]any{"servers": map[string]any{"tenants": map[string]any{
+			"listen":          []string{addr},
+			"automatic_https": map[string]any{"disable": true},
+			"routes": []any{map[string]any{"handle": []any{
+				map[string]any{
+					"handler":         "vfs_tenants",
+					"overlay":         map[string]any{"root": filepath.Join(dir, "{http.request.host.labels.2}.tar"), "cache_dir": t.TempDir()},
+					"max_filesystems": 1,
+				},
+				map[string]any{"handler": "vfs_test_delay"},
+				map[string]any{"handler": "file_server"},
+			}}},
+		}}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, caddy.Load(config, true))
+	defer caddy.Stop()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		tenant := []string{"alpha", "beta"}[i%2]
+		wg.Go(func() {
+			for range 50 {
+				r, err := http.NewRequest(http.MethodGet, "http://"+addr+"/index.html", nil)
+				require.NoError(t, err)
+				r.Host = tenant + ".sites.test"
+				resp, err := http.DefaultClient.Do(r)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, tenant, string(body))
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestTenantsCleanupDuringLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeTenantTar(t, filepath.Join(dir, "alpha.tar"), "alpha")
+	started, unblock := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-unblock
+		http.ServeFile(w, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := &Tenants{Overlay: &Overlay{Root: srv.URL + "/{http.request.host.labels.2}.tar", CacheDir: t.TempDir()}}
+	require.NoError(t, h.Provision(ctx))
+
+	errs := make(chan error)
+	go func() {
+		_, err := serveTenant(t, h, "alpha.sites.test", "index.html")
+		errs <- err
+	}()
+	<-started
+	require.NoError(t, h.Cleanup())
+	close(unblock)
+
+	// the load finishing after the cleanup closes what it opened
+	require.ErrorIs(t, <-errs, fs.ErrClosed)
+	require.Empty(t, h.tenants)
+	sum := sha256.Sum256([]byte(srv.URL + "/alpha.tar"))
+	_, ok := h.fileSystems.Get(tenantFsPrefix + hex.EncodeToString(sum[:8]) + "-1")
+	require.False(t, ok, "the closed tenant is unregistered")
+	_, err := serveTenant(t, h, "alpha.sites.test", "index.html")
+	require.ErrorIs(t, err, fs.ErrClosed)
+}
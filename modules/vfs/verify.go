@@ -0,0 +1,264 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jedisct1/go-minisign"
+	"golang.org/x/crypto/blake2b"
+)
+
+// maximum size of a detached signature file
+const maxSignatureSize = 64 * 1024
+
+// verifies reports whether any integrity options are set
+func (o *Overlay) verifies() bool {
+	return o.Sha256 != "" || o.PublicKey != ""
+}
+
+// verifier checks an archive against the configured digest and signature. the
+// raw archive is written to it as it is read.
+type verifier struct {
+	sha256 hash.Hash
+	want   []byte
+
+	blake2b hash.Hash
+	key     minisign.PublicKey
+	sig     minisign.Signature
+	// the signature file as fetched, kept with last known good copies
+	sigData []byte
+}
+
+// newVerifier parses the integrity options and fetches the signature of the
+// archive at u. it returns nil if no integrity options are set.
+func (o *Overlay) newVerifier(u *url.URL) (*verifier, error) {
+	if !o.verifies() {
+		return nil, nil
+	}
+	if o.PublicKey == "" {
+		return o.signedVerifier("", nil)
+	}
+	sigUrl, err := o.signatureUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	data, err := o.readSmall(sigUrl)
+	if err != nil {
+		return nil, fmt.Errorf("fetch signature %s: %w", sigUrl.Redacted(), err)
+	}
+	return o.signedVerifier(sigUrl.Redacted(), data)
+}
+
+// signedVerifier is newVerifier with the signature file already read from
+// sigName, which is only used in errors
+func (o *Overlay) signedVerifier(sigName string, sigData []byte) (*verifier, error) {
+	v := &verifier{}
+	if o.Sha256 != "" {
+		want, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(o.Sha256), "sha256:"))
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256: %s", o.Sha256)
+		}
+		v.sha256 = sha256.New()
+		v.want = want
+	}
+	if o.PublicKey != "" {
+		key, err := parsePublicKey(o.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := minisign.DecodeSignature(string(sigData))
+		if err != nil {
+			return nil, fmt.Errorf("decode signature %s: %w", sigName, err)
+		}
+		if sig.SignatureAlgorithm != [2]byte{'E', 'D'} {
+			return nil, fmt.Errorf("signature %s: only prehashed minisign signatures are supported, sign with minisign 0.8 or newer", sigName)
+		}
+		if sig.KeyId != key.KeyId {
+			return nil, fmt.Errorf("signature %s: made with key %X, expected key %X", sigName, sig.KeyId, key.KeyId)
+		}
+		v.blake2b, _ = blake2b.New512(nil)
+		v.key = key
+		v.sig = sig
+		v.sigData = sigData
+	}
+	return v, nil
+}
+
+// parsePublicKey accepts either the base64 key alone or the contents of a
+// minisign .pub file
+func parsePublicKey(s string) (minisign.PublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	key, err := minisign.NewPublicKey(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return key, fmt.Errorf("invalid public_key: %w", err)
+	}
+	if key.SignatureAlgorithm != [2]byte{'E', 'd'} {
+		return key, fmt.Errorf("invalid public_key: unsupported algorithm")
+	}
+	return key, nil
+}
+
+// signatureUrl returns where the signature of the archive at u is kept
+func (o *Overlay) signatureUrl(u *url.URL) (*url.URL, error) {
+	if o.Signature != "" {
+		return url.Parse(o.Signature)
+	}
+	sigUrl := *u
+	sigUrl.Path += ".minisig"
+	sigUrl.RawPath = ""
+	return &sigUrl, nil
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	if v.sha256 != nil {
+		v.sha256.Write(p)
+	}
+	if v.blake2b != nil {
+		v.blake2b.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks everything written so far against the digest and signature
+func (v *verifier) verify() error {
+	if v.sha256 != nil {
+		if got := v.sha256.Sum(nil); !bytes.Equal(got, v.want) {
+			return fmt.Errorf("archive sha256 mismatch: expected %x, got %x", v.want, got)
+		}
+	}
+	if v.blake2b != nil {
+		pk := ed25519.PublicKey(v.key.PublicKey[:])
+		if !ed25519.Verify(pk, v.blake2b.Sum(nil), v.sig.Signature[:]) {
+			return fmt.Errorf("archive signature verification failed: signature does not match archive")
+		}
+		comment, ok := strings.CutPrefix(v.sig.TrustedComment, "trusted comment: ")
+		if !ok || !ed25519.Verify(pk, append(v.sig.Signature[:], comment...), v.sig.GlobalSignature[:]) {
+			return fmt.Errorf("archive signature verification failed: invalid trusted comment")
+		}
+	}
+	return nil
+}
+
+// verifyReader checks a local archive read from r, which is left at its end.
+// v may be nil, in which case there is nothing to check.
+func (v *verifier) verifyReader(r io.Reader) error {
+	if v == nil {
+		return nil
+	}
+	if _, err := io.Copy(v, r); err != nil {
+		return err
+	}
+	return v.verify()
+}
+
+// readSmall reads a small object, such as a signature, from any of the
+// supported sources
+func (o *Overlay) readSmall(u *url.URL) ([]byte, error) {
+	ctx := context.Background()
+	var rc io.ReadCloser
+	switch u.Scheme {
+	case "file", "":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	case "http", "https":
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range o.Headers {
+			for _, vv := range v {
+				req.Header.Add(k, vv)
+			}
+		}
+		resp, err := o.doHttp(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to get network resource: %s", resp.Status)
+		}
+		rc = resp.Body
+	case "s3":
+		client, bucket, key, err := o.s3Client(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		oo, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		rc = oo.Body
+	case "gs":
+		client, obj, err := o.gcsObject(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		r, err := obj.NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rc = r
+	case "az", "azblob":
+		client, blobName, err := o.azureContainer(u)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.NewBlobClient(blobName).DownloadStream(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		rc = resp.Body
+	case "sftp":
+		client, closeFn, err := o.dialSftp(u)
+		if err != nil {
+			return nil, err
+		}
+		defer closeFn()
+		f, err := client.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	case "webdav", "webdavs":
+		resp, err := o.webdavClient(u).do(ctx, http.MethodGet, "", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to get network resource: %s", resp.Status)
+		}
+		rc = resp.Body
+	default:
+		return nil, fmt.Errorf("unrecognized scheme: %s", u.Scheme)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSignatureSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxSignatureSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,224 @@
+package vfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is an ed25519 key in minisign format
+type minisignKey struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+func newMinisignKey(t *testing.T) *minisignKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	k := &minisignKey{priv: priv, pub: pub}
+	_, err = rand.Read(k.id[:])
+	require.NoError(t, err)
+	return k
+}
+
+// publicKey returns the contents of a minisign .pub file
+func (k *minisignKey) publicKey() string {
+	bin := append([]byte("Ed"), k.id[:]...)
+	bin = append(bin, k.pub...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(bin) + "\n"
+}
+
+// sign returns a prehashed minisign signature of data
+func (k *minisignKey) sign(data []byte) string {
+	digest := blake2b.Sum512(data)
+	sig := ed25519.Sign(k.priv, digest[:])
+	comment := "timestamp:1700000000"
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), comment...))
+
+	bin := append([]byte("ED"), k.id[:]...)
+	bin = append(bin, sig...)
+	return "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(bin) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
+func TestOverlaySha256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "hello"})
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	for _, root := range []string{path, srv.URL + "/site.tar.gz"} {
+		t.Run(root, func(t *testing.T) {
+			o := &vfs.Overlay{Root: root, CacheDir: t.TempDir(), Sha256: "sha256:" + hex.EncodeToString(sum[:])}
+			fs, cleanup, err := o.OpenFilesystem()
+			require.NoError(t, err)
+			defer cleanup()
+			body, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(body))
+
+			o = &vfs.Overlay{Root: root, CacheDir: t.TempDir(), Sha256: hex.EncodeToString(make([]byte, 32))}
+			_, _, err = o.OpenFilesystem()
+			require.ErrorContains(t, err, "sha256 mismatch")
+		})
+	}
+}
+
+func TestOverlaySha256MismatchNotSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "hello"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, path)
+	}))
+	defer srv.Close()
+
+	lkg := t.TempDir()
+	o := &vfs.Overlay{
+		Root:          srv.URL + "/site.tar.gz",
+		CacheDir:      t.TempDir(),
+		LastKnownGood: lkg,
+		Sha256:        hex.EncodeToString(make([]byte, 32)),
+	}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "sha256 mismatch")
+
+	entries, err := os.ReadDir(lkg)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestOverlaySignature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "signed"})
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	key := newMinisignKey(t)
+	other := newMinisignKey(t)
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		archive []byte
+		sig     string
+		key     *minisignKey
+		wantErr string
+	}{
+		{name: "valid", archive: data, sig: key.sign(data), key: key},
+		{name: "tampered archive", archive: tampered, sig: key.sign(data), key: key, wantErr: "signature does not match archive"},
+		{name: "wrong key", archive: data, sig: other.sign(data), key: key, wantErr: "expected key"},
+		{name: "missing signature", archive: data, key: key, wantErr: "fetch signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/site.tar.gz":
+					w.Write(tt.archive)
+				case "/site.tar.gz.minisig":
+					if tt.sig == "" {
+						http.NotFound(w, r)
+						return
+					}
+					w.Write([]byte(tt.sig))
+				}
+			}))
+			defer srv.Close()
+
+			o := &vfs.Overlay{Root: srv.URL + "/site.tar.gz", CacheDir: t.TempDir(), PublicKey: tt.key.publicKey()}
+			fs, cleanup, err := o.OpenFilesystem()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer cleanup()
+			body, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "signed", string(body))
+		})
+	}
+}
+
+func TestOverlayVerifyRequiresArchive(t *testing.T) {
+	o := &vfs.Overlay{Root: t.TempDir(), Sha256: hex.EncodeToString(make([]byte, 32))}
+	_, _, err := o.OpenFilesystem()
+	require.ErrorContains(t, err, "requires an archive")
+
+	o = &vfs.Overlay{Root: "https://example.com/site.zip", Lazy: true, Sha256: hex.EncodeToString(make([]byte, 32))}
+	_, _, err = o.OpenFilesystem()
+	require.ErrorContains(t, err, "not supported in lazy mode")
+}
+
+func TestOverlayLastKnownGoodVerified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.tar.gz")
+	writeTar(t, path, map[string]string{"index.html": "signed"})
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	key := newMinisignKey(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/site.tar.gz":
+			w.Write(data)
+		case "/site.tar.gz.minisig":
+			w.Write([]byte(key.sign(data)))
+		}
+	}))
+	defer srv.Close()
+
+	lkg := t.TempDir()
+	overlay := func(key *minisignKey) *vfs.Overlay {
+		return &vfs.Overlay{Root: srv.URL + "/site.tar.gz", CacheDir: t.TempDir(), LastKnownGood: lkg, PublicKey: key.publicKey()}
+	}
+	_, cleanup, err := overlay(key).OpenFilesystem()
+	require.NoError(t, err)
+	cleanup()
+
+	fs, cleanup, err := overlay(key).OpenLastKnownGood()
+	require.NoError(t, err)
+	body, err := afero.ReadFile(fs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "signed", string(body))
+	cleanup()
+
+	// a copy saved under other pins is not served
+	_, _, err = overlay(newMinisignKey(t)).OpenLastKnownGood()
+	require.ErrorContains(t, err, "expected key")
+	o := overlay(key)
+	o.Sha256 = hex.EncodeToString(make([]byte, 32))
+	_, _, err = o.OpenLastKnownGood()
+	require.ErrorContains(t, err, "sha256 mismatch")
+
+	// and neither is one changed on disk
+	copies, err := filepath.Glob(filepath.Join(lkg, "lkg-*[^g]"))
+	require.NoError(t, err)
+	require.Len(t, copies, 1)
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(copies[0], tampered, 0o600))
+	_, _, err = overlay(key).OpenLastKnownGood()
+	require.ErrorContains(t, err, "signature does not match archive")
+}
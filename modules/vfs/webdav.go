@@ -0,0 +1,275 @@
+package vfs
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// webdavClient talks to the http server behind a webdav:// or webdavs:// url
+type webdavClient struct {
+	o        *Overlay
+	base     *url.URL
+	user     string
+	password string
+	header   http.Header
+}
+
+// webdavClient maps the url onto http(s). basic auth credentials may be
+// given in the url, otherwise they are taken from WEBDAV_USERNAME and
+// WEBDAV_PASSWORD. any other headers are sent with every request, as they
+// are for http(s) sources.
+func (o *Overlay) webdavClient(u *url.URL) *webdavClient {
+	base := *u
+	base.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	base.User = nil
+	base.RawQuery, base.Fragment = "", ""
+
+	c := &webdavClient{o: o, base: &base, header: make(http.Header)}
+	for k, v := range o.Headers {
+		if !strings.HasPrefix(strings.ToUpper(k), "WEBDAV_") {
+			c.header[k] = v
+		}
+	}
+	c.user = u.User.Username()
+	c.password, _ = u.User.Password()
+	if c.user == "" {
+		c.user = o.headerOrEnv("WEBDAV_USERNAME")
+		c.password = o.headerOrEnv("WEBDAV_PASSWORD")
+	}
+	return c
+}
+
+func (c *webdavClient) url(key string) string {
+	if key == "" {
+		return c.base.String()
+	}
+	return c.base.JoinPath(key).String()
+}
+
+func (c *webdavClient) do(ctx context.Context, method, key string, h http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return c.o.doHttp(req)
+}
+
+// davMultistatus is the body of a PROPFIND response
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// davEntry is a resource in a PROPFIND response
+type davEntry struct {
+	path string // unescaped and cleaned
+	info *objectInfo
+}
+
+// propfind lists key (depth 0) or key and its children (depth 1). a missing
+// resource is reported as os.ErrNotExist.
+func (c *webdavClient) propfind(ctx context.Context, key string, depth int) ([]davEntry, error) {
+	h := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := c.do(ctx, "PROPFIND", key, h, strings.NewReader(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	default:
+		return nil, fmt.Errorf("webdav: propfind %s: %s", c.url(key), resp.Status)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav: propfind %s: %w", c.url(key), err)
+	}
+	entries := make([]davEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p := path.Clean(href.Path)
+		info := &objectInfo{name: path.Base(p)}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			info.dir = ps.Prop.ResourceType.Collection != nil
+			info.size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			info.modTime, _ = http.ParseTime(ps.Prop.LastModified)
+		}
+		entries = append(entries, davEntry{path: p, info: info})
+	}
+	return entries, nil
+}
+
+func (o *Overlay) openWebdav(u *url.URL) (afero.Fs, func(), error) {
+	c := o.webdavClient(u)
+	resp, err := c.do(context.Background(), http.MethodGet, "", nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("webdav: read %s: %s", u.Redacted(), resp.Status)
+	}
+	return o.spool(u, resp.Header, resp.Body)
+}
+
+// versionWebdav returns the ETag of the archive, falling back to
+// Last-Modified
+func (o *Overlay) versionWebdav(u *url.URL) (string, error) {
+	resp, err := o.webdavClient(u).do(context.Background(), http.MethodHead, "", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("webdav: stat %s: %s", u.Redacted(), resp.Status)
+	}
+	return headerVersion(resp.Header), nil
+}
+
+// webdavStore serves the files under a collection of a webdav server
+type webdavStore struct {
+	client *webdavClient
+}
+
+// openWebdavPrefix serves a remote collection as a live filesystem
+func (o *Overlay) openWebdavPrefix(u *url.URL) (afero.Fs, func(), error) {
+	store := &webdavStore{client: o.webdavClient(u)}
+	// fail provisioning early on bad credentials or a missing collection
+	ok, err := store.hasPrefix(context.Background(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("webdav: %s is not a collection", u.Redacted())
+	}
+	return newBucketFs(store, time.Duration(o.MetadataTTL)), nil, nil
+}
+
+func (s *webdavStore) head(ctx context.Context, key string) (*objectInfo, error) {
+	entries, err := s.client.propfind(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].info.dir {
+		// collections are found via hasPrefix
+		return nil, os.ErrNotExist
+	}
+	info := entries[0].info
+	info.name = path.Base(key)
+	return info, nil
+}
+
+func (s *webdavStore) hasPrefix(ctx context.Context, dir string) (bool, error) {
+	entries, err := s.client.propfind(ctx, dir, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(entries) > 0 && entries[0].info.dir, nil
+}
+
+func (s *webdavStore) list(ctx context.Context, dir string) ([]*objectInfo, error) {
+	all, err := s.client.propfind(ctx, dir, 1)
+	if err != nil {
+		return nil, err
+	}
+	self := path.Join("/", s.client.base.Path, dir)
+	var entries []*objectInfo
+	for _, e := range all {
+		if e.path == self || path.Dir(e.path) != self {
+			// the collection itself, or something the server should not
+			// have returned at depth 1
+			continue
+		}
+		entries = append(entries, e.info)
+	}
+	slices.SortFunc(entries, func(a, b *objectInfo) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+func (s *webdavStore) read(ctx context.Context, key string, off, length int64) (io.ReadCloser, error) {
+	h := http.Header{}
+	switch {
+	case length >= 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	case off > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := s.client.do(ctx, http.MethodGet, key, h, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK && off == 0:
+		if length < 0 {
+			return resp.Body, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, length), resp.Body}, nil
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusOK:
+		return nil, fmt.Errorf("server does not support range requests")
+	}
+	return nil, fmt.Errorf("webdav: read %s: %s", s.client.url(key), resp.Status)
+}
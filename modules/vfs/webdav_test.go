@@ -0,0 +1,113 @@
+package vfs_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gfx-labs/swim/modules/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newWebdavServer serves dir over webdav to the user deploy with the
+// password hunter2
+func newWebdavServer(t *testing.T, dir string) string {
+	dav := &webdav.Handler{FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "deploy" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestOverlayWebdav(t *testing.T) {
+	dir := t.TempDir()
+	writeTar(t, filepath.Join(dir, "site.tar.gz"), map[string]string{"index.html": "from webdav"})
+	addr := newWebdavServer(t, dir)
+
+	t.Run("archive", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("WEBDAV_USERNAME", "deploy")
+		h.Set("WEBDAV_PASSWORD", "hunter2")
+		for _, root := range []string{
+			"webdav://" + addr + "/site.tar.gz",
+			"webdav://deploy:hunter2@" + addr + "/site.tar.gz",
+		} {
+			o := &vfs.Overlay{Root: root, Headers: h, CacheDir: t.TempDir()}
+			require.Equal(t, "from webdav", readFile(t, o, "index.html"))
+			version, err := o.Version()
+			require.NoError(t, err)
+			require.NotEmpty(t, version)
+		}
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		tarball, err := os.ReadFile(filepath.Join(dir, "site.tar.gz"))
+		require.NoError(t, err)
+		key := newMinisignKey(t)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "site.tar.gz.minisig"), []byte(key.sign(tarball)), 0o644))
+		o := &vfs.Overlay{Root: "webdav://deploy:hunter2@" + addr + "/site.tar.gz", CacheDir: t.TempDir(), PublicKey: key.publicKey()}
+		require.Equal(t, "from webdav", readFile(t, o, "index.html"))
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		o := &vfs.Overlay{Root: "webdav://" + addr + "/site.tar.gz"}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "401")
+	})
+
+	t.Run("collection", func(t *testing.T) {
+		site := filepath.Join(dir, "my dist")
+		require.NoError(t, os.MkdirAll(filepath.Join(site, "assets"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>home</h1>"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(site, "assets", "app.js"), []byte("console.log(1)"), 0o644))
+
+		o := &vfs.Overlay{Root: "webdav://deploy:hunter2@" + addr + "/my%20dist/", MetadataTTL: caddy.Duration(time.Nanosecond)}
+		afs, cleanup, err := o.OpenFilesystem()
+		require.NoError(t, err)
+		defer cleanup()
+
+		body, err := afero.ReadFile(afs, "assets/app.js")
+		require.NoError(t, err)
+		require.Equal(t, "console.log(1)", string(body))
+
+		f, err := afs.Open("index.html")
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = f.ReadAt(buf, 4)
+		require.NoError(t, err)
+		require.Equal(t, "home", string(buf))
+		f.Close()
+
+		infos, err := afero.ReadDir(afs, "/")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "assets", infos[0].Name())
+		require.True(t, infos[0].IsDir())
+		require.Equal(t, "index.html", infos[1].Name())
+		require.EqualValues(t, len("<h1>home</h1>"), infos[1].Size())
+
+		_, err = afs.Stat("site.tar.gz")
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		version, err := o.Version()
+		require.NoError(t, err)
+		require.Empty(t, version)
+	})
+
+	t.Run("missing collection", func(t *testing.T) {
+		o := &vfs.Overlay{Root: "webdav://deploy:hunter2@" + addr + "/nope/"}
+		_, _, err := o.OpenFilesystem()
+		require.ErrorContains(t, err, "is not a collection")
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
@@ -13,21 +14,61 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 	"github.com/spf13/afero/tarfs"
 	"github.com/spf13/afero/zipfs"
+	"github.com/ulikunitz/xz"
 )
 
+// FiletypeFromName guesses the archive type from the extension of filename.
+// it returns an empty string if the name has no known archive extension.
 func FiletypeFromName(filename string) (guess string) {
 	switch {
 	case strings.HasSuffix(filename, ".zip"):
 		return ".zip"
 	case strings.HasSuffix(filename, ".tar.gz") || strings.HasSuffix(filename, ".tgz"):
 		return ".tar.gz"
+	case strings.HasSuffix(filename, ".tar.zst") || strings.HasSuffix(filename, ".tzst"):
+		return ".tar.zst"
+	case strings.HasSuffix(filename, ".tar.xz") || strings.HasSuffix(filename, ".txz"):
+		return ".tar.xz"
+	case strings.HasSuffix(filename, ".tar.bz2") || strings.HasSuffix(filename, ".tbz2") || strings.HasSuffix(filename, ".tbz"):
+		return ".tar.bz2"
 	case strings.HasSuffix(filename, ".tar"):
 		return ".tar"
 	}
-	return ".tar"
+	return ""
+}
+
+// tarReader returns the uncompressed tar stream for any of the tar file
+// types. the returned close function releases the decompressor.
+func tarReader(ft string, r io.Reader) (tarball io.Reader, closeFn func(), err error) {
+	switch ft {
+	case ".tar":
+		return r, func() {}, nil
+	case ".tar.gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case ".tar.zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case ".tar.xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, func() {}, nil
+	case ".tar.bz2":
+		return bzip2.NewReader(r), func() {}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported file type: %s", ft)
 }
 
 func FilesystemFromReader(ft string, r io.Reader) (rootFs afero.Fs, err error) {
@@ -35,28 +76,19 @@ func FilesystemFromReader(ft string, r io.Reader) (rootFs afero.Fs, err error) {
 	if err != nil {
 		return nil, err
 	}
-	switch ft {
-	// TODO: .xz, .zlib
-	case ".zip":
+	if ft == ".zip" {
 		ziprd, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
 		if err != nil {
 			return nil, err
 		}
-		rootFs = zipfs.New(ziprd)
-	case ".tar.gz":
-		tarball, err := gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			return nil, err
-		}
-		tarrd := tar.NewReader(tarball)
-		rootFs = tarfs.New(tarrd)
-	case ".tar":
-		tarrd := tar.NewReader(bytes.NewReader(body))
-		rootFs = tarfs.New(tarrd)
-	default:
-		return nil, fmt.Errorf("unsupported file type: %s", ft)
+		return zipfs.New(ziprd), nil
+	}
+	tarball, closeFn, err := tarReader(ft, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
-	return rootFs, nil
+	defer closeFn()
+	return tarfs.New(tar.NewReader(tarball)), nil
 }
 
 // OpenZipFs opens an existing zip file on disk and returns a zip-backed
@@ -67,16 +99,24 @@ func OpenZipFs(path string) (rootFs afero.Fs, sizeBytes int64, cleanup func(), e
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	info, err := f.Stat()
+	rootFs, sizeBytes, cleanup, err = OpenZipFile(f)
 	if err != nil {
 		f.Close()
+	}
+	return rootFs, sizeBytes, cleanup, err
+}
+
+// OpenZipFile is OpenZipFs for a file that is already open. on success the
+// returned cleanup function closes f, on error closing it is up to the caller.
+func OpenZipFile(f *os.File) (rootFs afero.Fs, sizeBytes int64, cleanup func(), err error) {
+	info, err := f.Stat()
+	if err != nil {
 		return nil, 0, nil, err
 	}
 	n := info.Size()
 
 	ziprd, err := zip.NewReader(f, n)
 	if err != nil {
-		f.Close()
 		return nil, 0, nil, fmt.Errorf("open zip: %w", err)
 	}
 
@@ -84,6 +124,104 @@ func OpenZipFs(path string) (rootFs afero.Fs, sizeBytes int64, cleanup func(), e
 	return zipfs.New(ziprd), n, cleanup, nil
 }
 
+// OpenTarFs opens an existing uncompressed tar file on disk and returns an
+// afero.Fs that serves files via random access. only the entry index is kept
+// in memory. the returned cleanup function closes the file handle.
+func OpenTarFs(path string) (rootFs afero.Fs, sizeBytes int64, cleanup func(), err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	rootFs, sizeBytes, cleanup, err = OpenTarFile(f)
+	if err != nil {
+		f.Close()
+	}
+	return rootFs, sizeBytes, cleanup, err
+}
+
+// OpenTarFile is OpenTarFs for a file that is already open. the index is
+// read from the start of the file whatever its offset. on success the
+// returned cleanup function closes f, on error closing it is up to the caller.
+func OpenTarFile(f *os.File) (rootFs afero.Fs, sizeBytes int64, cleanup func(), err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+
+	tfs, err := newTarIndexFs(f, f)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("open tar: %w", err)
+	}
+
+	cleanup = func() { f.Close() }
+	return tfs, info.Size(), cleanup, nil
+}
+
+// SpoolFs writes the archive read from r into a new file in dir and opens it
+// from disk. zips are stored as-is and served via random access, tarballs are
+// decompressed while spooling and indexed by offset. the returned cleanup
+// function closes and removes the spooled file.
+func SpoolFs(ft string, r io.Reader, dir string) (rootFs afero.Fs, sizeBytes int64, cleanup func(), err error) {
+	path, err := SpoolFile(ft, r, dir)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	rootFs, sizeBytes, fsCleanup, err := OpenSpooledFs(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, 0, nil, err
+	}
+
+	cleanup = func() {
+		fsCleanup()
+		os.Remove(path)
+	}
+	return rootFs, sizeBytes, cleanup, nil
+}
+
+// SpoolFile writes the archive read from r into a new file in dir and returns
+// its path. tarballs are stored decompressed, so the file is always a .zip or
+// a .tar, named with that extension.
+func SpoolFile(ft string, r io.Reader, dir string) (path string, err error) {
+	ext := ".zip"
+	if ft != ".zip" {
+		tarball, closeFn, err := tarReader(ft, r)
+		if err != nil {
+			return "", err
+		}
+		defer closeFn()
+		r = tarball
+		ext = ".tar"
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("create spool dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "archive-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("create file: %w", err)
+	}
+	path = f.Name()
+	f.Close()
+
+	if err := downloadToFile(r, 0, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// OpenSpooledFs opens a file written by SpoolFile, picking the format from
+// its extension. the returned cleanup function closes the file handle.
+func OpenSpooledFs(path string) (rootFs afero.Fs, sizeBytes int64, cleanup func(), err error) {
+	if strings.HasSuffix(path, ".zip") {
+		return OpenZipFs(path)
+	}
+	return OpenTarFs(path)
+}
+
 // DownloadZipFs downloads the contents of r to a file at path, computing
 // the sha256 digest as it goes, then opens the result as a zip-backed afero.Fs.
 // parent directories are created automatically. if the stream exceeds maxSize
@@ -113,7 +251,8 @@ func DownloadZipFs(r io.Reader, maxSize int64, path string) (rootFs afero.Fs, si
 	return rootFs, sizeBytes, digest, cleanup, nil
 }
 
-// downloadToFile writes r to path, enforcing maxSize. creates parent dirs.
+// downloadToFile writes r to path, enforcing maxSize unless it is zero.
+// creates parent dirs.
 func downloadToFile(r io.Reader, maxSize int64, path string) error {
 	os.MkdirAll(filepath.Dir(path), 0o700)
 	f, err := os.Create(path)
@@ -121,8 +260,10 @@ func downloadToFile(r io.Reader, maxSize int64, path string) error {
 		return fmt.Errorf("create file: %w", err)
 	}
 
-	limited := io.LimitReader(r, maxSize+1)
-	n, err := io.Copy(f, limited)
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(f, r)
 	if closeErr := f.Close(); closeErr != nil && err == nil {
 		err = closeErr
 	}
@@ -130,7 +271,7 @@ func downloadToFile(r io.Reader, maxSize int64, path string) error {
 		os.Remove(path)
 		return fmt.Errorf("write file: %w", err)
 	}
-	if n > maxSize {
+	if maxSize > 0 && n > maxSize {
 		os.Remove(path)
 		return fmt.Errorf("archive exceeds max size %d", maxSize)
 	}
@@ -0,0 +1,271 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+type testEntry struct {
+	name string
+	body string
+	link string // symlink target, if set
+	dir  bool
+}
+
+var testEntries = []testEntry{
+	{name: "index.html", body: "<h1>home</h1>"},
+	{name: "assets/", dir: true},
+	{name: "assets/app.js", body: "console.log(1)"},
+	// parent directory is never listed in the archive
+	{name: "docs/guide/intro.md", body: "# intro"},
+	{name: "latest.md", link: "docs/guide/intro.md"},
+}
+
+func buildTar(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body))}
+		switch {
+		case e.dir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0o755
+		case e.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.link
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if e.body != "" {
+			_, err := tw.Write([]byte(e.body))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(buildTar(t, entries))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func buildTarZst(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = zw.Write(buildTar(t, entries))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func buildTarXz(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = xw.Write(buildTar(t, entries))
+	require.NoError(t, err)
+	require.NoError(t, xw.Close())
+	return buf.Bytes()
+}
+
+// the standard library has no bzip2 writer, so this one is a fixture
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	require.NoError(t, err)
+	return data
+}
+
+func buildZip(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		if e.dir || e.link != "" {
+			continue
+		}
+		w, err := zw.Create(e.name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestSpoolFs(t *testing.T) {
+	tests := []struct {
+		name string
+		ft   string
+		data []byte
+		// zipfs only knows directories that have their own entry
+		impliedDirs bool
+	}{
+		{name: "tar", ft: ".tar", data: buildTar(t, testEntries), impliedDirs: true},
+		{name: "tar.gz", ft: ".tar.gz", data: buildTarGz(t, testEntries), impliedDirs: true},
+		{name: "tar.zst", ft: ".tar.zst", data: buildTarZst(t, testEntries), impliedDirs: true},
+		{name: "tar.xz", ft: ".tar.xz", data: buildTarXz(t, testEntries), impliedDirs: true},
+		{name: "tar.bz2", ft: ".tar.bz2", data: readFixture(t, "site.tar.bz2"), impliedDirs: true},
+		{name: "zip", ft: ".zip", data: buildZip(t, testEntries)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs, _, cleanup, err := SpoolFs(tt.ft, bytes.NewReader(tt.data), dir)
+			require.NoError(t, err)
+
+			data, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "<h1>home</h1>", string(data))
+
+			data, err = afero.ReadFile(fs, "/docs/guide/intro.md")
+			require.NoError(t, err)
+			require.Equal(t, "# intro", string(data))
+
+			if tt.impliedDirs {
+				info, err := fs.Stat("docs/guide")
+				require.NoError(t, err)
+				require.True(t, info.IsDir())
+			}
+
+			spooled, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, spooled, 1)
+
+			cleanup()
+			spooled, err = os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, spooled)
+		})
+	}
+}
+
+func TestFilesystemFromReader(t *testing.T) {
+	tests := []struct {
+		name string
+		ft   string
+		data []byte
+	}{
+		{name: "tar", ft: ".tar", data: buildTar(t, testEntries)},
+		{name: "tar.gz", ft: ".tar.gz", data: buildTarGz(t, testEntries)},
+		{name: "tar.zst", ft: ".tar.zst", data: buildTarZst(t, testEntries)},
+		{name: "tar.xz", ft: ".tar.xz", data: buildTarXz(t, testEntries)},
+		{name: "tar.bz2", ft: ".tar.bz2", data: readFixture(t, "site.tar.bz2")},
+		{name: "zip", ft: ".zip", data: buildZip(t, testEntries)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := FilesystemFromReader(tt.ft, bytes.NewReader(tt.data))
+			require.NoError(t, err)
+			data, err := afero.ReadFile(fs, "index.html")
+			require.NoError(t, err)
+			require.Equal(t, "<h1>home</h1>", string(data))
+		})
+	}
+}
+
+func TestFiletypeFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"site.zip", ".zip"},
+		{"site.tar.gz", ".tar.gz"},
+		{"site.tgz", ".tar.gz"},
+		{"site.tar.zst", ".tar.zst"},
+		{"site.tzst", ".tar.zst"},
+		{"site.tar.xz", ".tar.xz"},
+		{"site.txz", ".tar.xz"},
+		{"site.tar.bz2", ".tar.bz2"},
+		{"site.tbz2", ".tar.bz2"},
+		{"site.tbz", ".tar.bz2"},
+		{"site.tar", ".tar"},
+		{"https://cdn.example.com/site.tar.zst", ".tar.zst"},
+		{"site.html", ""},
+		{"https://example.com/download?id=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, FiletypeFromName(tt.name))
+		})
+	}
+}
+
+func TestSpoolFsUnsupported(t *testing.T) {
+	_, _, _, err := SpoolFs(".rar", bytes.NewReader(nil), t.TempDir())
+	require.Error(t, err)
+}
+
+func TestTarIndexFs(t *testing.T) {
+	path := t.TempDir() + "/site.tar"
+	require.NoError(t, os.WriteFile(path, buildTar(t, testEntries), 0o644))
+
+	fs, size, cleanup, err := OpenTarFs(path)
+	require.NoError(t, err)
+	defer cleanup()
+	require.Positive(t, size)
+
+	t.Run("root listing", func(t *testing.T) {
+		f, err := fs.Open("/")
+		require.NoError(t, err)
+		defer f.Close()
+		names, err := f.Readdirnames(-1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"assets", "docs", "index.html", "latest.md"}, names)
+	})
+
+	t.Run("paged listing", func(t *testing.T) {
+		f, err := fs.Open("/")
+		require.NoError(t, err)
+		defer f.Close()
+		first, err := f.Readdir(3)
+		require.NoError(t, err)
+		require.Len(t, first, 3)
+		rest, err := f.Readdir(3)
+		require.NoError(t, err)
+		require.Len(t, rest, 1)
+		_, err = f.Readdir(3)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("symlink resolves to target", func(t *testing.T) {
+		data, err := afero.ReadFile(fs, "latest.md")
+		require.NoError(t, err)
+		require.Equal(t, "# intro", string(data))
+	})
+
+	t.Run("seek and read", func(t *testing.T) {
+		f, err := fs.Open("assets/app.js")
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Seek(8, io.SeekStart)
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "log(1)", string(data))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := fs.Open("nope.txt")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/zipfs"
+	"golang.org/x/sync/singleflight"
+)
+
+// size of the blocks fetched from the remote object
+const defaultBlockSize = 1024 * 1024 // 1MB
+
+// RangeFetcher returns length bytes of a remote object starting at off
+type RangeFetcher func(off, length int64) (io.ReadCloser, error)
+
+// blockCache is an io.ReaderAt over a remote object. the object is fetched in
+// fixed size blocks on first access, and blocks are kept in a sparse file on
+// disk so every byte is downloaded at most once.
+type blockCache struct {
+	fetch     RangeFetcher
+	size      int64
+	blockSize int64
+	file      *os.File
+
+	mu      sync.RWMutex
+	present []bool
+	group   singleflight.Group
+}
+
+func newBlockCache(fetch RangeFetcher, size, blockSize int64, dir string) (*blockCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "blocks-*")
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+	return &blockCache{
+		fetch:     fetch,
+		size:      size,
+		blockSize: blockSize,
+		file:      f,
+		present:   make([]bool, (size+blockSize-1)/blockSize),
+	}, nil
+}
+
+func (c *blockCache) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > c.size {
+		end = c.size
+	}
+	if err := c.ensure(off/c.blockSize, (end-1)/c.blockSize); err != nil {
+		return 0, err
+	}
+	n, err := c.file.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ensure fetches every missing block between first and last, inclusive.
+// consecutive missing blocks are fetched with a single request.
+func (c *blockCache) ensure(first, last int64) error {
+	c.mu.RLock()
+	var runs [][2]int64
+	for b := first; b <= last; b++ {
+		if c.present[b] {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1][1] == b-1 {
+			runs[n-1][1] = b
+		} else {
+			runs = append(runs, [2]int64{b, b})
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, run := range runs {
+		key := fmt.Sprintf("%d-%d", run[0], run[1])
+		_, err, _ := c.group.Do(key, func() (any, error) {
+			return nil, c.fetchRun(run[0], run[1])
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *blockCache) fetchRun(first, last int64) error {
+	off := first * c.blockSize
+	end := (last + 1) * c.blockSize
+	if end > c.size {
+		end = c.size
+	}
+	rc, err := c.fetch(off, end-off)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.NewOffsetWriter(c.file, off), io.LimitReader(rc, end-off))
+	if err != nil {
+		return fmt.Errorf("fetch range %d-%d: %w", off, end-1, err)
+	}
+	if n != end-off {
+		return fmt.Errorf("fetch range %d-%d: short read of %d bytes", off, end-1, n)
+	}
+	c.mu.Lock()
+	for b := first; b <= last; b++ {
+		c.present[b] = true
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *blockCache) close() {
+	c.file.Close()
+	os.Remove(c.file.Name())
+}
+
+// OpenRangeZipFs opens a remote zip of the given size without downloading
+// it. the central directory and individual entries are fetched on demand
+// through fetch, and cached in a sparse file in dir. the returned cleanup
+// function removes the cache file.
+func OpenRangeZipFs(fetch RangeFetcher, size int64, dir string) (rootFs afero.Fs, cleanup func(), err error) {
+	return openRangeZipFs(fetch, size, defaultBlockSize, dir)
+}
+
+func openRangeZipFs(fetch RangeFetcher, size, blockSize int64, dir string) (afero.Fs, func(), error) {
+	c, err := newBlockCache(fetch, size, blockSize, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	ziprd, err := zip.NewReader(c, size)
+	if err != nil {
+		c.close()
+		return nil, nil, fmt.Errorf("open zip: %w", err)
+	}
+	return zipfs.New(ziprd), c.close, nil
+}
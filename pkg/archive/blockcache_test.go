@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFetcher serves ranges of data and records how many bytes were fetched
+type countingFetcher struct {
+	data    []byte
+	fetched atomic.Int64
+	calls   atomic.Int64
+}
+
+func (f *countingFetcher) fetch(off, length int64) (io.ReadCloser, error) {
+	f.calls.Add(1)
+	f.fetched.Add(length)
+	return io.NopCloser(bytes.NewReader(f.data[off : off+length])), nil
+}
+
+func TestBlockCacheReadAt(t *testing.T) {
+	data := make([]byte, 10_000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	f := &countingFetcher{data: data}
+	c, err := newBlockCache(f.fetch, int64(len(data)), 1024, t.TempDir())
+	require.NoError(t, err)
+	defer c.close()
+
+	tests := []struct {
+		name string
+		off  int64
+		n    int
+	}{
+		{"within one block", 10, 100},
+		{"across blocks", 1000, 3000},
+		{"last partial block", 9500, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.n)
+			n, err := c.ReadAt(buf, tt.off)
+			require.NoError(t, err)
+			require.Equal(t, tt.n, n)
+			require.Equal(t, data[tt.off:tt.off+int64(tt.n)], buf)
+		})
+	}
+
+	t.Run("past the end", func(t *testing.T) {
+		buf := make([]byte, 100)
+		n, err := c.ReadAt(buf, 9950)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 50, n)
+		require.Equal(t, data[9950:], buf[:n])
+	})
+
+	t.Run("cached blocks are not refetched", func(t *testing.T) {
+		before := f.calls.Load()
+		buf := make([]byte, 3000)
+		_, err := c.ReadAt(buf, 1000)
+		require.NoError(t, err)
+		require.Equal(t, before, f.calls.Load())
+	})
+}
+
+func TestBlockCacheConcurrentReads(t *testing.T) {
+	data := make([]byte, 64*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	f := &countingFetcher{data: data}
+	c, err := newBlockCache(f.fetch, int64(len(data)), 4096, t.TempDir())
+	require.NoError(t, err)
+	defer c.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(data))
+			_, err := c.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, data, buf)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBlockCacheFetchError(t *testing.T) {
+	fetch := func(off, length int64) (io.ReadCloser, error) {
+		return nil, errors.New("boom")
+	}
+	c, err := newBlockCache(fetch, 100, 10, t.TempDir())
+	require.NoError(t, err)
+	defer c.close()
+
+	_, err = c.ReadAt(make([]byte, 10), 0)
+	require.ErrorContains(t, err, "boom")
+}
+
+func TestOpenRangeZipFs(t *testing.T) {
+	// a large incompressible entry next to a small one, so reading the small
+	// one must not pull the whole archive
+	big := make([]byte, 512*1024)
+	_, err := rand.Read(big)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "big.bin", Method: zip.Store})
+	require.NoError(t, err)
+	_, err = w.Write(big)
+	require.NoError(t, err)
+	w, err = zw.Create("index.html")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("<h1>lazy</h1>"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	dir := t.TempDir()
+	f := &countingFetcher{data: buf.Bytes()}
+	fs, cleanup, err := openRangeZipFs(f.fetch, int64(buf.Len()), 4096, dir)
+	require.NoError(t, err)
+
+	data, err := afero.ReadFile(fs, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "<h1>lazy</h1>", string(data))
+	require.Less(t, f.fetched.Load(), int64(len(big)/4))
+
+	cleanup()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestOpenRangeZipFsNotZip(t *testing.T) {
+	f := &countingFetcher{data: buildTar(t, testEntries)}
+	_, _, err := openRangeZipFs(f.fetch, int64(len(f.data)), 4096, t.TempDir())
+	require.ErrorContains(t, err, "open zip")
+}
@@ -0,0 +1,105 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// number of bytes needed to recognize every supported format. the tar magic
+// sits at offset 257 of the first header block.
+const sniffLen = 512
+
+// ErrUnknownFiletype is returned when a stream is not a supported archive
+var ErrUnknownFiletype = errors.New("unable to detect archive type")
+
+// contentTypes maps archive mime types to file types. generic types such as
+// application/octet-stream are deliberately absent so they fall through to
+// content sniffing.
+var contentTypes = map[string]string{
+	"application/zip":              ".zip",
+	"application/x-zip":            ".zip",
+	"application/x-zip-compressed": ".zip",
+	"application/gzip":             ".tar.gz",
+	"application/x-gzip":           ".tar.gz",
+	"application/x-gtar":           ".tar.gz",
+	"application/x-tgz":            ".tar.gz",
+	"application/zstd":             ".tar.zst",
+	"application/x-zstd":           ".tar.zst",
+	"application/x-xz":             ".tar.xz",
+	"application/x-bzip2":          ".tar.bz2",
+	"application/x-tar":            ".tar",
+
+	// oci and docker image layers
+	"application/vnd.oci.image.layer.v1.tar":            ".tar",
+	"application/vnd.oci.image.layer.v1.tar+gzip":       ".tar.gz",
+	"application/vnd.oci.image.layer.v1.tar+zstd":       ".tar.zst",
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": ".tar.gz",
+}
+
+// FiletypeFromHeaders guesses the archive type from the filename in a
+// Content-Disposition header, falling back to the Content-Type. it returns an
+// empty string if neither identifies an archive.
+func FiletypeFromHeaders(h http.Header) string {
+	if cd := h.Get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil {
+			if ft := FiletypeFromName(params["filename"]); ft != "" {
+				return ft
+			}
+		}
+	}
+	if ct := h.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			return contentTypes[mt]
+		}
+	}
+	return ""
+}
+
+// FiletypeFromMagic identifies the archive type from the first bytes of the
+// stream. compressed streams are assumed to hold a tarball.
+func FiletypeFromMagic(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ".zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ".tar.gz"
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ".tar.zst"
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return ".tar.xz"
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return ".tar.bz2"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return ".tar"
+	}
+	return ""
+}
+
+// DetectFiletype works out the archive type of a stream, trying the name,
+// then the response headers (which may be nil), then the magic bytes of the
+// stream itself. the returned reader must be used in place of r, since
+// sniffing consumes the start of the stream. it is returned along with
+// ErrUnknownFiletype too, so callers can still read a stream of unknown type.
+func DetectFiletype(name string, h http.Header, r io.Reader) (string, io.Reader, error) {
+	if ft := FiletypeFromName(name); ft != "" {
+		return ft, r, nil
+	}
+	if h != nil {
+		if ft := FiletypeFromHeaders(h); ft != "" {
+			return ft, r, nil
+		}
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	if ft := FiletypeFromMagic(head); ft != "" {
+		return ft, br, nil
+	}
+	return "", br, ErrUnknownFiletype
+}
@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiletypeFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "content disposition filename",
+			headers: map[string]string{"Content-Disposition": `attachment; filename="site.tar.zst"`},
+			want:    ".tar.zst",
+		},
+		{
+			name: "disposition wins over type",
+			headers: map[string]string{
+				"Content-Disposition": `attachment; filename="site.zip"`,
+				"Content-Type":        "application/gzip",
+			},
+			want: ".zip",
+		},
+		{
+			name: "disposition without archive name falls back to type",
+			headers: map[string]string{
+				"Content-Disposition": `attachment; filename="latest"`,
+				"Content-Type":        "application/x-xz",
+			},
+			want: ".tar.xz",
+		},
+		{
+			name:    "content type with params",
+			headers: map[string]string{"Content-Type": "application/zip; charset=binary"},
+			want:    ".zip",
+		},
+		{
+			name:    "oci layer media type",
+			headers: map[string]string{"Content-Type": "application/vnd.oci.image.layer.v1.tar+zstd"},
+			want:    ".tar.zst",
+		},
+		{
+			name:    "generic content type",
+			headers: map[string]string{"Content-Type": "application/octet-stream"},
+			want:    "",
+		},
+		{
+			name: "no headers",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			require.Equal(t, tt.want, FiletypeFromHeaders(h))
+		})
+	}
+}
+
+func TestDetectFiletype(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "extension", path: "/site.tar.gz", data: buildZip(t, testEntries), want: ".tar.gz"},
+		{
+			name:    "header beats magic",
+			path:    "/releases/latest",
+			headers: map[string]string{"Content-Type": "application/zip"},
+			data:    buildTar(t, testEntries),
+			want:    ".zip",
+		},
+		{name: "zip magic", path: "/releases/latest", data: buildZip(t, testEntries), want: ".zip"},
+		{name: "gzip magic", path: "/releases/latest", data: buildTarGz(t, testEntries), want: ".tar.gz"},
+		{name: "zstd magic", path: "/releases/latest", data: buildTarZst(t, testEntries), want: ".tar.zst"},
+		{name: "xz magic", path: "/releases/latest", data: buildTarXz(t, testEntries), want: ".tar.xz"},
+		{name: "bzip2 magic", path: "/releases/latest", data: readFixture(t, "site.tar.bz2"), want: ".tar.bz2"},
+		{name: "tar magic", path: "/releases/latest", data: buildTar(t, testEntries), want: ".tar"},
+		{name: "unknown", path: "/releases/latest", data: []byte("<html>not an archive</html>"), wantErr: true},
+		{name: "empty", path: "/releases/latest", data: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h http.Header
+			if tt.headers != nil {
+				h = make(http.Header)
+				for k, v := range tt.headers {
+					h.Set(k, v)
+				}
+			}
+			ft, rd, err := DetectFiletype(tt.path, h, bytes.NewReader(tt.data))
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrUnknownFiletype)
+				data, err := io.ReadAll(rd)
+				require.NoError(t, err)
+				require.Equal(t, string(tt.data), string(data))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ft)
+
+			// sniffing must not lose any of the stream
+			data, err := io.ReadAll(rd)
+			require.NoError(t, err)
+			require.Equal(t, tt.data, data)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// tarIndexFs is a read-only afero.Fs over an uncompressed tar archive. the
+// archive is scanned once to record the offset of every entry, file contents
+// are then read on demand through an io.ReaderAt, so nothing but the index is
+// held in memory.
+type tarIndexFs struct {
+	ra      io.ReaderAt
+	entries map[string]*tarEntry
+}
+
+type tarEntry struct {
+	name     string // absolute slash-separated path
+	hdr      *tar.Header
+	offset   int64
+	children []string // sorted base names, directories only
+}
+
+func (e *tarEntry) isDir() bool {
+	return e.hdr.Typeflag == tar.TypeDir
+}
+
+// newTarIndexFs indexes the tar stream read from rs. rs must be positioned at
+// the start of the archive, and ra must read from the same underlying data.
+func newTarIndexFs(rs io.ReadSeeker, ra io.ReaderAt) (*tarIndexFs, error) {
+	t := &tarIndexFs{
+		ra:      ra,
+		entries: make(map[string]*tarEntry),
+	}
+	children := make(map[string]map[string]struct{})
+	t.addDir("/", nil, children)
+
+	var links []*tar.Header
+	tr := tar.NewReader(rs)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanTarPath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			t.addDir(name, hdr, children)
+		case tar.TypeReg:
+			// tar.Reader never reads ahead, so the stream is positioned at the data
+			offset, err := rs.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			t.addParents(name, children)
+			t.entries[name] = &tarEntry{name: name, hdr: hdr, offset: offset}
+		case tar.TypeSymlink, tar.TypeLink:
+			links = append(links, hdr)
+		}
+	}
+
+	// links are resolved once every regular file is known, repeating until
+	// chains of links settle. links to directories or to paths outside of the
+	// archive are dropped.
+	for len(links) > 0 {
+		var pending []*tar.Header
+		for _, hdr := range links {
+			target := t.resolveLink(hdr)
+			if target == nil {
+				pending = append(pending, hdr)
+				continue
+			}
+			if target.isDir() {
+				continue
+			}
+			name := cleanTarPath(hdr.Name)
+			cp := *target.hdr
+			cp.Name = hdr.Name
+			t.addParents(name, children)
+			t.entries[name] = &tarEntry{name: name, hdr: &cp, offset: target.offset}
+		}
+		if len(pending) == len(links) {
+			break
+		}
+		links = pending
+	}
+
+	for dir, names := range children {
+		e := t.entries[dir]
+		for n := range names {
+			e.children = append(e.children, n)
+		}
+		sort.Strings(e.children)
+	}
+	return t, nil
+}
+
+func (t *tarIndexFs) addDir(name string, hdr *tar.Header, children map[string]map[string]struct{}) {
+	if hdr == nil {
+		hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+	}
+	if e, ok := t.entries[name]; ok {
+		// an explicit entry replaces a synthesized one but keeps its children
+		e.hdr = hdr
+		return
+	}
+	t.entries[name] = &tarEntry{name: name, hdr: hdr}
+	if _, ok := children[name]; !ok {
+		children[name] = make(map[string]struct{})
+	}
+	if name != "/" {
+		t.addParents(name, children)
+	}
+}
+
+// addParents makes sure every parent of name exists and lists name as a child
+func (t *tarIndexFs) addParents(name string, children map[string]map[string]struct{}) {
+	dir := path.Dir(name)
+	if _, ok := t.entries[dir]; !ok {
+		t.addDir(dir, nil, children)
+	}
+	children[dir][path.Base(name)] = struct{}{}
+}
+
+func (t *tarIndexFs) resolveLink(hdr *tar.Header) *tarEntry {
+	target := hdr.Linkname
+	if hdr.Typeflag == tar.TypeSymlink && !path.IsAbs(target) {
+		target = path.Join(path.Dir(cleanTarPath(hdr.Name)), target)
+	}
+	e, ok := t.entries[cleanTarPath(target)]
+	if !ok {
+		return nil
+	}
+	return e
+}
+
+func cleanTarPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func (t *tarIndexFs) lookup(op, name string) (*tarEntry, error) {
+	e, ok := t.entries[cleanTarPath(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t *tarIndexFs) Open(name string) (afero.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &tarIndexFile{fs: t, entry: e}
+	if !e.isDir() {
+		f.data = io.NewSectionReader(t.ra, e.offset, e.hdr.Size)
+	}
+	return f, nil
+}
+
+func (t *tarIndexFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag != os.O_RDONLY {
+		return nil, syscall.EROFS
+	}
+	return t.Open(name)
+}
+
+func (t *tarIndexFs) Stat(name string) (os.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.hdr.FileInfo(), nil
+}
+
+func (t *tarIndexFs) Name() string                                        { return "tarindexfs" }
+func (t *tarIndexFs) Create(name string) (afero.File, error)              { return nil, syscall.EROFS }
+func (t *tarIndexFs) Mkdir(name string, perm os.FileMode) error           { return syscall.EROFS }
+func (t *tarIndexFs) MkdirAll(path string, perm os.FileMode) error        { return syscall.EROFS }
+func (t *tarIndexFs) Remove(name string) error                            { return syscall.EROFS }
+func (t *tarIndexFs) RemoveAll(path string) error                         { return syscall.EROFS }
+func (t *tarIndexFs) Rename(oldname, newname string) error                { return syscall.EROFS }
+func (t *tarIndexFs) Chmod(name string, mode os.FileMode) error           { return syscall.EROFS }
+func (t *tarIndexFs) Chown(name string, uid, gid int) error               { return syscall.EROFS }
+func (t *tarIndexFs) Chtimes(name string, a time.Time, m time.Time) error { return syscall.EROFS }
+
+// tarIndexFile is an open entry of a tarIndexFs
+type tarIndexFile struct {
+	fs     *tarIndexFs
+	entry  *tarEntry
+	data   *io.SectionReader // nil for directories
+	dirPos int
+	closed bool
+}
+
+func (f *tarIndexFile) Close() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *tarIndexFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.Read(p)
+}
+
+func (f *tarIndexFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.ReadAt(p, off)
+}
+
+func (f *tarIndexFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.data == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.data.Seek(offset, whence)
+}
+
+func (f *tarIndexFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.data != nil {
+		return nil, syscall.ENOTDIR
+	}
+	names := f.entry.children[f.dirPos:]
+	if count > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > count {
+			names = names[:count]
+		}
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		infos = append(infos, f.fs.entries[path.Join(f.entry.name, n)].hdr.FileInfo())
+	}
+	f.dirPos += len(names)
+	return infos, nil
+}
+
+func (f *tarIndexFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, fi := range infos {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *tarIndexFile) Name() string                             { return f.entry.name }
+func (f *tarIndexFile) Stat() (os.FileInfo, error)               { return f.entry.hdr.FileInfo(), nil }
+func (f *tarIndexFile) Sync() error                              { return nil }
+func (f *tarIndexFile) Write(p []byte) (int, error)              { return 0, syscall.EROFS }
+func (f *tarIndexFile) WriteAt(p []byte, off int64) (int, error) { return 0, syscall.EROFS }
+func (f *tarIndexFile) WriteString(s string) (int, error)        { return 0, syscall.EROFS }
+func (f *tarIndexFile) Truncate(size int64) error                { return syscall.EROFS }
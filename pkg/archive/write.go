@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// WriteArchive packs fsys into w as an archive of type ft, which is one of
+// .zip, .tar or .tar.gz
+func WriteArchive(ft string, w io.Writer, fsys fs.FS) error {
+	switch ft {
+	case ".zip":
+		zw := zip.NewWriter(w)
+		if err := zw.AddFS(fsys); err != nil {
+			return err
+		}
+		return zw.Close()
+	case ".tar":
+		tw := tar.NewWriter(w)
+		if err := tw.AddFS(fsys); err != nil {
+			return err
+		}
+		return tw.Close()
+	case ".tar.gz":
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		if err := tw.AddFS(fsys); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	return fmt.Errorf("unsupported file type for writing: %s", ft)
+}
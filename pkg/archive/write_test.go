@@ -0,0 +1,32 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteArchive(t *testing.T) {
+	src := fstest.MapFS{
+		"index.html":          {Data: []byte("<h1>home</h1>")},
+		"assets/app.js":       {Data: []byte("console.log(1)")},
+		"docs/guide/intro.md": {Data: []byte("# intro")},
+	}
+	for _, ft := range []string{".zip", ".tar", ".tar.gz"} {
+		t.Run(ft, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, WriteArchive(ft, &buf, src))
+			fsys, err := FilesystemFromReader(ft, &buf)
+			require.NoError(t, err)
+			for name, f := range src {
+				data, err := afero.ReadFile(fsys, name)
+				require.NoError(t, err, name)
+				require.Equal(t, string(f.Data), string(data))
+			}
+		})
+	}
+	require.ErrorContains(t, WriteArchive(".tar.zst", &bytes.Buffer{}, src), "unsupported")
+}
@@ -0,0 +1,22 @@
+// package fsmap has helpers for caddy's FileSystems map
+package fsmap
+
+import (
+	"io/fs"
+	"reflect"
+)
+
+// Unwrap returns the filesystem that was registered, from the wrapper the
+// FileSystems map hands out. the wrapper is unexported, but embeds it as FS.
+// handlers use it to find out what module a filesystem they are given is.
+func Unwrap(fsys fs.FS) fs.FS {
+	v := reflect.ValueOf(fsys)
+	if v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct {
+		if inner := v.Elem().FieldByName("FS"); inner.IsValid() && inner.CanInterface() {
+			if inner, ok := inner.Interface().(fs.FS); ok && inner != nil {
+				return inner
+			}
+		}
+	}
+	return fsys
+}
@@ -0,0 +1,27 @@
+package fsmap
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnwrap(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	fileSystems := ctx.FileSystems()
+
+	registered := fstest.MapFS{"index.html": {Data: []byte("hi")}}
+	fileSystems.Register("site", registered)
+	fsys, ok := fileSystems.Get("site")
+	require.True(t, ok)
+	_, isMap := fsys.(fstest.MapFS)
+	require.False(t, isMap, "the map wraps what is registered")
+	require.Equal(t, registered, Unwrap(fsys))
+
+	// anything else is returned as is
+	require.Equal(t, registered, Unwrap(registered))
+}
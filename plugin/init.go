@@ -5,5 +5,6 @@ import (
 	_ "github.com/gfx-labs/swim/plugin/localfs"
 	_ "github.com/gfx-labs/swim/plugin/mergefs"
 	_ "github.com/gfx-labs/swim/plugin/prerender"
+	_ "github.com/gfx-labs/swim/plugin/uploadfs"
 	_ "github.com/gfx-labs/swim/plugin/vfs"
 )
@@ -2,9 +2,21 @@ package localfs
 
 import (
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/gfx-labs/swim/modules/localfs"
 )
 
 func init() {
 	caddy.RegisterModule(&localfs.Localfs{})
+	caddy.RegisterModule(&localfs.PinRelease{})
+	httpcaddyfile.RegisterHandlerDirective("localfs_release", parsePinRelease)
+	// runs after the fs directive has named the filesystem to pin
+	httpcaddyfile.RegisterDirectiveOrder("localfs_release", httpcaddyfile.After, "fs")
+}
+
+func parsePinRelease(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var p localfs.PinRelease
+	err := p.UnmarshalCaddyfile(h.Dispenser)
+	return &p, err
 }
@@ -2,9 +2,21 @@ package mergefs
 
 import (
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/gfx-labs/swim/modules/mergefs"
 )
 
 func init() {
 	caddy.RegisterModule(&mergefs.Mergefs{})
+	caddy.RegisterModule(&mergefs.MergeLayers{})
+	httpcaddyfile.RegisterHandlerDirective("merge_layers", parseMergeLayers)
+	// picks the view of the filesystem that the fs directive set
+	httpcaddyfile.RegisterDirectiveOrder("merge_layers", httpcaddyfile.After, "fs")
+}
+
+func parseMergeLayers(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m mergefs.MergeLayers
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
 }
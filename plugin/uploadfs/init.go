@@ -0,0 +1,22 @@
+package uploadfs
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gfx-labs/swim/modules/uploadfs"
+)
+
+func init() {
+	caddy.RegisterModule(&uploadfs.Uploadfs{})
+	caddy.RegisterModule(&uploadfs.Dav{})
+	httpcaddyfile.RegisterHandlerDirective("upload_dav", parseDav)
+	// it answers the request itself, like file_server does
+	httpcaddyfile.RegisterDirectiveOrder("upload_dav", httpcaddyfile.Before, "file_server")
+}
+
+func parseDav(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var d uploadfs.Dav
+	err := d.UnmarshalCaddyfile(h.Dispenser)
+	return &d, err
+}
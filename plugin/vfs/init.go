@@ -2,9 +2,22 @@ package vfs
 
 import (
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/gfx-labs/swim/modules/vfs"
 )
 
 func init() {
 	caddy.RegisterModule(&vfs.Vfs{})
+	caddy.RegisterModule(&vfs.Tenants{})
+	httpcaddyfile.RegisterHandlerDirective("vfs_tenants", parseTenants)
+	// like github_preview, this picks the filesystem for downstream
+	// try_files / file_server
+	httpcaddyfile.RegisterDirectiveOrder("vfs_tenants", httpcaddyfile.After, "fs")
+}
+
+func parseTenants(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var t vfs.Tenants
+	err := t.UnmarshalCaddyfile(h.Dispenser)
+	return &t, err
 }